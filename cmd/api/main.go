@@ -5,9 +5,12 @@ import (
 	"log/slog"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lckrugel/rinha-backend-25/internal/chaos"
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
 	"github.com/lckrugel/rinha-backend-25/internal/handlers"
 	"github.com/lckrugel/rinha-backend-25/internal/repositories"
 	"github.com/lckrugel/rinha-backend-25/internal/workers"
@@ -48,44 +51,281 @@ func setupLogger() {
 	slog.SetDefault(logger)
 }
 
-func registerRoutes(r *gin.Engine, h *handlers.PaymentHandlers) {
-	r.POST("payments", h.HandlePayment)
-	r.GET("payments-summary", h.HandlePaymentSummary)
-	r.POST("payments-purge", h.PurgePayments)
+// auth nil deixa as rotas públicas abertas.
+func registerRoutes(r *gin.Engine, h *handlers.PaymentHandlers, adminToken string, auth *handlers.APIKeyAuth) {
+	api := r.Group("")
+	if auth != nil {
+		api.Use(auth.Middleware())
+	}
+	api.Use(h.ResolveTenant())
+	api.POST("payments", h.HandlePayment)
+	api.POST("payments/batch", h.HandlePaymentBatch)
+	api.POST("payments/:correlationId/refund", h.HandleRefund)
+	api.GET("payments-summary", h.HandlePaymentSummary)
+	api.GET("payments/events", h.StreamEvents)
+	api.GET("payments/export", h.ExportPayments)
+	api.GET("payments/:correlationId", h.GetPaymentStatus)
+	api.POST("payments-purge", handlers.RequireAdminToken(adminToken), h.PurgePayments)
+}
+
+func registerAdminRoutes(r *gin.Engine, h *handlers.AdminHandlers, auth *handlers.APIKeyAuth, token string) {
+	admin := r.Group("admin", handlers.RequireAdminToken(token))
+	admin.GET("state", h.GetState)
+	admin.PUT("pin", h.PinProcessor)
+	admin.DELETE("pin", h.UnpinProcessor)
+	admin.POST("workers/pause", h.PauseWorkers)
+	admin.POST("workers/resume", h.ResumeWorkers)
+	admin.GET("webhooks/log", h.GetWebhookLog)
+	admin.GET("tenants", h.ListTenants)
+	admin.POST("tenants", h.RegisterTenant)
+
+	if auth != nil {
+		admin.POST("api-keys", auth.CreateAPIKey)
+		admin.DELETE("api-keys", auth.RevokeAPIKey)
+	}
+
+	if chaos.Enabled() {
+		admin.GET("chaos", handlers.ListFaults)
+		admin.PUT("chaos", handlers.SetFault)
+		admin.DELETE("chaos", handlers.ClearFaults)
+	}
 }
 
 func main() {
 	setupLogger()
 	time.Sleep(1 * time.Second)
 
-	redisHost := os.Getenv("REDIS_HOST")
-	redisPassword := os.Getenv("REDIS_PASSWORD")
-	redisRepo := repositories.NewRedisRepository(redisHost+":6379", redisPassword)
+	if os.Getenv("CHAOS_ENABLED") == "true" {
+		chaos.Enable()
+	}
+
+	if url := os.Getenv("PROCESSOR_DEFAULT_URL"); url != "" {
+		dtos.ApiUrl[dtos.DEFAULT_API] = url
+	}
+	if url := os.Getenv("PROCESSOR_FALLBACK_URL"); url != "" {
+		dtos.ApiUrl[dtos.FALLBACK_API] = url
+	}
+
+	redisMode, ok := repositories.ParseRedisMode(os.Getenv("REDIS_MODE"))
+	if !ok {
+		slog.Error("REDIS_MODE deve ser 'standalone', 'sentinel' ou 'cluster'", "value", os.Getenv("REDIS_MODE"))
+		os.Exit(1)
+	}
+	// REDIS_ADDRS lista os sentinels ou os nós do cluster; sem ele vale o REDIS_HOST
+	redisAddrs := []string{os.Getenv("REDIS_HOST") + ":6379"}
+	if addrs := os.Getenv("REDIS_ADDRS"); addrs != "" {
+		redisAddrs = strings.Split(addrs, ",")
+	}
+	if redisMode == repositories.RedisSentinel && os.Getenv("REDIS_MASTER_NAME") == "" {
+		slog.Error("REDIS_MASTER_NAME é obrigatório com REDIS_MODE=sentinel")
+		os.Exit(1)
+	}
+	redisRepo := repositories.NewRedisRepositoryWithConfig(repositories.RedisConfig{
+		Mode:             redisMode,
+		Addrs:            redisAddrs,
+		Password:         os.Getenv("REDIS_PASSWORD"),
+		MasterName:       os.Getenv("REDIS_MASTER_NAME"),
+		SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+	})
 	defer redisRepo.Close()
+	// O formato binário é opcional: só depois que todas as instâncias o leem
+	if name := os.Getenv("RECORD_ENCODING"); name != "" {
+		encoding, ok := repositories.ParseEncoding(name)
+		if !ok {
+			slog.Error("RECORD_ENCODING deve ser 'binary' ou 'json'", "value", name)
+			os.Exit(1)
+		}
+		redisRepo.SetEncoding(encoding)
+	}
+	// Os tempos de cada pagamento aumentam o registro; só com RECORD_TIMING
+	redisRepo.SetRecordTiming(os.Getenv("RECORD_TIMING") == "true")
+	// Só processadores com a rota de reembolso recebem reembolsos
+	for api, env := range map[dtos.PaymentAPI]string{
+		dtos.DEFAULT_API:  "PROCESSOR_DEFAULT_REFUNDS",
+		dtos.FALLBACK_API: "PROCESSOR_FALLBACK_REFUNDS",
+	} {
+		redisRepo.SetRefundable(api, os.Getenv(env) == "true")
+	}
+	// Sem o cache os scripts ainda rodam, via EVAL na primeira chamada
+	if loaded, err := redisRepo.LoadScripts(context.Background()); err != nil {
+		slog.Warn("Falha ao carregar scripts Lua", "err", err)
+	} else {
+		slog.Info("Scripts Lua carregados", "scripts", loaded)
+	}
+
+	// Sem segredo qualquer um forjaria a assinatura dos webhooks
+	webhookSecret := os.Getenv("WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		slog.Error("WEBHOOK_SECRET é obrigatório")
+		os.Exit(1)
+	}
+	if hosts := os.Getenv("WEBHOOK_ALLOWED_HOSTS"); hosts != "" {
+		workers.SetAllowedCallbackHosts(strings.Split(hosts, ","))
+	}
 
 	paymentHandlers := handlers.NewPaymentHandlers(redisRepo)
+	if maxClients, err := strconv.Atoi(os.Getenv("MAX_SSE_CLIENTS")); err == nil && maxClients > 0 {
+		paymentHandlers.SetMaxEventClients(maxClients)
+	}
+
+	adminToken := os.Getenv("ADMIN_TOKEN")
+
+	var auth *handlers.APIKeyAuth
+	if os.Getenv("AUTH_ENABLED") == "true" {
+		staticKeys, err := handlers.ParseAPIKeys(os.Getenv("API_KEYS"))
+		if err != nil {
+			slog.Error("Erro ao ler API_KEYS", "err", err)
+			os.Exit(1)
+		}
+		auth = handlers.NewAPIKeyAuth(redisRepo, staticKeys)
+		for _, key := range staticKeys {
+			if err := redisRepo.RegisterTenant(context.Background(), key.Tenant); err != nil {
+				slog.Error("Erro ao registrar tenant", "tenant", key.Tenant, "err", err)
+				os.Exit(1)
+			}
+		}
+	}
+	// TENANTS registra tenants sem chave de API, além dos da API administrativa
+	for _, tenant := range strings.Split(os.Getenv("TENANTS"), ",") {
+		tenant = strings.TrimSpace(tenant)
+		if tenant == "" {
+			continue
+		}
+		if !repositories.ValidTenant(tenant) {
+			slog.Error("Tenant inválido em TENANTS", "tenant", tenant)
+			os.Exit(1)
+		}
+		if err := redisRepo.RegisterTenant(context.Background(), tenant); err != nil {
+			slog.Error("Erro ao registrar tenant", "tenant", tenant, "err", err)
+			os.Exit(1)
+		}
+	}
 
 	r := setupRouter()
-	registerRoutes(r, paymentHandlers)
+	registerRoutes(r, paymentHandlers, adminToken, auth)
 
 	selector := workers.NewServiceSelector()
+	// Moedas de processadores que não as declaram no service-health
+	for api, env := range map[dtos.PaymentAPI]string{
+		dtos.DEFAULT_API:  "PROCESSOR_DEFAULT_CURRENCIES",
+		dtos.FALLBACK_API: "PROCESSOR_FALLBACK_CURRENCIES",
+	} {
+		if currencies := os.Getenv(env); currencies != "" {
+			selector.SetCurrencies(api, strings.Split(currencies, ","))
+		}
+	}
 
 	biasStr := os.Getenv("DEFAULT_API_BIAS")
 	bias, err := strconv.ParseInt(biasStr, 10, 0)
 	if err != nil {
 		bias = 3
 	}
-	healthChecker := workers.NewHealthCheckWorker(selector, int(bias))
+	instanceId := redisRepo.ConsumerId
+	if instanceId == "" {
+		instanceId, _ = os.Hostname()
+	}
+	healthChecker := workers.NewHealthCheckWorker(selector, redisRepo, instanceId, int(bias))
+	stateSync := workers.NewStateSync(redisRepo, selector, instanceId)
+
+	reconcileCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	reconciler := workers.NewReconciler(redisRepo)
+	err = reconciler.Run(reconcileCtx)
+	if err != nil {
+		slog.Error("Erro ao reconciliar pagamentos pendentes", "err", err)
+	}
+	cancel()
+	go reconciler.Start(context.Background(), 30*time.Second, instanceId)
 
-	workers := workers.NewWorkers(redisRepo, selector)
+	paymentWorkers := workers.NewWorkers(redisRepo, selector)
 	nWorkersStr := os.Getenv("N_WORKERS")
 	nWorkers, err := strconv.ParseInt(nWorkersStr, 10, 0)
 	if err != nil {
 		nWorkers = 1
 	}
 
+	auditInterval, err := time.ParseDuration(os.Getenv("SUMMARY_AUDIT_INTERVAL"))
+	if err == nil && auditInterval > 0 {
+		auditToken := os.Getenv("PROCESSOR_ADMIN_TOKEN")
+		if auditToken == "" {
+			auditToken = "123"
+		}
+		auditor := workers.NewSummaryAuditor(redisRepo, auditToken, os.Getenv("SUMMARY_AUDIT_LIST_MISSING") == "true")
+		go auditor.Start(context.Background(), auditInterval, auditInterval, 5*time.Second)
+	}
+
+	maxBacklog, err := strconv.ParseInt(os.Getenv("MAX_BACKLOG"), 10, 64)
+	if err != nil {
+		maxBacklog = 0
+	}
+	redisRepo.SetMaxBacklog(maxBacklog)
+	go workers.NewBacklogMonitor(redisRepo, maxBacklog).Start(context.Background(), time.Second)
+
+	go stateSync.Start(context.Background())
 	go healthChecker.Start(context.Background())
-	go workers.StartWorkers(context.Background(), int(nWorkers))
+	go paymentWorkers.StartWorkers(context.Background(), int(nWorkers))
+	go paymentWorkers.StartReclaimer(context.Background(), time.Minute)
+
+	nWebhookWorkers, err := strconv.ParseInt(os.Getenv("WEBHOOK_WORKERS"), 10, 0)
+	if err != nil {
+		nWebhookWorkers = 1
+	}
+	webhookWorkers := workers.NewWebhookWorkers(redisRepo, webhookSecret)
+	go webhookWorkers.Start(context.Background(), int(nWebhookWorkers))
+
+	nRefundWorkers, err := strconv.ParseInt(os.Getenv("REFUND_WORKERS"), 10, 0)
+	if err != nil {
+		nRefundWorkers = 1
+	}
+	go workers.NewRefundWorkers(redisRepo).Start(context.Background(), int(nRefundWorkers))
+
+	// Retenção desligada sem RETENTION_MAX_AGE
+	retentionMaxAge, err := time.ParseDuration(os.Getenv("RETENTION_MAX_AGE"))
+	if err == nil && retentionMaxAge > 0 {
+		retentionInterval, err := time.ParseDuration(os.Getenv("RETENTION_INTERVAL"))
+		if err != nil || retentionInterval <= 0 {
+			retentionInterval = time.Minute
+		}
+
+		var archiver repositories.Archiver
+		if databaseUrl := os.Getenv("ARCHIVE_DATABASE_URL"); databaseUrl != "" {
+			connectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			archiver, err = repositories.NewPostgresArchiver(connectCtx, databaseUrl)
+			cancel()
+			if err != nil {
+				slog.Error("Erro ao iniciar arquivo no Postgres", "err", err)
+				os.Exit(1)
+			}
+		} else {
+			// O líder da retenção muda entre as instâncias: o diretório precisa
+			// ser um volume compartilhado, senão o arquivo fica espalhado
+			archiveDir := os.Getenv("ARCHIVE_DIR")
+			if archiveDir == "" {
+				slog.Error("Com RETENTION_MAX_AGE, ARCHIVE_DATABASE_URL ou ARCHIVE_DIR (volume compartilhado) é obrigatório")
+				os.Exit(1)
+			}
+			archiver = repositories.NewFileArchiver(archiveDir)
+		}
+		defer archiver.Close()
+
+		retention := workers.NewRetentionWorker(redisRepo, archiver, retentionMaxAge, instanceId)
+		go retention.Start(context.Background(), retentionInterval)
+	}
+
+	// A API administrativa escuta numa porta própria, que o nginx não expõe
+	if adminToken != "" {
+		adminPort := os.Getenv("ADMIN_PORT")
+		if adminPort == "" {
+			adminPort = "8081"
+		}
+		adminRouter := setupRouter()
+		registerAdminRoutes(adminRouter, handlers.NewAdminHandlers(redisRepo, selector, paymentWorkers, instanceId), auth, adminToken)
+		go func() {
+			slog.Info("Admin API is running on port " + adminPort)
+			if err := adminRouter.Run(":" + adminPort); err != nil {
+				slog.Error("Erro ao iniciar API administrativa", "err", err)
+			}
+		}()
+	}
 
 	slog.Info("API is running on port 8080")
 	r.Run(":8080")
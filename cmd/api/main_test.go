@@ -0,0 +1,1863 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/lckrugel/rinha-backend-25/internal/chaos"
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/handlers"
+	"github.com/lckrugel/rinha-backend-25/internal/processorsim"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+	"github.com/lckrugel/rinha-backend-25/internal/workers"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	testAdminToken    = "admin-test"
+	testWebhookSecret = "whsec-test"
+)
+
+// testEnv monta o caminho completo de um pagamento sem docker: o router da API,
+// um Redis em memória (miniredis) e os dois processadores simulados.
+type testEnv struct {
+	t           *testing.T
+	redis       *miniredis.Miniredis
+	repo        *repositories.RedisRepository
+	router      *gin.Engine
+	selector    *workers.ServiceSelector
+	defaultSim  *processorsim.Simulator
+	fallbackSim *processorsim.Simulator
+	startedAt   time.Time
+
+	stopWorkers context.CancelFunc
+	workersDone chan struct{}
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	return newTestEnvWith(t, repositories.RedisConfig{})
+}
+
+// newTestEnvWith conecta no modo de cfg; os endereços são os do miniredis.
+func newTestEnvWith(t *testing.T, cfg repositories.RedisConfig) *testEnv {
+	t.Helper()
+	t.Setenv("CONSUMER_ID", "consumer-test")
+
+	mr := miniredis.RunT(t)
+	cfg.Addrs = []string{mr.Addr()}
+	repo := repositories.NewRedisRepositoryWithConfig(cfg)
+	repo.ReadBlock = 50 * time.Millisecond
+	// O simulador tem a rota de reembolso
+	repo.SetRefundable(dtos.DEFAULT_API, true)
+	repo.SetRefundable(dtos.FALLBACK_API, true)
+	t.Cleanup(func() { repo.Close() })
+
+	env := &testEnv{
+		t:           t,
+		redis:       mr,
+		repo:        repo,
+		router:      setupRouter(),
+		selector:    workers.NewServiceSelector(),
+		defaultSim:  processorsim.New(processorsim.Config{Fee: 0.05, Token: "123"}),
+		fallbackSim: processorsim.New(processorsim.Config{Fee: 0.15, Token: "123"}),
+		startedAt:   time.Now().UTC().Add(-time.Second),
+	}
+	registerRoutes(env.router, handlers.NewPaymentHandlers(repo), testAdminToken, nil)
+
+	defaultServer := httptest.NewServer(env.defaultSim.Handler())
+	fallbackServer := httptest.NewServer(env.fallbackSim.Handler())
+	t.Cleanup(defaultServer.Close)
+	t.Cleanup(fallbackServer.Close)
+
+	previous := map[dtos.PaymentAPI]string{}
+	for api, u := range dtos.ApiUrl {
+		previous[api] = u
+	}
+	dtos.ApiUrl[dtos.DEFAULT_API] = defaultServer.URL
+	dtos.ApiUrl[dtos.FALLBACK_API] = fallbackServer.URL
+	t.Cleanup(func() {
+		for api, u := range previous {
+			dtos.ApiUrl[api] = u
+		}
+	})
+
+	t.Cleanup(env.stop)
+	return env
+}
+
+func (e *testEnv) start(nWorkers int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	paymentWorkers := workers.NewWorkers(e.repo, e.selector)
+	webhookWorkers := workers.NewWebhookWorkers(e.repo, testWebhookSecret)
+	go func() {
+		defer close(done)
+		go webhookWorkers.Start(ctx, 1)
+		go workers.NewRefundWorkers(e.repo).Start(ctx, 1)
+		paymentWorkers.StartWorkers(ctx, nWorkers)
+	}()
+	e.stopWorkers = cancel
+	e.workersDone = done
+}
+
+// stop simula a queda da instância: os workers param no meio do que estiverem
+// fazendo.
+func (e *testEnv) stop() {
+	if e.stopWorkers == nil {
+		return
+	}
+	e.stopWorkers()
+	<-e.workersDone
+	e.stopWorkers = nil
+}
+
+// restart reconcilia as intenções pendentes como o main faz no startup.
+func (e *testEnv) restart(nWorkers int) {
+	e.stop()
+	err := workers.NewReconciler(e.repo).Run(context.Background())
+	if err != nil {
+		e.t.Fatalf("reconciliação falhou: %v", err)
+	}
+	e.start(nWorkers)
+}
+
+func (e *testEnv) postPayment(correlationId string, amount float64) int {
+	return e.postPaymentAs(repositories.DefaultTenant, correlationId, amount)
+}
+
+// registerTenants faz o papel do admin, que registra os tenants antes de uso.
+func (e *testEnv) registerTenants(tenants ...string) {
+	e.t.Helper()
+	for _, tenant := range tenants {
+		if err := e.repo.RegisterTenant(context.Background(), tenant); err != nil {
+			e.t.Fatalf("erro ao registrar tenant %s: %v", tenant, err)
+		}
+	}
+}
+
+func (e *testEnv) postPaymentAs(tenant, correlationId string, amount float64) int {
+	body, _ := json.Marshal(map[string]any{"correlationId": correlationId, "amount": amount})
+	req := httptest.NewRequest(http.MethodPost, "/payments", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if tenant != repositories.DefaultTenant {
+		req.Header.Set(handlers.TenantHeader, tenant)
+	}
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func (e *testEnv) summary() dtos.SummaryResponse {
+	return e.summaryFor(repositories.DefaultTenant)
+}
+
+// summaryFor consulta horas inteiras, para a janela não cortar os rollups por
+// hora dos testes de retenção.
+func (e *testEnv) summaryFor(tenant string) dtos.SummaryResponse {
+	to := time.Now().UTC().Add(time.Minute).Truncate(time.Hour).Add(time.Hour - time.Millisecond)
+	query := url.Values{}
+	query.Set("from", e.startedAt.Truncate(time.Hour).Format("2006-01-02T15:04:05.000Z"))
+	query.Set("to", to.Format("2006-01-02T15:04:05.000Z"))
+
+	req := httptest.NewRequest(http.MethodGet, "/payments-summary?"+query.Encode(), nil)
+	if tenant != repositories.DefaultTenant {
+		req.Header.Set(handlers.TenantHeader, tenant)
+	}
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		e.t.Fatalf("payments-summary retornou %d: %s", w.Code, w.Body.String())
+	}
+
+	var summary dtos.SummaryResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		e.t.Fatalf("payments-summary inválido: %v", err)
+	}
+	return summary
+}
+
+func processorSummary(t *testing.T, sim *processorsim.Simulator) dtos.ProcessorSummaryResponse {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/admin/payments-summary", nil)
+	req.Header.Set("X-Rinha-Token", "123")
+	w := httptest.NewRecorder()
+	sim.Handler().ServeHTTP(w, req)
+
+	var summary dtos.ProcessorSummaryResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("sumário do processador inválido: %v", err)
+	}
+	return summary
+}
+
+// waitForTotal espera o sumário chegar a total pagamentos e confere que ele
+// bate com o que cada processador registrou.
+func (e *testEnv) waitForTotal(total int) dtos.SummaryResponse {
+	e.t.Helper()
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		summary := e.summary()
+		if summary.Default.TotalRequests+summary.Fallback.TotalRequests >= total || time.Now().After(deadline) {
+			if got := summary.Default.TotalRequests + summary.Fallback.TotalRequests; got != total {
+				e.t.Fatalf("esperava %d pagamentos no sumário, obteve %d", total, got)
+			}
+			e.assertMatchesProcessors(summary)
+			return summary
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (e *testEnv) assertMatchesProcessors(summary dtos.SummaryResponse) {
+	e.t.Helper()
+	for name, pair := range map[string]struct {
+		local dtos.APISummary
+		sim   *processorsim.Simulator
+	}{
+		"default":  {summary.Default, e.defaultSim},
+		"fallback": {summary.Fallback, e.fallbackSim},
+	} {
+		remote := processorSummary(e.t, pair.sim)
+		if pair.local.TotalRequests != remote.TotalRequests || pair.local.TotalAmount != remote.TotalAmount {
+			e.t.Errorf("%s: sumário local %d/%.2f, processador %d/%.2f", name,
+				pair.local.TotalRequests, pair.local.TotalAmount, remote.TotalRequests, remote.TotalAmount)
+		}
+	}
+}
+
+func TestPaymentsAreSummarized(t *testing.T) {
+	env := newTestEnv(t)
+	env.start(4)
+
+	for i := range 20 {
+		if code := env.postPayment(fmt.Sprintf("pay-%d", i), 10.5); code != http.StatusOK {
+			t.Fatalf("POST /payments retornou %d", code)
+		}
+	}
+
+	summary := env.waitForTotal(20)
+	if summary.Default.TotalRequests != 20 || summary.Default.TotalAmount != 210 {
+		t.Errorf("esperava 20 pagamentos (210.00) no default, obteve %+v", summary.Default)
+	}
+}
+
+func TestFailoverWhenDefaultFails(t *testing.T) {
+	env := newTestEnv(t)
+	env.defaultSim.SetPhase(&processorsim.Phase{Failing: true})
+	env.start(2)
+
+	for i := range 10 {
+		env.postPayment(fmt.Sprintf("pay-%d", i), 1.25)
+	}
+
+	summary := env.waitForTotal(10)
+	if summary.Fallback.TotalRequests != 10 {
+		t.Errorf("esperava todos os pagamentos no fallback, obteve %+v", summary)
+	}
+}
+
+func TestProcessorRecoveryMidStream(t *testing.T) {
+	env := newTestEnv(t)
+	env.start(2)
+
+	for i := range 10 {
+		env.postPayment(fmt.Sprintf("before-%d", i), 3)
+	}
+	env.waitForTotal(10)
+
+	env.defaultSim.SetPhase(&processorsim.Phase{FailRate: 0.5})
+	env.fallbackSim.SetPhase(&processorsim.Phase{FailRate: 0.5})
+	for i := range 20 {
+		env.postPayment(fmt.Sprintf("flaky-%d", i), 3)
+	}
+
+	env.waitForTotal(30)
+}
+
+func TestRestartReconcilesInterruptedPayments(t *testing.T) {
+	env := newTestEnv(t)
+	env.defaultSim.SetPhase(&processorsim.Phase{Failing: true})
+	env.fallbackSim.SetPhase(&processorsim.Phase{Failing: true})
+	env.start(2)
+
+	for i := range 6 {
+		env.postPayment(fmt.Sprintf("pay-%d", i), 7.77)
+	}
+
+	// Os workers caem no meio das retries, deixando intenções e mensagens pendentes
+	time.Sleep(300 * time.Millisecond)
+	env.stop()
+
+	env.defaultSim.SetPhase(nil)
+	env.fallbackSim.SetPhase(nil)
+	env.restart(2)
+
+	env.waitForTotal(6)
+}
+
+func TestReconcileChargedButUnrecordedPayment(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	env.postPayment("charged", 42)
+	payments, err := env.repo.ReadFromStream(ctx, "consumer-test-0")
+	if err != nil || len(payments) != 1 {
+		t.Fatalf("esperava ler o pagamento da stream: %v", err)
+	}
+	payment := payments[0]
+
+	// O processador cobrou, mas a instância caiu antes do StoreProcessed
+	requestedAt := payment.RequestedAt.Format("2006-01-02T15:04:05.000Z")
+	err = env.repo.RecordIntent(ctx, &dtos.PaymentIntent{
+		CorrelationId: payment.CorrelationId,
+		Amount:        payment.Amount,
+		RequestedAt:   requestedAt,
+		Api:           dtos.DEFAULT_API,
+		RedisStreamId: payment.RedisStreamId,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(dtos.PaymentAPIRequest{CorrelationId: payment.CorrelationId, Amount: payment.Amount, RequestedAt: requestedAt})
+	resp, err := http.Post(dtos.ApiUrl[dtos.DEFAULT_API]+"/payments", "application/json", bytes.NewReader(body))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("esperava o processador aceitar o pagamento: %v", err)
+	}
+	resp.Body.Close()
+
+	env.restart(1)
+
+	summary := env.waitForTotal(1)
+	if summary.Default.TotalAmount != 42 {
+		t.Errorf("esperava 42.00 no default, obteve %+v", summary.Default)
+	}
+}
+
+// A primeira tentativa é aceita mas a resposta se perde; a retry recebe 422
+// de correlationId repetido e o pagamento tem que entrar como processado.
+func TestLostResponseThenDuplicateIsRecorded(t *testing.T) {
+	env := newTestEnv(t)
+
+	var dropped sync.Once
+	sim := env.defaultSim.Handler()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		drop := false
+		if r.Method == http.MethodPost && r.URL.Path == "/payments" {
+			dropped.Do(func() { drop = true })
+		}
+		if !drop {
+			sim.ServeHTTP(w, r)
+			return
+		}
+		sim.ServeHTTP(httptest.NewRecorder(), r)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	t.Cleanup(proxy.Close)
+	dtos.ApiUrl[dtos.DEFAULT_API] = proxy.URL
+
+	env.start(1)
+	env.postPayment("lost-response", 30)
+
+	summary := env.waitForTotal(1)
+	if summary.Default.TotalAmount != 30 {
+		t.Errorf("esperava 30.00 no default, obteve %+v", summary.Default)
+	}
+	if entries, _ := env.redis.Stream("payments:deadletter"); len(entries) != 0 {
+		t.Errorf("pagamento cobrado foi para a dead-letter: %+v", entries)
+	}
+	if _, status := env.paymentStatus("lost-response"); status.Status != dtos.PAYMENT_STATUS_PROCESSED {
+		t.Errorf("esperava status processed, obteve %+v", status)
+	}
+}
+
+func TestLeaderReconcilesIntentsOfDeadInstance(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	env.registerTenants("acme")
+	env.postPayment("orphan", 3)
+	env.postPaymentAs("acme", "orphan", 4)
+
+	// Outra instância lê os dois pagamentos, grava as intenções e nunca volta
+	t.Setenv("CONSUMER_ID", "dead-instance")
+	dead := repositories.NewRedisRepository(env.redis.Addr(), "")
+	defer dead.Close()
+	payments, err := dead.ReadFromStream(ctx, "dead-instance-0")
+	if err != nil || len(payments) != 2 {
+		t.Fatalf("esperava ler os dois pagamentos: %v %v", payments, err)
+	}
+	for _, payment := range payments {
+		err := dead.RecordIntent(ctx, &dtos.PaymentIntent{
+			CorrelationId: payment.CorrelationId,
+			Amount:        payment.Amount,
+			RequestedAt:   payment.RequestedAt.Format("2006-01-02T15:04:05.000Z"),
+			Api:           dtos.DEFAULT_API,
+			RedisStreamId: payment.RedisStreamId,
+			Tenant:        payment.Tenant,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fields, _ := env.redis.HKeys("payments:intents:dead-instance"); len(fields) != 2 {
+		t.Fatalf("o mesmo correlationId em dois tenants deveria gerar duas intenções: %v", fields)
+	}
+
+	if err := workers.NewReconciler(env.repo).RunStale(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if env.redis.Exists("payments:intents:dead-instance") {
+		t.Error("as intenções da instância morta deveriam ter sido adotadas")
+	}
+	if owners, _ := env.redis.Members("payments:intents"); len(owners) != 0 {
+		t.Errorf("instância sem intenções continua registrada: %v", owners)
+	}
+
+	// Nenhum processador recebeu os pagamentos: os dois voltam para a fila do
+	// seu tenant e as mensagens antigas recebem ack
+	if stats, err := env.repo.GetStreamStats(ctx); err != nil || stats.Pending != 0 {
+		t.Errorf("esperava as mensagens da instância morta confirmadas: %+v (%v)", stats, err)
+	}
+	if entries, _ := env.redis.Stream("tenants:acme:payments:stream"); len(entries) != 2 {
+		t.Errorf("esperava o pagamento do acme reenfileirado, a stream tem %d entradas", len(entries))
+	}
+
+	env.start(1)
+	env.waitForTotal(1)
+}
+
+func TestDuplicateSubmissionsCountedOnce(t *testing.T) {
+	env := newTestEnv(t)
+	env.start(2)
+
+	for range 3 {
+		env.postPayment("same-id", 5)
+	}
+	env.postPayment("other-id", 5)
+
+	env.waitForTotal(2)
+
+	// Dá tempo para as duplicatas passarem pelos workers antes de conferir de novo
+	time.Sleep(200 * time.Millisecond)
+	env.waitForTotal(2)
+}
+
+func TestChaosKeepsExactlyOnceSummaries(t *testing.T) {
+	chaos.Enable()
+	t.Cleanup(chaos.ClearAll)
+
+	env := newTestEnv(t)
+	faults := []chaos.Fault{
+		{Point: chaos.POINT_BEFORE_STORE, Action: chaos.ACTION_ERROR, Count: 3},
+		{Point: chaos.POINT_REDIS + "script:complete", Action: chaos.ACTION_ERROR, Count: 2},
+		{Point: chaos.POINT_PAYMENT_API, Action: chaos.ACTION_ERROR, Probability: 0.3},
+	}
+	for _, f := range faults {
+		if err := chaos.Set(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env.start(3)
+
+	for i := range 15 {
+		env.postPayment(fmt.Sprintf("pay-%d", i), 2.5)
+	}
+
+	// Espera as falhas de uma vez só se esgotarem antes da "queda"
+	deadline := time.Now().Add(5 * time.Second)
+	for len(chaos.List()) > 1 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	chaos.ClearAll()
+	time.Sleep(200 * time.Millisecond)
+
+	env.restart(3)
+	env.waitForTotal(15)
+}
+
+func (e *testEnv) purge(query, token string) int {
+	req := httptest.NewRequest(http.MethodPost, "/payments-purge?"+query, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestPurgeIsScopedAndAuthenticated(t *testing.T) {
+	env := newTestEnv(t)
+	env.defaultSim.SetPhase(&processorsim.Phase{Failing: true})
+	env.start(2)
+
+	for i := range 10 {
+		env.postPayment(fmt.Sprintf("pay-%d", i), 1)
+	}
+	env.waitForTotal(10)
+
+	if code := env.purge("", ""); code != http.StatusUnauthorized {
+		t.Fatalf("purge sem token retornou %d", code)
+	}
+
+	if code := env.purge("processor=default", testAdminToken); code != http.StatusOK {
+		t.Fatalf("purge do default retornou %d", code)
+	}
+	if summary := env.summary(); summary.Fallback.TotalRequests != 10 {
+		t.Errorf("purge do default apagou o fallback: %+v", summary)
+	}
+
+	// Uma intenção pendente do tenant não pode trazer o pagamento de volta
+	err := env.repo.RecordIntent(context.Background(), &dtos.PaymentIntent{
+		CorrelationId: "pay-0",
+		Amount:        1,
+		RequestedAt:   time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		Api:           dtos.FALLBACK_API,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := env.purge("queue=true", testAdminToken); code != http.StatusOK {
+		t.Fatalf("purge completo retornou %d", code)
+	}
+	if summary := env.summary(); summary.Fallback.TotalRequests != 0 {
+		t.Errorf("esperava sumário vazio depois do purge, obteve %+v", summary)
+	}
+	if fields, _ := env.redis.HKeys("payments:intents:consumer-test"); len(fields) != 0 {
+		t.Errorf("o purge completo deveria apagar as intenções do tenant: %v", fields)
+	}
+
+	// Os workers continuam consumindo do read group recriado
+	env.fallbackSim.Reset()
+	env.postPayment("after-purge", 1)
+	env.waitForTotal(1)
+}
+
+func TestTenantsAreIsolated(t *testing.T) {
+	env := newTestEnv(t)
+	env.registerTenants("acme", "globex")
+	env.start(2)
+
+	for i := range 4 {
+		env.postPaymentAs("acme", fmt.Sprintf("acme-%d", i), 10)
+	}
+	for i := range 2 {
+		env.postPaymentAs("globex", fmt.Sprintf("globex-%d", i), 1)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for env.summaryFor("acme").Default.TotalRequests < 4 || env.summaryFor("globex").Default.TotalRequests < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pagamentos dos tenants não foram processados: acme=%+v globex=%+v", env.summaryFor("acme"), env.summaryFor("globex"))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if summary := env.summaryFor("acme"); summary.Default.TotalAmount != 40 {
+		t.Errorf("acme: esperava 40.00, obteve %+v", summary.Default)
+	}
+	if summary := env.summaryFor("globex"); summary.Default.TotalAmount != 2 {
+		t.Errorf("globex: esperava 2.00, obteve %+v", summary.Default)
+	}
+	if summary := env.summary(); summary.Default.TotalRequests != 0 {
+		t.Errorf("tenant padrão não deveria ver pagamentos dos outros: %+v", summary.Default)
+	}
+
+	if code := env.postPaymentAs("../etc", "bad", 1); code != http.StatusBadRequest {
+		t.Errorf("tenant inválido retornou %d", code)
+	}
+	if code := env.postPaymentAs("initech", "unknown", 1); code != http.StatusForbidden {
+		t.Errorf("tenant não registrado retornou %d", code)
+	}
+	if env.redis.Exists("tenants:initech:payments:stream") {
+		t.Error("tenant não registrado criou uma stream")
+	}
+}
+
+func TestAPIKeyAuthAndRateLimit(t *testing.T) {
+	env := newTestEnv(t)
+	auth := handlers.NewAPIKeyAuth(env.repo, map[string]dtos.APIKey{
+		"secret": {ClientId: "acme-billing", Tenant: "acme", Rate: 1, Burst: 2},
+	})
+	router := setupRouter()
+	registerRoutes(router, handlers.NewPaymentHandlers(env.repo), testAdminToken, auth)
+	env.start(1)
+
+	post := func(apiKey, tenant, correlationId string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{"correlationId": correlationId, "amount": 3})
+		req := httptest.NewRequest(http.MethodPost, "/payments", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			req.Header.Set(handlers.APIKeyHeader, apiKey)
+		}
+		if tenant != "" {
+			req.Header.Set(handlers.TenantHeader, tenant)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("", "", "no-key"); w.Code != http.StatusUnauthorized {
+		t.Errorf("sem chave retornou %d", w.Code)
+	}
+	if w := post("wrong", "", "wrong-key"); w.Code != http.StatusUnauthorized {
+		t.Errorf("chave inválida retornou %d", w.Code)
+	}
+	if w := post("secret", "globex", "other-tenant"); w.Code != http.StatusForbidden {
+		t.Errorf("tenant de outra chave retornou %d", w.Code)
+	}
+
+	for i := range 2 {
+		if w := post("secret", "", fmt.Sprintf("ok-%d", i)); w.Code != http.StatusOK {
+			t.Fatalf("requisição %d dentro do burst retornou %d", i, w.Code)
+		}
+	}
+	w := post("secret", "", "limited")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("esperava 429 com Retry-After, obteve %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		payments, err := env.repo.GetProcessedByDateRange(context.Background(), "acme", dtos.DEFAULT_API, env.startedAt, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(payments) == 2 {
+			for _, p := range payments {
+				if p.ClientId != "acme-billing" {
+					t.Errorf("pagamento %s sem o cliente: %+v", p.CorrelationId, p)
+				}
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("esperava 2 pagamentos processados para acme, obteve %d", len(payments))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWebhooksAreSignedAndRetried(t *testing.T) {
+	env := newTestEnv(t)
+
+	var mu sync.Mutex
+	received := map[string]dtos.WebhookEvent{}
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+		mac.Write([]byte(r.Header.Get("X-Webhook-Timestamp") + "." + string(body)))
+		if r.Header.Get("X-Webhook-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("assinatura inválida para %s", body)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		// A primeira entrega falha para forçar uma retry
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event dtos.WebhookEvent
+		json.Unmarshal(body, &event)
+		received[event.Id] = event
+	}))
+	t.Cleanup(receiver.Close)
+	env.selector.SetCurrencies(dtos.DEFAULT_API, []string{"BRL"})
+	env.selector.SetCurrencies(dtos.FALLBACK_API, []string{"BRL"})
+	env.start(1)
+
+	post := func(correlationId, callbackUrl, currency string) int {
+		body, _ := json.Marshal(map[string]any{"correlationId": correlationId, "amount": 4, "callbackUrl": callbackUrl, "currency": currency})
+		req := httptest.NewRequest(http.MethodPost, "/payments", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		env.router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post("bad-callback", "ftp://example.com", "BRL"); code != http.StatusBadRequest {
+		t.Errorf("callbackUrl inválido retornou %d", code)
+	}
+	// Sem WEBHOOK_ALLOWED_HOSTS só endereços públicos recebem webhooks
+	for _, internal := range []string{receiver.URL, "http://169.254.169.254/latest", "http://[::1]:6379", "http://10.0.0.5/hook"} {
+		if code := post("internal-callback", internal, "BRL"); code != http.StatusBadRequest {
+			t.Errorf("callbackUrl interno %s retornou %d", internal, code)
+		}
+	}
+	workers.SetAllowedCallbackHosts([]string{"127.0.0.1"})
+	t.Cleanup(func() { workers.SetAllowedCallbackHosts(nil) })
+	post("hooked", receiver.URL, "BRL")
+	env.waitForTotal(1)
+	// Nenhum processador aceita JPY: vai para a dead-letter
+	post("refused", receiver.URL, "JPY")
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		processed, okProcessed := received["hooked:"+dtos.WEBHOOK_PROCESSED]
+		_, okFailed := received["refused:"+dtos.WEBHOOK_FAILED]
+		mu.Unlock()
+		if okProcessed && okFailed {
+			if processed.Processor != "default" || processed.Amount != 4 {
+				t.Errorf("evento de processamento inesperado: %+v", processed)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("webhooks não entregues: %v", received)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	log, err := env.repo.GetWebhookLog(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcomes := map[string]int{}
+	for _, entry := range log {
+		outcomes[entry.Outcome]++
+	}
+	if outcomes["retrying"] != 1 || outcomes["delivered"] != 2 {
+		t.Errorf("log de entregas inesperado: %+v", log)
+	}
+}
+
+type sseEvent struct {
+	id, event string
+	data      dtos.PaymentEvent
+}
+
+// openEvents conecta no feed SSE e entrega os eventos pelo canal até o
+// contexto ser cancelado.
+func openEvents(t *testing.T, ctx context.Context, baseUrl, lastEventId string) <-chan sseEvent {
+	t.Helper()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, baseUrl+"/payments/events", nil)
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("feed retornou %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		var current sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				current.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				current.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &current.data)
+			case line == "" && current.id != "":
+				events <- current
+				current = sseEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("feed fechado antes do evento")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("nenhum evento no feed")
+	}
+	return sseEvent{}
+}
+
+func TestEventsFeedResumesFromLastEventId(t *testing.T) {
+	env := newTestEnv(t)
+	server := httptest.NewServer(env.router)
+	t.Cleanup(server.Close)
+	env.start(1)
+
+	env.registerTenants("acme")
+	ctx, cancel := context.WithCancel(context.Background())
+	events := openEvents(t, ctx, server.URL, "")
+
+	env.postPaymentAs("acme", "other-tenant", 2)
+	env.postPayment("evt-1", 9.9)
+
+	queued := nextEvent(t, events)
+	if queued.event != dtos.PAYMENT_EVENT_QUEUED || queued.data.CorrelationId != "evt-1" {
+		t.Fatalf("esperava evt-1 enfileirado, obteve %+v", queued)
+	}
+	processed := nextEvent(t, events)
+	if processed.event != dtos.PAYMENT_EVENT_PROCESSED || processed.data.Processor != "default" || processed.data.Amount != 9.9 {
+		t.Fatalf("esperava evt-1 processado, obteve %+v", processed)
+	}
+	cancel()
+
+	// Retomando do evento enfileirado o cliente recebe de novo só o que perdeu
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	resumed := nextEvent(t, openEvents(t, ctx, server.URL, queued.id))
+	if resumed.id != processed.id {
+		t.Errorf("esperava retomar em %s, obteve %+v", processed.id, resumed)
+	}
+}
+
+func TestEventsFeedLimitsConnections(t *testing.T) {
+	env := newTestEnv(t)
+	paymentHandlers := handlers.NewPaymentHandlers(env.repo)
+	paymentHandlers.SetMaxEventClients(1)
+	router := setupRouter()
+	registerRoutes(router, paymentHandlers, testAdminToken, nil)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	env.start(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := openEvents(t, ctx, server.URL, "")
+
+	resp, err := http.Get(server.URL + "/payments/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("conexão acima do limite retornou %d", resp.StatusCode)
+	}
+
+	// O cliente conectado continua recebendo pelo leitor compartilhado
+	env.postPayment("capped", 1)
+	if queued := nextEvent(t, events); queued.data.CorrelationId != "capped" {
+		t.Errorf("esperava capped enfileirado, obteve %+v", queued)
+	}
+
+	// Fechada a conexão, a vaga volta
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/payments/events", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		cancel()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("a vaga não foi liberada, feed retornou %d", resp.StatusCode)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (e *testEnv) postBatch(contentType, body string) dtos.BatchResponse {
+	e.t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/payments/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		e.t.Fatalf("POST /payments/batch retornou %d: %s", w.Code, w.Body.String())
+	}
+
+	var response dtos.BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		e.t.Fatalf("resposta do lote inválida: %v", err)
+	}
+	return response
+}
+
+func TestBatchSubmission(t *testing.T) {
+	env := newTestEnv(t)
+	env.start(2)
+	env.postPayment("single", 1)
+
+	statuses := func(response dtos.BatchResponse) []string {
+		var got []string
+		for _, result := range response.Results {
+			got = append(got, result.Status)
+		}
+		return got
+	}
+
+	array := env.postBatch("application/json", `[
+		{"correlationId": "b-1", "amount": 10},
+		{"correlationId": "b-2", "amount": 20},
+		{"correlationId": "b-1", "amount": 10},
+		{"correlationId": "b-3", "amount": -1},
+		{"correlationId": "single", "amount": 1}
+	]`)
+	want := []string{dtos.BATCH_ACCEPTED, dtos.BATCH_ACCEPTED, dtos.BATCH_DUPLICATE, dtos.BATCH_INVALID, dtos.BATCH_DUPLICATE}
+	if got := statuses(array); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("lote em array: esperava %v, obteve %v", want, got)
+	}
+
+	ndjson := env.postBatch("application/x-ndjson", "{\"correlationId\": \"b-4\", \"amount\": 5}\nnot json\n\n{\"correlationId\": \"b-2\", \"amount\": 20}\n")
+	want = []string{dtos.BATCH_ACCEPTED, dtos.BATCH_INVALID, dtos.BATCH_DUPLICATE}
+	if got := statuses(ndjson); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("lote NDJSON: esperava %v, obteve %v", want, got)
+	}
+	if ndjson.Accepted != 1 || ndjson.Invalid != 1 || ndjson.Duplicates != 1 {
+		t.Errorf("contagens do lote NDJSON: %+v", ndjson)
+	}
+
+	summary := env.waitForTotal(4)
+	if summary.Default.TotalAmount != 36 {
+		t.Errorf("esperava 36.00 processados, obteve %+v", summary.Default)
+	}
+}
+
+func (e *testEnv) refund(correlationId, body string) (int, dtos.RefundResponse) {
+	req := httptest.NewRequest(http.MethodPost, "/payments/"+correlationId+"/refund", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+
+	var response dtos.RefundResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func TestRefundsGoToOriginalProcessor(t *testing.T) {
+	env := newTestEnv(t)
+	env.defaultSim.SetPhase(&processorsim.Phase{Failing: true})
+	env.start(1)
+
+	env.postPayment("to-refund", 10)
+	env.waitForTotal(1)
+	afterPayment := time.Now().UTC()
+	// O default volta, mas o reembolso tem que ir para o fallback
+	env.defaultSim.SetPhase(nil)
+
+	if code, _ := env.refund("missing", ""); code != http.StatusNotFound {
+		t.Errorf("reembolso de pagamento inexistente retornou %d", code)
+	}
+	env.repo.SetRefundable(dtos.FALLBACK_API, false)
+	if code, _ := env.refund("to-refund", ""); code != http.StatusUnprocessableEntity {
+		t.Errorf("reembolso em processador sem reembolsos retornou %d", code)
+	}
+	env.repo.SetRefundable(dtos.FALLBACK_API, true)
+	code, partial := env.refund("to-refund", `{"amount": 4}`)
+	if code != http.StatusAccepted || partial.Processor != "fallback" || partial.Remaining != 6 {
+		t.Fatalf("reembolso parcial: %d %+v", code, partial)
+	}
+	if code, over := env.refund("to-refund", `{"amount": 7}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("reembolso acima do saldo retornou %d %+v", code, over)
+	}
+	code, rest := env.refund("to-refund", "")
+	if code != http.StatusAccepted || rest.Amount != 6 || rest.Remaining != 0 {
+		t.Fatalf("reembolso do saldo: %d %+v", code, rest)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		summary := env.summary()
+		if summary.Fallback.TotalRefunded == 10 {
+			if summary.Fallback.TotalAmount != 10 || summary.Fallback.NetAmount != 0 {
+				t.Errorf("sumário com reembolso inesperado: %+v", summary.Fallback)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("reembolsos não concluídos: %+v", summary.Fallback)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if remote := processorSummary(t, env.fallbackSim); remote.TotalRefunded != 10 {
+		t.Errorf("fallback registrou %.2f reembolsados", remote.TotalRefunded)
+	}
+	// O reembolso conta no período do pagamento original, não no em que
+	// foi concluído
+	query := url.Values{"from": {afterPayment.Format("2006-01-02T15:04:05.000Z")}, "to": {time.Now().UTC().Add(time.Minute).Format("2006-01-02T15:04:05.000Z")}}
+	if _, later := env.summaryQuery(query); later.Fallback.TotalRefunded != 0 || later.Fallback.NetAmount != 0 {
+		t.Errorf("período sem o pagamento descontou o reembolso: %+v", later.Fallback)
+	}
+	if remote := processorSummary(t, env.defaultSim); remote.TotalRefunded != 0 {
+		t.Errorf("default recebeu reembolsos: %.2f", remote.TotalRefunded)
+	}
+}
+
+func TestRefundsFindLegacyPayments(t *testing.T) {
+	env := newTestEnv(t)
+	env.start(1)
+	env.postPayment("indexed", 8)
+	env.postPayment("unscored", 2)
+	env.waitForTotal(2)
+	env.stop()
+
+	// Pagamentos gravados com o índice e sem status, ou com status sem score
+	members, _ := env.redis.ZMembers("payments:processed:default")
+	for _, member := range members {
+		if strings.Contains(member, "indexed") {
+			env.redis.HSet("payments:index", "indexed", member)
+		}
+	}
+	env.redis.HDel("payments:status", "indexed")
+	env.redis.HSet("payments:status", "unscored", "processed:default")
+
+	// Ao subir, a instância passa o índice para o status e o apaga
+	legacy := repositories.NewRedisRepository(env.redis.Addr(), "")
+	legacy.Close()
+	if env.redis.Exists("payments:index") {
+		t.Error("índice legado não foi apagado")
+	}
+
+	for _, correlationId := range []string{"indexed", "unscored"} {
+		if code, response := env.refund(correlationId, `{"amount": 1}`); code != http.StatusAccepted {
+			t.Errorf("reembolso de %s: %d %+v", correlationId, code, response)
+		}
+	}
+}
+
+func TestMultiCurrencyRouting(t *testing.T) {
+	env := newTestEnv(t)
+	env.selector.SetCurrencies(dtos.DEFAULT_API, []string{"BRL"})
+	env.selector.SetCurrencies(dtos.FALLBACK_API, []string{"BRL", "USD"})
+	env.start(1)
+
+	post := func(correlationId string, amount float64, currency string) int {
+		body, _ := json.Marshal(map[string]any{"correlationId": correlationId, "amount": amount, "currency": currency})
+		req := httptest.NewRequest(http.MethodPost, "/payments", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		env.router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post("bad-currency", 1, "XYZ"); code != http.StatusBadRequest {
+		t.Errorf("moeda desconhecida retornou %d", code)
+	}
+	if code := post("bad-precision", 1.5, "JPY"); code != http.StatusBadRequest {
+		t.Errorf("JPY com casas decimais retornou %d", code)
+	}
+	post("brl", 10.25, "")
+	post("usd", 5.5, "usd")
+	// Nenhum processador aceita JPY: vai para a dead-letter
+	post("jpy", 100, "JPY")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		summary := env.summary()
+		brl, usd := summary.Currencies["BRL"], summary.Currencies["USD"]
+		if brl.Default.TotalRequests == 1 && usd.Fallback.TotalRequests == 1 {
+			if brl.Default.TotalAmount != 10.25 || usd.Fallback.TotalAmount != 5.5 || usd.Default.TotalRequests != 0 {
+				t.Errorf("sumário por moeda inesperado: %+v", summary.Currencies)
+			}
+			if summary.Default.TotalAmount != 10.25 || summary.Fallback.TotalRequests != 0 {
+				t.Errorf("totais de topo devem ser só da moeda padrão: %+v %+v", summary.Default, summary.Fallback)
+			}
+			if _, ok := summary.Currencies["JPY"]; ok {
+				t.Errorf("pagamento em JPY não deveria ser processado")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pagamentos não processados: %+v", summary.Currencies)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// O processador soma todas as moedas: a auditoria compara só a contagem
+	// quando há outras moedas na janela
+	report, err := workers.NewSummaryAuditor(env.repo, "123", false).Audit(context.Background(), env.startedAt, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range report.Processors {
+		if p.RequestsDrift != 0 || p.AmountDrift != 0 {
+			t.Errorf("divergência inesperada: %+v", p)
+		}
+	}
+	if def, fb := report.Processors[0], report.Processors[1]; def.UnauditedCurrencies != nil || !slices.Equal(fb.UnauditedCurrencies, []string{"USD"}) {
+		t.Errorf("moedas não auditadas inesperadas: %v %v", def.UnauditedCurrencies, fb.UnauditedCurrencies)
+	}
+
+	// Uma lista só com moedas desconhecidas não faz o processador recusar tudo
+	env.selector.SetCurrencies(dtos.DEFAULT_API, []string{"XYZ"})
+	if !env.selector.Accepts(dtos.DEFAULT_API, "BRL") {
+		t.Errorf("lista inválida deveria ser ignorada")
+	}
+}
+
+func TestProcessingTimesAreRecorded(t *testing.T) {
+	env := newTestEnv(t)
+	env.defaultSim.SetPhase(&processorsim.Phase{Latency: processorsim.Latency{Dist: "fixed", Ms: 30}})
+	env.repo.SetRecordTiming(true)
+	env.start(1)
+
+	for i := range 5 {
+		env.postPayment(fmt.Sprintf("timed-%d", i), 2)
+	}
+	env.waitForTotal(5)
+
+	payments, err := env.repo.GetProcessedByDateRange(context.Background(), repositories.DefaultTenant, dtos.DEFAULT_API, env.startedAt, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range payments {
+		if p.RequestedAt == "" || p.DispatchedAt == "" || p.Attempts != 1 || p.LatencyMs < 30 {
+			t.Errorf("pagamento sem tempos registrados: %+v", p)
+		}
+		if p.ProcessedAt < p.DispatchedAt || p.DispatchedAt < p.RequestedAt {
+			t.Errorf("horários fora de ordem: %+v", p)
+		}
+	}
+
+	// Os percentis só são calculados quando pedidos
+	if summary := env.summary(); summary.Timing != nil {
+		t.Errorf("tempos sem ?timing=true: %+v", summary.Timing)
+	}
+	query := url.Values{}
+	query.Set("from", env.startedAt.Format("2006-01-02T15:04:05.000Z"))
+	query.Set("timing", "true")
+	code, summary := env.summaryQuery(query)
+	if code != http.StatusOK || summary.Timing == nil || summary.Timing.Default == nil || summary.Timing.Fallback != nil {
+		t.Fatalf("esperava tempos só do default, obteve %d %+v", code, summary.Timing)
+	}
+	timing := summary.Timing.Default
+	if timing.Samples != 5 || timing.ProcessingMs.P50 < 30 || timing.ProcessingMs.Max < timing.ProcessingMs.P90 {
+		t.Errorf("percentis inesperados: %+v", timing)
+	}
+}
+
+func (e *testEnv) summaryQuery(query url.Values) (int, dtos.SummaryResponse) {
+	req := httptest.NewRequest(http.MethodGet, "/payments-summary?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+
+	var summary dtos.SummaryResponse
+	json.Unmarshal(w.Body.Bytes(), &summary)
+	return w.Code, summary
+}
+
+func TestSummaryTimeRanges(t *testing.T) {
+	env := newTestEnv(t)
+	env.start(1)
+	for i := range 3 {
+		env.postPayment(fmt.Sprintf("ranged-%d", i), 1)
+	}
+	env.waitForTotal(3)
+
+	saoPaulo := time.FixedZone("BRT", -3*60*60)
+	before := env.startedAt.In(saoPaulo).Format(time.RFC3339)
+	after := time.Now().Add(time.Minute).In(saoPaulo).Format(time.RFC3339Nano)
+
+	for name, tc := range map[string]struct {
+		query url.Values
+		total int
+	}{
+		"sem limites":        {url.Values{}, 3},
+		"só from com fuso":   {url.Values{"from": {before}}, 3},
+		"só to com fuso":     {url.Values{"to": {before}}, 0},
+		"from e to nano":     {url.Values{"from": {before}, "to": {after}}, 3},
+		"last":               {url.Values{"last": {"1m"}}, 3},
+		"formato da rinha":   {url.Values{"from": {env.startedAt.Format("2006-01-02T15:04:05.000Z")}}, 3},
+		"to antes dos dados": {url.Values{"to": {env.startedAt.Add(-time.Hour).Format(time.RFC3339)}}, 0},
+	} {
+		code, summary := env.summaryQuery(tc.query)
+		if code != http.StatusOK || summary.Default.TotalRequests != tc.total {
+			t.Errorf("%s: esperava 200 com %d pagamentos, obteve %d com %+v", name, tc.total, code, summary.Default)
+		}
+	}
+
+	for name, query := range map[string]url.Values{
+		"from depois de to": {"from": {after}, "to": {before}},
+		"last com from":     {"last": {"5m"}, "from": {before}},
+		"last inválido":     {"last": {"cinco minutos"}},
+		"last negativo":     {"last": {"-5m"}},
+		"data inválida":     {"from": {"15/07/2025"}},
+	} {
+		if code, _ := env.summaryQuery(query); code != http.StatusBadRequest {
+			t.Errorf("%s: esperava 400, obteve %d", name, code)
+		}
+	}
+}
+
+func (e *testEnv) export(query url.Values) *http.Response {
+	e.t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/payments/export?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+	return w.Result()
+}
+
+// splitTrailer separa a última linha do export e confere o checksum do resto.
+func splitTrailer(t *testing.T, body []byte) ([]byte, string) {
+	t.Helper()
+	cut := bytes.LastIndexByte(bytes.TrimSuffix(body, []byte("\n")), '\n') + 1
+	content, trailer := body[:cut], strings.TrimSpace(string(body[cut:]))
+	sum := sha256.Sum256(content)
+	if !strings.Contains(trailer, hex.EncodeToString(sum[:])) {
+		t.Errorf("checksum do trailer %q não confere com o conteúdo", trailer)
+	}
+	return content, trailer
+}
+
+func TestExportStreamsWithTrailer(t *testing.T) {
+	env := newTestEnv(t)
+	env.start(4)
+
+	// Mais que um bloco de leitura, para cruzar a paginação do sorted set
+	const total = 520
+	var batch strings.Builder
+	for i := range total {
+		fmt.Fprintf(&batch, "{\"correlationId\": \"exp-%d\", \"amount\": 1.5}\n", i)
+	}
+	if response := env.postBatch("application/x-ndjson", batch.String()); response.Accepted != total {
+		t.Fatalf("esperava %d aceitos, obteve %+v", total, response.Accepted)
+	}
+	env.waitForTotal(total)
+
+	res := env.export(url.Values{})
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("export CSV retornou %d %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	content, trailer := splitTrailer(t, body)
+	if trailer != fmt.Sprintf("#rows=%d,sha256=%s", total, res.Trailer.Get("X-Export-Sha256")) {
+		t.Errorf("trailer CSV inesperado: %q (HTTP %v)", trailer, res.Trailer)
+	}
+	if res.Trailer.Get("X-Export-Rows") != fmt.Sprint(total) {
+		t.Errorf("trailer HTTP de linhas: %q", res.Trailer.Get("X-Export-Rows"))
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if lines[0] != "correlationId,processor,amount,currency,requestedAt,dispatchedAt,processedAt,attempts,latencyMs,clientId" {
+		t.Errorf("cabeçalho CSV inesperado: %q", lines[0])
+	}
+	seen := make(map[string]bool)
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, ",")
+		if fields[2] != "1.50" || fields[3] != "BRL" {
+			t.Errorf("linha CSV inesperada: %q", line)
+		}
+		seen[fields[0]] = true
+	}
+	if len(seen) != total {
+		t.Errorf("esperava %d pagamentos distintos no export, obteve %d", total, len(seen))
+	}
+
+	res = env.export(url.Values{"format": {"ndjson"}, "processor": {"fallback"}})
+	body, _ = io.ReadAll(res.Body)
+	content, trailer = splitTrailer(t, body)
+	if len(content) != 0 || !strings.HasPrefix(trailer, `{"trailer":{"rows":0,`) {
+		t.Errorf("export NDJSON do fallback deveria estar vazio: %q", body)
+	}
+
+	res = env.export(url.Values{"format": {"xlsx"}})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("formato inválido: esperava 400, obteve %d", res.StatusCode)
+	}
+}
+
+func TestRetentionArchivesAndKeepsSummaries(t *testing.T) {
+	env := newTestEnv(t)
+	env.start(1)
+	for i := range 5 {
+		env.postPayment(fmt.Sprintf("old-%d", i), 2.5)
+	}
+	env.waitForTotal(5)
+	// Um reembolso concluído tem que continuar no sumário depois de arquivado
+	if code, _ := env.refund("old-1", `{"amount": 1}`); code != http.StatusAccepted {
+		t.Fatalf("reembolso retornou %d", code)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for summary := env.summary(); summary.Default.TotalRefunded+summary.Fallback.TotalRefunded != 1; summary = env.summary() {
+		if time.Now().After(deadline) {
+			t.Fatalf("reembolso não concluído: %+v", summary)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	before := env.waitForTotal(5)
+	// Membros do set legado de recebidos saem junto com o pagamento arquivado
+	env.redis.SAdd("payments:submitted", "old-0", "legacy-queued")
+
+	dir := t.TempDir()
+	retention := workers.NewRetentionWorker(env.repo, repositories.NewFileArchiver(dir), 0, "retention-test")
+	archived, err := retention.Run(context.Background())
+	if err != nil || archived != 5 {
+		t.Fatalf("esperava 5 pagamentos arquivados, obteve %d (%v)", archived, err)
+	}
+	if members, _ := env.redis.Members("payments:submitted"); len(members) != 1 || members[0] != "legacy-queued" {
+		t.Errorf("set legado de recebidos após arquivar: %v", members)
+	}
+	// O status fica só como archived, para o reenvio continuar sendo recusado
+	for i := range 5 {
+		id := fmt.Sprintf("old-%d", i)
+		if value := env.redis.HGet("payments:status", id); !strings.HasPrefix(value, "archived:") {
+			t.Errorf("status de %s após arquivar: %q", id, value)
+		}
+	}
+	if code, status := env.paymentStatus("old-0"); code != http.StatusOK || status.Status != dtos.PAYMENT_STATUS_ARCHIVED || status.Processor == "" {
+		t.Errorf("status de pagamento arquivado: %d %+v", code, status)
+	}
+	if code := env.postPayment("old-0", 2.5); code != http.StatusConflict {
+		t.Errorf("reenvio de pagamento arquivado: esperava 409, obteve %d", code)
+	}
+	if batch := env.postBatch("application/json", `[{"correlationId": "old-1", "amount": 2.5}]`); batch.Duplicates != 1 {
+		t.Errorf("lote com pagamento arquivado: %+v", batch)
+	}
+	if code, _ := env.refund("old-2", `{"amount": 1}`); code != http.StatusNotFound {
+		t.Errorf("reembolso de pagamento arquivado: esperava 404, obteve %d", code)
+	}
+	if fields, _ := env.redis.HKeys("payments:refunded"); len(fields) != 0 {
+		t.Errorf("reservas de reembolso de pagamentos arquivados continuam no Redis: %v", fields)
+	}
+	for _, key := range []string{"payments:refunds:default", "payments:refunds:fallback"} {
+		if members, _ := env.redis.ZMembers(key); len(members) != 0 {
+			t.Errorf("reembolsos arquivados continuam em %s: %v", key, members)
+		}
+	}
+	if members, _ := env.redis.ZMembers("payments:processed:default"); len(members) != 0 {
+		t.Errorf("pagamentos arquivados continuam no Redis: %d", len(members))
+	}
+
+	// O sumário sai dos rollups e continua batendo com os processadores
+	after := env.waitForTotal(5)
+	if after.Default != before.Default || after.Fallback != before.Fallback || after.Default.TotalRefunded+after.Fallback.TotalRefunded != 1 {
+		t.Errorf("sumário mudou após arquivar: antes %+v, depois %+v", before, after)
+	}
+	if code, summary := env.summaryQuery(url.Values{"to": {env.startedAt.Add(-time.Hour).Format(time.RFC3339)}}); code != http.StatusOK || summary.Default.TotalRequests != 0 {
+		t.Errorf("período anterior aos dados deveria estar vazio: %d %+v", code, summary.Default)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "default", "*.ndjson.gz"))
+	var lines int
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(gz)
+		for scanner.Scan() {
+			lines++
+		}
+		file.Close()
+	}
+	if lines != 5 {
+		t.Errorf("esperava 5 pagamentos no arquivo, encontrou %d em %v", lines, files)
+	}
+
+	// O export lê só o Redis: um período com pagamentos arquivados é recusado
+	res := env.export(url.Values{})
+	var refused struct {
+		ArchivedUntil string `json:"archivedUntil"`
+	}
+	json.NewDecoder(res.Body).Decode(&refused)
+	if res.StatusCode != http.StatusUnprocessableEntity || refused.ArchivedUntil == "" {
+		t.Fatalf("export de período arquivado: esperava 422 com archivedUntil, obteve %d %+v", res.StatusCode, refused)
+	}
+	res = env.export(url.Values{"from": {refused.ArchivedUntil}})
+	body, _ := io.ReadAll(res.Body)
+	if _, trailer := splitTrailer(t, body); res.StatusCode != http.StatusOK || !strings.HasPrefix(trailer, "#rows=0,") {
+		t.Errorf("export a partir do archivedUntil: %d %q", res.StatusCode, trailer)
+	}
+
+	if archived, _ := retention.Run(context.Background()); archived != 0 {
+		t.Errorf("segunda execução arquivou %d pagamentos de novo", archived)
+	}
+	if code, _ := env.refund("old-0", `{}`); code != http.StatusNotFound {
+		t.Errorf("reembolso de pagamento arquivado: esperava 404, obteve %d", code)
+	}
+
+	// Os rollups por minuto viram rollups por hora sem mudar o sumário
+	for _, api := range []dtos.PaymentAPI{dtos.DEFAULT_API, dtos.FALLBACK_API} {
+		if _, err := env.repo.CompactRollups(context.Background(), repositories.DefaultTenant, api, time.Now().Add(2*time.Hour), 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if env.redis.Exists("payments:rollups:default") || !env.redis.Exists("payments:rollups-hourly:default") {
+		t.Errorf("rollups por minuto não foram compactados: %v", env.redis.Keys())
+	}
+	if compacted := env.summary(); compacted.Default != before.Default {
+		t.Errorf("sumário mudou após compactar: antes %+v, depois %+v", before.Default, compacted.Default)
+	}
+
+	// Um período que corta uma hora compactada somaria pagamentos de fora dele
+	buckets, _ := env.redis.ZMembers("payments:rollups-hourly-index:default")
+	if len(buckets) == 0 {
+		t.Fatal("índice de rollups por hora vazio")
+	}
+	start, _ := env.redis.ZScore("payments:rollups-hourly-index:default", buckets[0])
+	hour := time.UnixMilli(int64(start)).UTC()
+	unaligned := url.Values{"from": {hour.Add(time.Minute).Format("2006-01-02T15:04:05.000Z")}}
+	req := httptest.NewRequest(http.MethodGet, "/payments-summary?"+unaligned.Encode(), nil)
+	w := httptest.NewRecorder()
+	env.router.ServeHTTP(w, req)
+	var refusedSummary struct {
+		Alignment string `json:"alignment"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &refusedSummary)
+	if w.Code != http.StatusBadRequest || refusedSummary.Alignment != time.Hour.String() {
+		t.Errorf("sumário com from no meio da hora: esperava 400 com alinhamento de 1h, obteve %d %s", w.Code, w.Body)
+	}
+	if code := env.purge("from="+url.QueryEscape(unaligned.Get("from")), testAdminToken); code != http.StatusBadRequest {
+		t.Errorf("purge com from no meio da hora: esperava 400, obteve %d", code)
+	}
+	aligned := url.Values{"from": {env.startedAt.Truncate(time.Hour).Format("2006-01-02T15:04:05.000Z")}}
+	if code, summary := env.summaryQuery(aligned); code != http.StatusOK || summary.Default != before.Default {
+		t.Errorf("sumário alinhado à hora: %d %+v", code, summary.Default)
+	}
+
+	// Rollups gravados antes do índice entram nele quando o tenant é carregado
+	minute := time.Now().UnixMilli() / 60000 * 60000
+	env.redis.HSet("tenants:legacy:payments:rollups:default",
+		fmt.Sprintf("%d:BRL:n", minute), "2", fmt.Sprintf("%d:BRL:amount", minute), "300")
+	env.registerTenants("legacy")
+	if summary := env.summaryFor("legacy"); summary.Default.TotalRequests != 2 || summary.Default.TotalAmount != 3 {
+		t.Errorf("rollups legados fora do sumário: %+v", summary.Default)
+	}
+
+	if code := env.purge("", testAdminToken); code != http.StatusOK {
+		t.Fatalf("purge retornou %d", code)
+	}
+	if summary := env.summary(); summary.Default.TotalRequests != 0 {
+		t.Errorf("purge deveria apagar os rollups: %+v", summary.Default)
+	}
+	if env.redis.Exists("payments:rollups-hourly:default") || env.redis.Exists("payments:rollups-hourly-index:default") {
+		t.Errorf("purge deveria apagar os rollups por hora: %v", env.redis.Keys())
+	}
+}
+
+func TestBacklogLimitAndTrim(t *testing.T) {
+	env := newTestEnv(t)
+	env.repo.SetMaxBacklog(3)
+	for i := range 3 {
+		if code := env.postPayment(fmt.Sprintf("queued-%d", i), 1); code != http.StatusOK {
+			t.Fatalf("pagamento %d dentro do limite retornou %d", i, code)
+		}
+	}
+
+	body, _ := json.Marshal(map[string]any{"correlationId": "over", "amount": 1})
+	req := httptest.NewRequest(http.MethodPost, "/payments", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	env.router.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("acima do limite: esperava 503 com Retry-After, obteve %d %v", w.Code, w.Header())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/payments/batch", strings.NewReader(`[{"correlationId": "over-batch", "amount": 1}]`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	env.router.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("lote acima do limite: esperava 503, obteve %d", w.Code)
+	}
+
+	env.start(1)
+	env.waitForTotal(3)
+	env.stop()
+
+	backlog, err := env.repo.TrimStreams(context.Background())
+	if err != nil || backlog != 0 {
+		t.Fatalf("esperava backlog 0 após processar tudo, obteve %d (%v)", backlog, err)
+	}
+	if entries, _ := env.redis.Stream("payments:stream"); len(entries) != 0 {
+		t.Errorf("entradas confirmadas continuam na stream: %d", len(entries))
+	}
+
+	// Uma entrada entregue sem ack e outra ainda na fila sobrevivem ao trim
+	env.postPayment("stuck", 1)
+	if payments, err := env.repo.ReadFromStream(context.Background(), "stuck-consumer"); err != nil || len(payments) != 1 {
+		t.Fatalf("esperava ler o pagamento preso: %v %v", payments, err)
+	}
+	env.postPayment("waiting", 1)
+
+	backlog, err = env.repo.TrimStreams(context.Background())
+	if err != nil || backlog != 2 {
+		t.Errorf("esperava backlog 2 com um pendente e um na fila, obteve %d (%v)", backlog, err)
+	}
+	if code := env.postPayment("fits", 1); code != http.StatusOK {
+		t.Errorf("após o trim havia espaço, mas o pagamento retornou %d", code)
+	}
+
+	env.start(1)
+	env.waitForTotal(5)
+}
+
+func TestReclaimStalePendingEntries(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	// Um pagamento já entregue várias vezes e outro lido uma vez, ambos por
+	// workers que caíram antes do ack
+	env.postPayment("poison", 1)
+	if payments, err := env.repo.ReadFromStream(ctx, "crashed-consumer"); err != nil || len(payments) != 1 {
+		t.Fatalf("esperava ler o pagamento: %v %v", payments, err)
+	}
+	for range 5 {
+		if _, err := env.repo.ReclaimStale(ctx, "crashed-again", 0, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env.postPayment("abandoned", 2)
+	if payments, err := env.repo.ReadFromStream(ctx, "crashed-consumer"); err != nil || len(payments) != 1 {
+		t.Fatalf("esperava ler o pagamento: %v %v", payments, err)
+	}
+
+	paymentWorkers := workers.NewWorkers(env.repo, env.selector)
+	if reclaimed, err := paymentWorkers.Reclaim(ctx, time.Minute); err != nil || reclaimed != 0 {
+		t.Errorf("entradas recentes não deveriam ser reclamadas: %d %v", reclaimed, err)
+	}
+	if reclaimed, err := paymentWorkers.Reclaim(ctx, 0); err != nil || reclaimed != 2 {
+		t.Fatalf("esperava reclamar 2 entradas, obteve %d (%v)", reclaimed, err)
+	}
+
+	if summary := env.summary(); summary.Default.TotalRequests+summary.Fallback.TotalRequests != 1 {
+		t.Errorf("esperava só o pagamento abandonado processado: %+v %+v", summary.Default, summary.Fallback)
+	}
+	if entries, _ := env.redis.Stream("payments:deadletter"); len(entries) != 1 {
+		t.Errorf("esperava o pagamento entregue demais na dead-letter, obteve %d", len(entries))
+	}
+	if pending, err := env.repo.ReclaimStale(ctx, "checker", 0, 10); err != nil || len(pending) != 0 {
+		t.Errorf("entradas continuam pendentes: %+v %v", pending, err)
+	}
+	if backlog, err := env.repo.TrimStreams(ctx); err != nil || backlog != 0 {
+		t.Errorf("esperava backlog 0, obteve %d (%v)", backlog, err)
+	}
+}
+
+func TestIntakeReportsRedisErrors(t *testing.T) {
+	env := newTestEnv(t)
+	env.redis.SetError("ERR indisponível")
+	code := env.postPayment("redis-down", 1)
+	env.redis.SetError("")
+	if code != http.StatusInternalServerError {
+		t.Errorf("erro do Redis no intake: esperava 500, obteve %d", code)
+	}
+}
+
+func TestRecordEncodingMigration(t *testing.T) {
+	env := newTestEnv(t)
+	env.repo.SetEncoding(repositories.EncodingJSON)
+	env.start(1)
+	for i := range 4 {
+		env.postPayment(fmt.Sprintf("legacy-%d", i), 10.1)
+	}
+	before := env.waitForTotal(4)
+	env.stop()
+
+	memberBytes := func() (int, []string) {
+		members, _ := env.redis.ZMembers("payments:processed:default")
+		var size int
+		for _, member := range members {
+			size += len(member)
+		}
+		return size, members
+	}
+	jsonSize, members := memberBytes()
+	for _, member := range members {
+		if member[0] != '{' {
+			t.Fatalf("esperava membros em JSON antes da migração: %q", member)
+		}
+	}
+
+	env.repo.SetEncoding(repositories.EncodingBinary)
+	migrated, err := env.repo.MigrateEncoding(context.Background(), repositories.DefaultTenant, dtos.DEFAULT_API, 2)
+	if err != nil || migrated != 4 {
+		t.Fatalf("esperava 4 pagamentos migrados, obteve %d (%v)", migrated, err)
+	}
+	if again, _ := env.repo.MigrateEncoding(context.Background(), repositories.DefaultTenant, dtos.DEFAULT_API, 2); again != 0 {
+		t.Errorf("segunda migração regravou %d pagamentos", again)
+	}
+	binarySize, members := memberBytes()
+	for _, member := range members {
+		if member[0] == '{' {
+			t.Errorf("membro continua em JSON após a migração: %q", member)
+		}
+	}
+	if binarySize*2 > jsonSize {
+		t.Errorf("esperava o binário com menos da metade do JSON: %d contra %d bytes", binarySize, jsonSize)
+	}
+
+	// Os registros convertidos e os novos, já binários desde a stream, são
+	// lidos pelo sumário e pelo reembolso
+	env.start(1)
+	env.postPayment("binary-new", 5)
+	after := env.waitForTotal(5)
+	if after.Default.TotalAmount != before.Default.TotalAmount+5 {
+		t.Errorf("sumário após migrar: antes %+v, depois %+v", before.Default, after.Default)
+	}
+	if code, response := env.refund("legacy-0", `{"amount": 0.1}`); code != http.StatusAccepted || response.Remaining != 10 {
+		t.Errorf("reembolso de pagamento migrado: %d %+v", code, response)
+	}
+}
+
+func (e *testEnv) paymentStatus(correlationId string) (int, dtos.PaymentStatus) {
+	req := httptest.NewRequest(http.MethodGet, "/payments/"+correlationId, nil)
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+
+	var status dtos.PaymentStatus
+	json.Unmarshal(w.Body.Bytes(), &status)
+	return w.Code, status
+}
+
+func TestScriptsSurviveFlushAndTrackStatus(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	loaded, err := env.repo.LoadScripts(ctx)
+	if err != nil || !strings.Contains(fmt.Sprint(loaded), "intake@v") {
+		t.Fatalf("esperava carregar os scripts, obteve %v (%v)", loaded, err)
+	}
+
+	// Um Redis reiniciado perde o cache: o EVALSHA volta NOSCRIPT e o
+	// repositório repete com EVAL
+	client := redis.NewClient(&redis.Options{Addr: env.redis.Addr()})
+	defer client.Close()
+	if err := client.ScriptFlush(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := env.postPayment("status-1", 10); code != http.StatusOK {
+		t.Fatalf("esperava 200, obteve %d", code)
+	}
+	if code := env.postPayment("status-1", 10); code != http.StatusConflict {
+		t.Errorf("duplicata: esperava 409, obteve %d", code)
+	}
+	batch := env.postBatch("application/json", `[{"correlationId": "status-2", "amount": 5}]`)
+	if batch.Accepted != 1 {
+		t.Fatalf("lote após o SCRIPT FLUSH: %+v", batch)
+	}
+	if entries, _ := env.redis.Stream("payments:stream"); len(entries) != 2 {
+		t.Errorf("a duplicata não deveria entrar na stream: %d entradas", len(entries))
+	}
+	if code, status := env.paymentStatus("status-1"); code != http.StatusOK || status.Status != dtos.PAYMENT_STATUS_QUEUED {
+		t.Errorf("esperava status queued, obteve %d %+v", code, status)
+	}
+	if code, _ := env.paymentStatus("unknown"); code != http.StatusNotFound {
+		t.Errorf("pagamento desconhecido: esperava 404, obteve %d", code)
+	}
+
+	env.start(1)
+	env.waitForTotal(2)
+	env.stop()
+
+	code, status := env.paymentStatus("status-1")
+	if code != http.StatusOK || status.Status != dtos.PAYMENT_STATUS_PROCESSED || status.Processor != dtos.DEFAULT_API.String() {
+		t.Errorf("esperava status processed no default, obteve %d %+v", code, status)
+	}
+
+	// Uma entrega atrasada que falha não desfaz o processado
+	late := &dtos.PaymentRequest{CorrelationId: "status-1", Amount: 10, Currency: dtos.DEFAULT_CURRENCY, RequestedAt: time.Now().UTC()}
+	if err := env.repo.DeadLetter(ctx, late, "duplicada"); err != nil {
+		t.Fatal(err)
+	}
+	if _, status := env.paymentStatus("status-1"); status.Status != dtos.PAYMENT_STATUS_PROCESSED {
+		t.Errorf("dead-letter sobrescreveu o processado: %+v", status)
+	}
+
+	failed := &dtos.PaymentRequest{CorrelationId: "status-3", Amount: 1, Currency: dtos.DEFAULT_CURRENCY, RequestedAt: time.Now().UTC()}
+	if err := env.repo.DeadLetter(ctx, failed, "recusado"); err != nil {
+		t.Fatal(err)
+	}
+	if _, status := env.paymentStatus("status-3"); status.Status != dtos.PAYMENT_STATUS_FAILED {
+		t.Errorf("esperava status failed, obteve %+v", status)
+	}
+	if entries, _ := env.redis.Stream("payments:deadletter"); len(entries) != 2 {
+		t.Errorf("esperava 2 entradas na dead-letter, obteve %d", len(entries))
+	}
+
+	// O que foi para a dead-letter pode ser reenviado; o processado não
+	if code := env.postPayment("status-3", 1); code != http.StatusOK {
+		t.Errorf("reenvio de pagamento failed: esperava 200, obteve %d", code)
+	}
+	if _, status := env.paymentStatus("status-3"); status.Status != dtos.PAYMENT_STATUS_QUEUED {
+		t.Errorf("esperava status queued após o reenvio, obteve %+v", status)
+	}
+	if code := env.postPayment("status-1", 10); code != http.StatusConflict {
+		t.Errorf("reenvio de pagamento processado: esperava 409, obteve %d", code)
+	}
+}
+
+func TestGroupRecreatedAfterFailover(t *testing.T) {
+	env := newTestEnv(t)
+	env.start(1)
+	env.postPayment("before-failover", 1)
+	env.waitForTotal(1)
+
+	// A réplica promovida não tinha a stream nem o read group; o próximo XADD
+	// recria a stream, mas sem grupo
+	env.redis.Del("payments:stream")
+	env.redis.Del("webhooks:stream")
+	env.postPayment("after-failover", 1)
+	env.waitForTotal(2)
+
+	if code, status := env.paymentStatus("after-failover"); code != http.StatusOK || status.Status != dtos.PAYMENT_STATUS_PROCESSED {
+		t.Errorf("esperava o pagamento processado após recriar o grupo, obteve %d %+v", code, status)
+	}
+
+	// Só o grupo se perdeu: ele volta do início da stream e entrega de novo
+	// o que já foi processado, que não pode ser cobrado outra vez
+	client := redis.NewClient(&redis.Options{Addr: env.redis.Addr()})
+	defer client.Close()
+	if err := client.XGroupDestroy(context.Background(), "payments:stream", "read-group").Err(); err != nil {
+		t.Fatal(err)
+	}
+	env.postPayment("group-lost", 1)
+	env.waitForTotal(3)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, err := client.XPending(context.Background(), "payments:stream", "read-group").Result()
+		if err == nil && pending.Count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entregas repetidas continuam pendentes: %+v (%v)", pending, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if entries, _ := env.redis.Stream("payments:deadletter"); len(entries) != 0 {
+		t.Errorf("entregas repetidas foram para a dead-letter: %+v", entries)
+	}
+}
+
+func TestClusterModeKeepsTenantOnOneSlot(t *testing.T) {
+	env := newTestEnvWith(t, repositories.RedisConfig{Mode: repositories.RedisCluster})
+	env.registerTenants("acme")
+	env.start(2)
+
+	env.postPayment("cluster-1", 10)
+	env.postPaymentAs("acme", "cluster-2", 20)
+	batch := env.postBatch("application/json", `[{"correlationId": "cluster-3", "amount": 5}, {"correlationId": "cluster-1", "amount": 10}]`)
+	if batch.Accepted != 1 || batch.Duplicates != 1 {
+		t.Errorf("lote no cluster: %+v", batch)
+	}
+
+	// O processador simulado soma os dois tenants, então cada um é conferido
+	// só pelo próprio sumário
+	deadline := time.Now().Add(5 * time.Second)
+	for tenant, total := range map[string]int{repositories.DefaultTenant: 2, "acme": 1} {
+		for env.summaryFor(tenant).Default.TotalRequests != total {
+			if time.Now().After(deadline) {
+				t.Fatalf("tenant %q: esperava %d pagamentos, obteve %+v", tenant, total, env.summaryFor(tenant))
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	if code, _ := env.refund("cluster-1", `{"amount": 4}`); code != http.StatusAccepted {
+		t.Errorf("reembolso no cluster retornou %d", code)
+	}
+	if code, status := env.paymentStatus("cluster-1"); code != http.StatusOK || status.Status != dtos.PAYMENT_STATUS_PROCESSED {
+		t.Errorf("status no cluster: %d %+v", code, status)
+	}
+	if entries, _ := env.redis.Stream("events:stream"); len(entries) == 0 {
+		t.Error("os eventos do cluster não chegaram ao feed")
+	}
+
+	// Todas as chaves de um tenant caem no slot da sua stream
+	client := redis.NewClient(&redis.Options{Addr: env.redis.Addr()})
+	defer client.Close()
+	ctx := context.Background()
+	for tag, stream := range map[string]string{"{payments}:": "{payments}:stream", "tenants:{acme}:": "tenants:{acme}:payments:stream"} {
+		want, err := client.ClusterKeySlot(ctx, stream).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys int
+		for _, key := range env.redis.Keys() {
+			if !strings.HasPrefix(key, tag) {
+				continue
+			}
+			keys++
+			if got, _ := client.ClusterKeySlot(ctx, key).Result(); got != want {
+				t.Errorf("%s está no slot %d, a stream do tenant no %d", key, got, want)
+			}
+		}
+		if keys < 3 {
+			t.Errorf("esperava stream, processados e status com a tag %s, achou %d chaves", tag, keys)
+		}
+	}
+}
+
+// No cluster o evento e o webhook saem fora do script do tenant; uma nova
+// entrega de um pagamento já concluído não pode publicá-los de novo.
+func TestClusterRedeliveryPublishesOnce(t *testing.T) {
+	env := newTestEnvWith(t, repositories.RedisConfig{Mode: repositories.RedisCluster})
+	ctx := context.Background()
+
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	payment := &dtos.ProcessedPayment{
+		CorrelationId: "cluster-redelivered",
+		Api:           dtos.DEFAULT_API,
+		Amount:        10,
+		Currency:      dtos.DEFAULT_CURRENCY,
+		RequestedAt:   now,
+		ProcessedAt:   now,
+		Tenant:        repositories.DefaultTenant,
+		CallbackUrl:   "https://example.com/hook",
+	}
+	for range 2 {
+		if err := env.repo.StoreProcessed(ctx, payment, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A entrega atrasada que falha também não publica nada
+	late := &dtos.PaymentRequest{CorrelationId: payment.CorrelationId, Amount: 10, Currency: dtos.DEFAULT_CURRENCY, RequestedAt: time.Now().UTC(), CallbackUrl: payment.CallbackUrl}
+	if err := env.repo.DeadLetter(ctx, late, "duplicada"); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, _ := env.redis.Stream("events:stream"); len(entries) != 1 {
+		t.Errorf("esperava 1 evento no feed, obteve %d: %+v", len(entries), entries)
+	}
+	if entries, _ := env.redis.Stream("{webhooks}:stream"); len(entries) != 1 {
+		t.Errorf("esperava 1 webhook, obteve %d: %+v", len(entries), entries)
+	}
+	if _, status := env.paymentStatus(payment.CorrelationId); status.Status != dtos.PAYMENT_STATUS_PROCESSED {
+		t.Errorf("esperava status processed, obteve %+v", status)
+	}
+}
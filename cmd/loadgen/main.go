@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+)
+
+type payment struct {
+	CorrelationId string  `json:"correlationId"`
+	Amount        float64 `json:"amount"`
+}
+
+// Gera carga contra POST /payments, lendo os pagamentos de um arquivo JSONL ou
+// sintetizando-os, e no fim confere o /payments-summary com o que foi aceito.
+func main() {
+	target := flag.String("target", "http://localhost:9999", "URL base da API")
+	file := flag.String("file", "", "arquivo JSONL para reproduzir; linhas sem correlationId/amount geram pagamentos sintéticos")
+	rateSpec := flag.String("rate", "100", "taxa em req/s ou rampa \"0s:50,30s:500\"")
+	duration := flag.Duration("duration", 30*time.Second, "duração máxima (sem -file)")
+	concurrency := flag.Int("concurrency", 50, "requisições simultâneas")
+	amount := flag.Float64("amount", 19.90, "valor dos pagamentos sintéticos")
+	summaryEvery := flag.Duration("summary-every", 5*time.Second, "intervalo entre consultas ao /payments-summary durante o teste")
+	drain := flag.Duration("drain", 10*time.Second, "tempo máximo aguardando a fila esvaziar no fim")
+	defaultURL := flag.String("processor-default", "", "URL do processador default para comparar sumários")
+	fallbackURL := flag.String("processor-fallback", "", "URL do processador fallback para comparar sumários")
+	token := flag.String("token", "123", "X-Rinha-Token dos processadores")
+	flag.Parse()
+
+	prof, err := parseProfile(*rateSpec)
+	if err != nil {
+		fail("Perfil inválido: %v", err)
+	}
+
+	source, err := newSource(*file, *amount)
+	if err != nil {
+		fail("%v", err)
+	}
+	defer source.Close()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	st := newStats()
+	jobs := make(chan payment, *concurrency)
+
+	var wg sync.WaitGroup
+	for range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				start := time.Now()
+				status, err := postPayment(client, *target, &p)
+				st.record(time.Since(start), status, err, p.Amount)
+			}
+		}()
+	}
+
+	ctx := context.Background()
+	if *file == "" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	startedAt := time.Now().UTC()
+	go watchSummary(ctx, client, *target, startedAt, *summaryEvery)
+
+	schedule(ctx, prof, source, jobs)
+	close(jobs)
+	wg.Wait()
+
+	elapsed := time.Since(startedAt)
+	st.print(os.Stdout, elapsed)
+
+	ok := checkConsistency(client, *target, startedAt, st, *drain, *defaultURL, *fallbackURL, *token)
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// schedule libera pagamentos em pequenos intervalos acumulando a fração de
+// requisições que a taxa atual permite.
+func schedule(ctx context.Context, prof profile, source *source, jobs chan<- payment) {
+	const tick = 10 * time.Millisecond
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	start := time.Now()
+	credit := 0.0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			credit += prof.rateAt(time.Since(start)) * tick.Seconds()
+			for ; credit >= 1; credit-- {
+				p, ok := source.next()
+				if !ok {
+					return
+				}
+				jobs <- p
+			}
+		}
+	}
+}
+
+func postPayment(client *http.Client, target string, p *payment) (int, error) {
+	body, _ := json.Marshal(p)
+	resp, err := client.Post(target+"/payments", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+type source struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	amount  float64
+}
+
+func newSource(path string, amount float64) (*source, error) {
+	s := &source{amount: amount}
+	if path == "" {
+		return s, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao abrir %s: %w", path, err)
+	}
+	s.file = f
+	s.scanner = bufio.NewScanner(f)
+	s.scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	return s, nil
+}
+
+func (s *source) next() (payment, bool) {
+	if s.scanner == nil {
+		return payment{CorrelationId: newUUID(), Amount: s.amount}, true
+	}
+
+	for s.scanner.Scan() {
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var p payment
+		if json.Unmarshal(line, &p) != nil || p.CorrelationId == "" {
+			p.CorrelationId = newUUID()
+		}
+		if p.Amount <= 0 {
+			p.Amount = math.Round((1+mrand.Float64()*99)*100) / 100
+		}
+		return p, true
+	}
+	return payment{}, false
+}
+
+func (s *source) Close() {
+	if s.file != nil {
+		s.file.Close()
+	}
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func fetchSummary(client *http.Client, target string, from, to time.Time) (*dtos.SummaryResponse, error) {
+	query := url.Values{}
+	query.Set("from", from.Format("2006-01-02T15:04:05.000Z"))
+	query.Set("to", to.Format("2006-01-02T15:04:05.000Z"))
+
+	resp, err := client.Get(target + "/payments-summary?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	var summary dtos.SummaryResponse
+	err = json.NewDecoder(resp.Body).Decode(&summary)
+	return &summary, err
+}
+
+func fetchProcessorSummary(client *http.Client, processorURL, token string, from, to time.Time) (*dtos.ProcessorSummaryResponse, error) {
+	query := url.Values{}
+	query.Set("from", from.Format("2006-01-02T15:04:05.000Z"))
+	query.Set("to", to.Format("2006-01-02T15:04:05.000Z"))
+
+	req, err := http.NewRequest(http.MethodGet, processorURL+"/admin/payments-summary?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Rinha-Token", token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	var summary dtos.ProcessorSummaryResponse
+	err = json.NewDecoder(resp.Body).Decode(&summary)
+	return &summary, err
+}
+
+func watchSummary(ctx context.Context, client *http.Client, target string, from time.Time, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			summary, err := fetchSummary(client, target, from, time.Now().UTC())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "summary: erro %v\n", err)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "summary (%s): default=%d fallback=%d\n", time.Since(start).Round(time.Millisecond),
+				summary.Default.TotalRequests, summary.Fallback.TotalRequests)
+		}
+	}
+}
+
+// checkConsistency espera a fila esvaziar e confere que o sumário bate com os
+// pagamentos aceitos e, se configurados, com os sumários dos processadores.
+func checkConsistency(client *http.Client, target string, from time.Time, st *stats, drain time.Duration, defaultURL, fallbackURL, token string) bool {
+	deadline := time.Now().Add(drain)
+	var summary *dtos.SummaryResponse
+	for {
+		var err error
+		summary, err = fetchSummary(client, target, from, time.Now().UTC().Add(time.Minute))
+		if err != nil {
+			fmt.Printf("consistência: erro ao buscar sumário: %v\n", err)
+			return false
+		}
+		if summary.Default.TotalRequests+summary.Fallback.TotalRequests >= st.accepted || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	processed := summary.Default.TotalRequests + summary.Fallback.TotalRequests
+	amount := math.Round((summary.Default.TotalAmount+summary.Fallback.TotalAmount)*100) / 100
+	fmt.Printf("sumário: default=%d (%.2f) fallback=%d (%.2f)\n", summary.Default.TotalRequests, summary.Default.TotalAmount,
+		summary.Fallback.TotalRequests, summary.Fallback.TotalAmount)
+
+	ok := true
+	if processed != st.accepted {
+		fmt.Printf("consistência: %d aceitos, %d no sumário\n", st.accepted, processed)
+		ok = false
+	}
+	if expected := math.Round(st.amount*100) / 100; amount != expected {
+		fmt.Printf("consistência: amount aceito %.2f, no sumário %.2f\n", expected, amount)
+		ok = false
+	}
+
+	to := time.Now().UTC().Add(time.Minute)
+	for name, processorURL := range map[string]string{"default": defaultURL, "fallback": fallbackURL} {
+		if processorURL == "" {
+			continue
+		}
+		remote, err := fetchProcessorSummary(client, processorURL, token, from, to)
+		if err != nil {
+			fmt.Printf("consistência: erro ao buscar sumário do processador %s: %v\n", name, err)
+			ok = false
+			continue
+		}
+		local := summary.Default
+		if name == "fallback" {
+			local = summary.Fallback
+		}
+		if local.TotalRequests != remote.TotalRequests || local.TotalAmount != remote.TotalAmount {
+			fmt.Printf("consistência: processador %s tem %d (%.2f), sumário tem %d (%.2f)\n", name,
+				remote.TotalRequests, remote.TotalAmount, local.TotalRequests, local.TotalAmount)
+			ok = false
+		}
+	}
+
+	if ok {
+		fmt.Println("consistência: ok")
+	}
+	return ok
+}
+
+func fail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type rampPoint struct {
+	at   time.Duration
+	rate float64
+}
+
+// profile interpola linearamente a taxa (req/s) entre os pontos da rampa.
+// Depois do último ponto a taxa fica constante.
+type profile []rampPoint
+
+// parseProfile lê "0s:50,30s:200,60s:200". Uma taxa sem tempo ("100") vale
+// para a execução inteira.
+func parseProfile(spec string) (profile, error) {
+	var p profile
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		at := time.Duration(0)
+		rateStr := part
+		if idx := strings.Index(part, ":"); idx >= 0 {
+			var err error
+			at, err = time.ParseDuration(part[:idx])
+			if err != nil {
+				return nil, fmt.Errorf("tempo inválido em %q: %w", part, err)
+			}
+			rateStr = part[idx+1:]
+		}
+
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("taxa inválida em %q", part)
+		}
+
+		if len(p) > 0 && at < p[len(p)-1].at {
+			return nil, fmt.Errorf("pontos da rampa fora de ordem em %q", part)
+		}
+		p = append(p, rampPoint{at: at, rate: rate})
+	}
+
+	if len(p) == 0 {
+		return nil, fmt.Errorf("perfil vazio")
+	}
+	return p, nil
+}
+
+func (p profile) rateAt(elapsed time.Duration) float64 {
+	if elapsed <= p[0].at {
+		return p[0].rate
+	}
+	for i := 1; i < len(p); i++ {
+		if elapsed < p[i].at {
+			prev := p[i-1]
+			frac := float64(elapsed-prev.at) / float64(p[i].at-prev.at)
+			return prev.rate + frac*(p[i].rate-prev.rate)
+		}
+	}
+	return p[len(p)-1].rate
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+type stats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	statuses  map[int]int
+	errors    int
+	accepted  int
+	amount    float64
+}
+
+func newStats() *stats {
+	return &stats{statuses: make(map[int]int)}
+}
+
+func (s *stats) record(latency time.Duration, status int, err error, amount float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.latencies = append(s.latencies, latency)
+	s.statuses[status]++
+	if status >= 200 && status < 300 {
+		s.accepted++
+		s.amount += amount
+	}
+}
+
+func (s *stats) print(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	latencies := slices.Clone(s.latencies)
+	slices.Sort(latencies)
+
+	total := len(latencies) + s.errors
+	fmt.Fprintf(w, "requisições: %d em %s (%.1f req/s)\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+	fmt.Fprintf(w, "aceitas: %d (amount %.2f), erros de conexão: %d\n", s.accepted, math.Round(s.amount*100)/100, s.errors)
+
+	codes := make([]int, 0, len(s.statuses))
+	for code := range s.statuses {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  HTTP %d: %d\n", code, s.statuses[code])
+	}
+
+	if len(latencies) > 0 {
+		fmt.Fprintf(w, "latência p50=%s p90=%s p99=%s max=%s\n",
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[max(idx, 0)]
+}
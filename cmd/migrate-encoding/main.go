@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+)
+
+// Regrava no formato escolhido os pagamentos processados de todos os tenants.
+// Pode rodar com as APIs no ar, que leem os dois formatos; rode depois que
+// todas as instâncias estiverem gravando no formato novo (RECORD_ENCODING).
+func main() {
+	redisHost := flag.String("redis", envOr("REDIS_HOST", "localhost"), "host do Redis")
+	redisPassword := flag.String("redis-password", os.Getenv("REDIS_PASSWORD"), "senha do Redis")
+	redisMode := flag.String("redis-mode", os.Getenv("REDIS_MODE"), "standalone, sentinel ou cluster")
+	redisAddrs := flag.String("redis-addrs", os.Getenv("REDIS_ADDRS"), "sentinels ou nós do cluster separados por vírgula, no lugar de -redis")
+	redisMaster := flag.String("redis-master", os.Getenv("REDIS_MASTER_NAME"), "nome do master no Sentinel")
+	encodingName := flag.String("encoding", "binary", "formato de destino: binary ou json")
+	chunk := flag.Int64("chunk", 500, "pagamentos convertidos por vez")
+	flag.Parse()
+
+	encoding, ok := repositories.ParseEncoding(*encodingName)
+	if !ok {
+		fail("Formato inválido: %s", *encodingName)
+	}
+
+	mode, ok := repositories.ParseRedisMode(*redisMode)
+	if !ok {
+		fail("Modo do Redis inválido: %s", *redisMode)
+	}
+	addrs := []string{*redisHost + ":6379"}
+	if *redisAddrs != "" {
+		addrs = strings.Split(*redisAddrs, ",")
+	}
+	redisRepo := repositories.NewRedisRepositoryWithConfig(repositories.RedisConfig{
+		Mode:             mode,
+		Addrs:            addrs,
+		Password:         *redisPassword,
+		MasterName:       *redisMaster,
+		SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+	})
+	defer redisRepo.Close()
+	redisRepo.SetEncoding(encoding)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	tenants, err := redisRepo.Tenants(ctx)
+	if err != nil {
+		fail("%v", err)
+	}
+
+	var total int64
+	for _, tenant := range tenants {
+		for _, api := range []dtos.PaymentAPI{dtos.DEFAULT_API, dtos.FALLBACK_API} {
+			migrated, err := redisRepo.MigrateEncoding(ctx, tenant, api, *chunk)
+			total += migrated
+			if err != nil {
+				fail("Erro ao migrar tenant %q (%s) após %d pagamentos: %v", tenant, api, total, err)
+			}
+			if migrated > 0 {
+				fmt.Printf("tenant=%q processor=%s migrated=%d\n", tenant, api, migrated)
+			}
+		}
+	}
+	fmt.Printf("total=%d encoding=%s\n", total, encoding)
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func fail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/processorsim"
+)
+
+// Simula um payment-processor da Rinha para desenvolvimento local e CI. Sem
+// -scenario usa uma única fase montada a partir das flags.
+func main() {
+	addr := flag.String("addr", ":8080", "endereço para escutar")
+	scenarioPath := flag.String("scenario", "", "arquivo JSON com as fases do cenário")
+	fee := flag.Float64("fee", 0.05, "taxa por transação")
+	token := flag.String("token", "123", "token dos endpoints /admin")
+	healthInterval := flag.Duration("health-interval", 5*time.Second, "intervalo mínimo entre checagens de saúde")
+	failRate := flag.Float64("fail-rate", 0, "fração de pagamentos que falham com 500")
+	failing := flag.Bool("failing", false, "falha todos os pagamentos")
+	latencyDist := flag.String("latency-dist", "fixed", "fixed, uniform, normal ou exponential")
+	latencyMs := flag.Float64("latency-ms", 10, "latência base em ms")
+	latencyMaxMs := flag.Float64("latency-max-ms", 0, "latência máxima em ms (uniform)")
+	latencyStdDevMs := flag.Float64("latency-stddev-ms", 0, "desvio padrão em ms (normal)")
+	currencies := flag.String("currencies", "", "moedas aceitas separadas por vírgula (vazio aceita todas)")
+	flag.Parse()
+
+	scenario := &processorsim.Scenario{Phases: []processorsim.Phase{{
+		Name:     "flags",
+		Failing:  *failing,
+		FailRate: *failRate,
+		Latency: processorsim.Latency{
+			Dist:     *latencyDist,
+			Ms:       *latencyMs,
+			MaxMs:    *latencyMaxMs,
+			StdDevMs: *latencyStdDevMs,
+		},
+	}}}
+
+	if *scenarioPath != "" {
+		var err error
+		scenario, err = processorsim.LoadScenario(*scenarioPath)
+		if err != nil {
+			slog.Error("Erro ao carregar cenário", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	sim := processorsim.New(processorsim.Config{
+		Fee:            *fee,
+		Token:          *token,
+		HealthInterval: *healthInterval,
+		Currencies:     splitCurrencies(*currencies),
+		Scenario:       scenario,
+	})
+
+	slog.Info("Simulador de processador rodando", "addr", *addr, "fases", len(scenario.Phases))
+	if err := http.ListenAndServe(*addr, sim.Handler()); err != nil {
+		slog.Error("Erro no simulador", "err", err)
+		os.Exit(1)
+	}
+}
+
+func splitCurrencies(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(strings.ToUpper(value), ",")
+}
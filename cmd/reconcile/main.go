@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+	"github.com/lckrugel/rinha-backend-25/internal/workers"
+)
+
+// Compara o sumário armazenado no Redis com o sumário administrativo dos
+// processadores. Sai com código 1 se houver divergência.
+func main() {
+	redisHost := flag.String("redis", envOr("REDIS_HOST", "localhost"), "host do Redis")
+	redisPassword := flag.String("redis-password", os.Getenv("REDIS_PASSWORD"), "senha do Redis")
+	redisMode := flag.String("redis-mode", os.Getenv("REDIS_MODE"), "standalone, sentinel ou cluster")
+	redisAddrs := flag.String("redis-addrs", os.Getenv("REDIS_ADDRS"), "sentinels ou nós do cluster separados por vírgula, no lugar de -redis")
+	redisMaster := flag.String("redis-master", os.Getenv("REDIS_MASTER_NAME"), "nome do master no Sentinel")
+	token := flag.String("token", envOr("PROCESSOR_ADMIN_TOKEN", "123"), "token administrativo dos processadores")
+	fromStr := flag.String("from", "", "início da janela (RFC3339), padrão: to - 1m")
+	toStr := flag.String("to", "", "fim da janela (RFC3339), padrão: agora")
+	missing := flag.Bool("missing", false, "lista os correlationIds que só existem do nosso lado")
+	flag.Parse()
+
+	to := time.Now().UTC()
+	if *toStr != "" {
+		var err error
+		to, err = time.Parse(time.RFC3339Nano, *toStr)
+		if err != nil {
+			fail("Formato inválido para o parâmetro 'to': %v", err)
+		}
+	}
+
+	from := to.Add(-time.Minute)
+	if *fromStr != "" {
+		var err error
+		from, err = time.Parse(time.RFC3339Nano, *fromStr)
+		if err != nil {
+			fail("Formato inválido para o parâmetro 'from': %v", err)
+		}
+	}
+
+	mode, ok := repositories.ParseRedisMode(*redisMode)
+	if !ok {
+		fail("Modo do Redis inválido: %s", *redisMode)
+	}
+	addrs := []string{*redisHost + ":6379"}
+	if *redisAddrs != "" {
+		addrs = strings.Split(*redisAddrs, ",")
+	}
+	redisRepo := repositories.NewRedisRepositoryWithConfig(repositories.RedisConfig{
+		Mode:             mode,
+		Addrs:            addrs,
+		Password:         *redisPassword,
+		MasterName:       *redisMaster,
+		SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+	})
+	defer redisRepo.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	report, err := workers.NewSummaryAuditor(redisRepo, *token, *missing).Audit(ctx, from, to)
+	if err != nil {
+		fail("%v", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+
+	if report.HasDrift() {
+		os.Exit(1)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func fail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
@@ -0,0 +1,163 @@
+// Package chaos injeta falhas em pontos conhecidos do processamento para
+// testar as garantias de at-least-once e de não contar pagamentos em dobro.
+// Fica desligado a menos que Enable seja chamado (CHAOS_ENABLED=true no main).
+package chaos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pontos de injeção. Comandos do Redis usam "redis:<comando>" (ex.:
+// "redis:zadd") ou "redis:*" para todos; scripts Lua usam
+// "redis:script:<nome>" (ex.: "redis:script:complete").
+const (
+	POINT_REDIS        = "redis:"
+	POINT_PAYMENT_API  = "payment-api"
+	POINT_BEFORE_STORE = "before-store"
+)
+
+const (
+	ACTION_ERROR = "error"
+	ACTION_DELAY = "delay"
+	ACTION_CRASH = "crash"
+)
+
+var ErrInjected = errors.New("falha injetada pelo chaos")
+
+// Exit é chamado pela ação crash. Pode ser trocado em testes.
+var Exit = os.Exit
+
+type Fault struct {
+	Point       string  `json:"point"`
+	Action      string  `json:"action"`
+	Probability float64 `json:"probability,omitempty"` // 0 equivale a 1
+	Delay       string  `json:"delay,omitempty"`
+	Count       int     `json:"count,omitempty"` // disparos restantes, 0 é ilimitado
+}
+
+var (
+	enabled atomic.Bool
+	mu      sync.Mutex
+	faults  = map[string]*Fault{}
+)
+
+func Enable() {
+	enabled.Store(true)
+	slog.Warn("Chaos habilitado")
+}
+
+func Enabled() bool {
+	return enabled.Load()
+}
+
+func Set(f Fault) error {
+	if !Enabled() {
+		return fmt.Errorf("Chaos não está habilitado")
+	}
+	if f.Point == "" {
+		return fmt.Errorf("Ponto de injeção vazio")
+	}
+	switch f.Action {
+	case ACTION_ERROR, ACTION_CRASH:
+	case ACTION_DELAY:
+		if _, err := time.ParseDuration(f.Delay); err != nil {
+			return fmt.Errorf("Formato inválido para o parâmetro 'delay': %w", err)
+		}
+	default:
+		return fmt.Errorf("Ação desconhecida: %q", f.Action)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	faults[f.Point] = &f
+	return nil
+}
+
+func Clear(point string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(faults, point)
+}
+
+func ClearAll() {
+	mu.Lock()
+	defer mu.Unlock()
+	faults = map[string]*Fault{}
+}
+
+func List() []Fault {
+	mu.Lock()
+	defer mu.Unlock()
+
+	list := make([]Fault, 0, len(faults))
+	for _, f := range faults {
+		list = append(list, *f)
+	}
+	slices.SortFunc(list, func(a, b Fault) int { return strings.Compare(a.Point, b.Point) })
+	return list
+}
+
+// Inject aplica a falha configurada para point, se houver. Retorna
+// ErrInjected para a ação error.
+func Inject(ctx context.Context, point string) error {
+	if !enabled.Load() {
+		return nil
+	}
+
+	f := take(point)
+	if f == nil {
+		return nil
+	}
+
+	switch f.Action {
+	case ACTION_ERROR:
+		return fmt.Errorf("%s: %w", point, ErrInjected)
+	case ACTION_DELAY:
+		delay, _ := time.ParseDuration(f.Delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	case ACTION_CRASH:
+		slog.Error("Chaos derrubando o processo", "point", point)
+		Exit(3)
+	}
+	return nil
+}
+
+func take(point string) *Fault {
+	mu.Lock()
+	defer mu.Unlock()
+
+	f, ok := faults[point]
+	if !ok && strings.HasPrefix(point, POINT_REDIS) {
+		f, ok = faults[POINT_REDIS+"*"]
+	}
+	if !ok {
+		return nil
+	}
+
+	if f.Probability > 0 && rand.Float64() >= f.Probability {
+		return nil
+	}
+
+	triggered := *f
+	if f.Count > 0 {
+		f.Count--
+		if f.Count == 0 {
+			delete(faults, f.Point)
+		}
+	}
+	return &triggered
+}
@@ -0,0 +1,69 @@
+package dtos
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DEFAULT_CURRENCY vale para pagamentos sem currency, inclusive os que já
+// estavam na stream antes do campo existir.
+const DEFAULT_CURRENCY = "BRL"
+
+// Casas decimais (minor units) de cada moeda ISO 4217 aceita.
+var minorUnits = map[string]int{
+	"ARS": 2, "AUD": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2, "CLP": 0,
+	"CNY": 2, "COP": 2, "EUR": 2, "GBP": 2, "JPY": 0, "KRW": 0, "KWD": 3,
+	"MXN": 2, "PEN": 2, "PYG": 0, "USD": 2, "UYU": 2,
+}
+
+// NormalizeCurrency retorna o código em maiúsculas, ou DEFAULT_CURRENCY se
+// vazio, e false se a moeda não for suportada.
+func NormalizeCurrency(currency string) (string, bool) {
+	if currency == "" {
+		return DEFAULT_CURRENCY, true
+	}
+	currency = strings.ToUpper(currency)
+	_, ok := minorUnits[currency]
+	return currency, ok
+}
+
+func scale(currency string) float64 {
+	units, ok := minorUnits[currency]
+	if !ok {
+		units = minorUnits[DEFAULT_CURRENCY]
+	}
+	return math.Pow10(units)
+}
+
+// ToMinor converte o valor para a menor unidade da moeda (centavos no BRL).
+func ToMinor(currency string, amount float64) int64 {
+	return int64(math.Round(amount * scale(currency)))
+}
+
+func FromMinor(currency string, minor int64) float64 {
+	return float64(minor) / scale(currency)
+}
+
+func RoundAmount(currency string, amount float64) float64 {
+	return FromMinor(currency, ToMinor(currency, amount))
+}
+
+// ValidAmount recusa valores não positivos e com mais casas decimais do que a
+// moeda permite.
+func ValidAmount(currency string, amount float64) bool {
+	if amount <= 0 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return false
+	}
+	scaled := amount * scale(currency)
+	return math.Abs(scaled-math.Round(scaled)) < 1e-6
+}
+
+// FormatAmount escreve o valor com as casas decimais da moeda.
+func FormatAmount(currency string, amount float64) string {
+	units, ok := minorUnits[currency]
+	if !ok {
+		units = minorUnits[DEFAULT_CURRENCY]
+	}
+	return strconv.FormatFloat(amount, 'f', units, 64)
+}
@@ -5,36 +5,410 @@ import "time"
 type PaymentRequest struct {
 	CorrelationId string  `json:"correlationId"`
 	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency,omitempty"`
+	CallbackUrl   string  `json:"callbackUrl,omitempty"`
 	RequestedAt   time.Time
 	RedisStreamId string
+	Tenant        string `json:"-"`
+	ClientId      string `json:"-"`
+}
+
+// APIKey identifica um cliente. Rate é a taxa sustentada em req/s e Burst o
+// tamanho do balde; Rate zero desliga o limite.
+type APIKey struct {
+	ClientId string  `json:"clientId"`
+	Tenant   string  `json:"tenant,omitempty"`
+	Rate     float64 `json:"rate,omitempty"`
+	Burst    int     `json:"burst,omitempty"`
+
+	// CallbackUrl recebe os webhooks dos pagamentos que não informam o seu
+	CallbackUrl string `json:"callbackUrl,omitempty"`
+}
+
+type CreateAPIKeyResponse struct {
+	Key string `json:"apiKey"`
+	APIKey
+}
+
+type RefundRequest struct {
+	Amount float64 `json:"amount"` // zero reembolsa todo o saldo restante
+}
+
+// Refund circula pela stream de reembolsos e, depois de concluído, fica no
+// sorted set de reembolsos do processador que recebeu o pagamento original.
+type Refund struct {
+	RefundId      string     `json:"refundId"`
+	CorrelationId string     `json:"correlationId"`
+	Amount        float64    `json:"amount"`
+	Currency      string     `json:"currency"`
+	Api           PaymentAPI `json:"paymentAPI"`
+	RequestedAt   string     `json:"requestedAt"`
+	RefundedAt    string     `json:"refundedAt,omitempty"`
+	// Horário do pagamento original, que posiciona o reembolso nos sumários
+	PaymentRequestedAt string `json:"paymentRequestedAt,omitempty"`
+	Tenant             string `json:"tenant,omitempty"`
+	RedisStreamId      string `json:"-"`
+}
+
+type RefundResponse struct {
+	RefundId      string  `json:"refundId"`
+	CorrelationId string  `json:"correlationId"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	Processor     string  `json:"processor"`
+	Remaining     float64 `json:"remaining"`
+}
+
+type ProcessorRefundRequest struct {
+	RefundId    string  `json:"refundId"`
+	Amount      float64 `json:"amount"`
+	Currency    string  `json:"currency"`
+	RequestedAt string  `json:"requestedAt"`
+}
+
+const (
+	BATCH_ACCEPTED  = "accepted"
+	BATCH_DUPLICATE = "duplicate"
+	BATCH_INVALID   = "invalid"
+)
+
+type BatchItemResult struct {
+	Index         int    `json:"index"`
+	CorrelationId string `json:"correlationId,omitempty"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Accepted   int               `json:"accepted"`
+	Duplicates int               `json:"duplicates"`
+	Invalid    int               `json:"invalid"`
+	Results    []BatchItemResult `json:"results"`
 }
 
 type PaymentAPIRequest struct {
 	CorrelationId string  `json:"correlationId"`
 	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
 	RequestedAt   string  `json:"requestedAt"`
 }
 
+// SummaryResponse traz em Default e Fallback os totais da DEFAULT_CURRENCY,
+// como antes das outras moedas existirem, e em Currencies os de cada moeda.
 type SummaryResponse struct {
+	Default    APISummary                 `json:"default"`
+	Fallback   APISummary                 `json:"fallback"`
+	Currencies map[string]CurrencySummary `json:"currencies,omitempty"`
+	Timing     *ProcessorTimings          `json:"timing,omitempty"`
+}
+
+type CurrencySummary struct {
 	Default  APISummary `json:"default"`
 	Fallback APISummary `json:"fallback"`
 }
 
+// APISummary traz o valor bruto em TotalAmount, para continuar batendo com o
+// sumário dos processadores, e os reembolsos concluídos no período à parte.
 type APISummary struct {
 	TotalRequests int     `json:"totalRequests"`
 	TotalAmount   float64 `json:"totalAmount"`
+	TotalRefunded float64 `json:"totalRefunded"`
+	NetAmount     float64 `json:"netAmount"`
 }
 
+type Percentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// TimingSummary mede, em ms, a espera na fila (requestedAt até dispatchedAt)
+// e o processamento (dispatchedAt até processedAt, incluindo as retries).
+// Samples conta só os pagamentos que têm os horários registrados.
+type TimingSummary struct {
+	Samples      int         `json:"samples"`
+	QueueWaitMs  Percentiles `json:"queueWaitMs"`
+	ProcessingMs Percentiles `json:"processingMs"`
+}
+
+type ProcessorTimings struct {
+	Default  *TimingSummary `json:"default,omitempty"`
+	Fallback *TimingSummary `json:"fallback,omitempty"`
+}
+
+// Currencies é opcional: sem ele o processador aceita qualquer moeda, a
+// menos que a configuração diga o contrário.
 type HealthCheckResponse struct {
-	Failing         bool `json:"failing"`
-	MinResponseTime int  `json:"minResponseTime"`
+	Failing         bool     `json:"failing"`
+	MinResponseTime int      `json:"minResponseTime"`
+	Currencies      []string `json:"currencies,omitempty"`
+}
+
+// HealthState é o resultado publicado pela instância líder das checagens de saúde.
+type HealthState struct {
+	Active    PaymentAPI           `json:"active"`
+	Default   *HealthCheckResponse `json:"default"`
+	Fallback  *HealthCheckResponse `json:"fallback"`
+	CheckedAt string               `json:"checkedAt"`
+	Leader    string               `json:"leader"`
+}
+
+const (
+	EVENT_SELECTOR = "selector"
+	EVENT_BREAKER  = "breaker"
+	EVENT_LATENCY  = "latency"
+	EVENT_PIN      = "pin"
+	EVENT_UNPIN    = "unpin"
+)
+
+// ProcessorEvent é trocado entre as instâncias para que todas tenham a mesma
+// visão dos processadores.
+type ProcessorEvent struct {
+	Type       string     `json:"type"`
+	Api        PaymentAPI `json:"api"`
+	Source     string     `json:"source"`
+	OpenUntil  int64      `json:"openUntil,omitempty"` // unix ms
+	LatencyMs  float64    `json:"latencyMs,omitempty"`
+	ObservedAt int64      `json:"observedAt,omitempty"` // unix ms, fim da janela das amostras de latência
+	PinUntil   int64      `json:"pinUntil,omitempty"`   // unix ms
 }
 
+type PinRequest struct {
+	Processor string `json:"processor"`
+	TTL       string `json:"ttl"`
+}
+
+type ProcessorState struct {
+	Processor        string   `json:"processor"`
+	BreakerOpen      bool     `json:"breakerOpen"`
+	BreakerOpenUntil string   `json:"breakerOpenUntil,omitempty"`
+	LatencyMs        float64  `json:"latencyMs"`
+	Currencies       []string `json:"currencies,omitempty"`
+}
+
+type SelectorState struct {
+	Active     string           `json:"active"`
+	Chosen     string           `json:"chosen"`
+	Pinned     string           `json:"pinned,omitempty"`
+	PinUntil   string           `json:"pinUntil,omitempty"`
+	Processors []ProcessorState `json:"processors"`
+}
+
+type StreamStats struct {
+	Length  int64 `json:"length"`
+	Pending int64 `json:"pending"`
+	Lag     int64 `json:"lag"`
+}
+
+type AdminState struct {
+	Instance      string        `json:"instance"`
+	Selector      SelectorState `json:"selector"`
+	Health        *HealthState  `json:"health"`
+	WorkersPaused bool          `json:"workersPaused"`
+	PoolSize      int           `json:"poolSize"`
+	Stream        *StreamStats  `json:"stream"`
+}
+
+// ProcessedPayment guarda quando o pagamento entrou na fila (RequestedAt, que
+// também é o score no sorted set, como nos processadores), quando um worker o
+// pegou (DispatchedAt) e quando o processador o aceitou (ProcessedAt).
+// Pagamentos gravados antes desses campos só têm ProcessedAt, com o horário
+// de entrada na fila.
 type ProcessedPayment struct {
 	CorrelationId string     `json:"correlationId"`
 	Api           PaymentAPI `json:"paymentAPI"`
 	Amount        float64    `json:"amount"`
+	Currency      string     `json:"currency,omitempty"`
+	RequestedAt   string     `json:"requestedAt,omitempty"`
+	DispatchedAt  string     `json:"dispatchedAt,omitempty"`
 	ProcessedAt   string     `json:"processedAt"`
+	Attempts      int        `json:"attempts,omitempty"`
+	LatencyMs     float64    `json:"latencyMs,omitempty"` // da chamada que teve sucesso
+	Tenant        string     `json:"tenant,omitempty"`
+	ClientId      string     `json:"clientId,omitempty"`
+	CallbackUrl   string     `json:"-"`
+}
+
+// SummaryTime é o horário que posiciona o pagamento nos sumários: o
+// requestedAt, ou o processedAt para pagamentos gravados antes dele.
+func (p *ProcessedPayment) SummaryTime() (time.Time, error) {
+	at := p.RequestedAt
+	if at == "" {
+		at = p.ProcessedAt
+	}
+	return time.Parse("2006-01-02T15:04:05.000Z", at)
+}
+
+const (
+	WEBHOOK_PROCESSED = "payment.processed"
+	WEBHOOK_FAILED    = "payment.failed"
+)
+
+// WebhookEvent é o corpo assinado enviado para o callbackUrl do cliente.
+type WebhookEvent struct {
+	Id            string  `json:"id"`
+	Type          string  `json:"type"`
+	CorrelationId string  `json:"correlationId"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	Processor     string  `json:"processor,omitempty"`
+	RequestedAt   string  `json:"requestedAt"`
+	Reason        string  `json:"reason,omitempty"`
+	ClientId      string  `json:"clientId,omitempty"`
+}
+
+// WebhookDelivery é o item que circula pela stream de webhooks.
+type WebhookDelivery struct {
+	Event   WebhookEvent `json:"event"`
+	Url     string       `json:"url"`
+	Attempt int          `json:"attempt"`
+}
+
+type WebhookLogEntry struct {
+	EventId       string `json:"eventId"`
+	CorrelationId string `json:"correlationId"`
+	Url           string `json:"url"`
+	Attempt       int    `json:"attempt"`
+	Status        int    `json:"status,omitempty"`
+	Error         string `json:"error,omitempty"`
+	Outcome       string `json:"outcome"` // delivered, retrying ou abandoned
+	At            string `json:"at"`
+}
+
+const (
+	PAYMENT_EVENT_QUEUED             = "payment.queued"
+	PAYMENT_EVENT_PROCESSED          = "payment.processed"
+	PAYMENT_EVENT_FAILED             = "payment.failed"
+	PAYMENT_EVENT_PROCESSOR_SWITCHED = "processor.switched"
+	PAYMENT_EVENT_REFUNDED           = "payment.refunded"
+	PAYMENT_EVENT_REFUND_FAILED      = "refund.failed"
+)
+
+// Situação de um pagamento desde o aceite (GET /payments/:correlationId).
+const (
+	PAYMENT_STATUS_QUEUED    = "queued"
+	PAYMENT_STATUS_PROCESSED = "processed"
+	PAYMENT_STATUS_FAILED    = "failed"
+	PAYMENT_STATUS_ARCHIVED  = "archived"
+)
+
+type PaymentStatus struct {
+	CorrelationId string `json:"correlationId"`
+	Status        string `json:"status"`
+	Processor     string `json:"processor,omitempty"` // só em processed e archived
+}
+
+// PaymentEvent é uma entrada do feed de eventos (GET /payments/events). Id é o
+// id da mensagem na stream e serve de Last-Event-ID.
+type PaymentEvent struct {
+	Id            string  `json:"-"`
+	Tenant        string  `json:"-"`
+	Type          string  `json:"type"`
+	CorrelationId string  `json:"correlationId,omitempty"`
+	Amount        float64 `json:"amount,omitempty"`
+	Currency      string  `json:"currency,omitempty"`
+	Processor     string  `json:"processor,omitempty"`
+	Previous      string  `json:"previous,omitempty"` // só em processor.switched
+	Reason        string  `json:"reason,omitempty"`
+	RefundId      string  `json:"refundId,omitempty"`
+	At            string  `json:"at"`
+}
+
+// PaymentIntent é registrado antes de cada chamada ao processador para que um
+// crash entre a chamada e o StoreProcessed possa ser reconciliado depois.
+type PaymentIntent struct {
+	CorrelationId string     `json:"correlationId"`
+	Amount        float64    `json:"amount"`
+	Currency      string     `json:"currency,omitempty"`
+	RequestedAt   string     `json:"requestedAt"`
+	DispatchedAt  string     `json:"dispatchedAt,omitempty"`
+	Attempts      int        `json:"attempts,omitempty"`
+	Api           PaymentAPI `json:"paymentAPI"`
+	RedisStreamId string     `json:"streamId"`
+	Tenant        string     `json:"tenant,omitempty"`
+	ClientId      string     `json:"clientId,omitempty"`
+	CallbackUrl   string     `json:"callbackUrl,omitempty"`
+	RecordedAt    string     `json:"recordedAt,omitempty"` // última gravação, para achar intenções abandonadas
+}
+
+type ProcessorPaymentResponse struct {
+	CorrelationId string  `json:"correlationId"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency,omitempty"`
+	RequestedAt   string  `json:"requestedAt"`
+}
+
+// ProcessorSummaryResponse é a resposta do GET /admin/payments-summary dos processadores.
+type ProcessorSummaryResponse struct {
+	TotalRequests     int     `json:"totalRequests"`
+	TotalAmount       float64 `json:"totalAmount"`
+	TotalFee          float64 `json:"totalFee"`
+	FeePerTransaction float64 `json:"feePerTransaction"`
+	TotalRefunded     float64 `json:"totalRefunded,omitempty"`
+}
+
+// ProcessorAudit compara valores só na DEFAULT_CURRENCY: o sumário do
+// processador soma todas as moedas. Se a janela tiver pagamentos em outras
+// moedas, elas ficam em UnauditedCurrencies e o AmountDrift não é calculado.
+type ProcessorAudit struct {
+	Processor           string     `json:"processor"`
+	Local               APISummary `json:"local"`
+	Remote              APISummary `json:"remote"`
+	RequestsDrift       int        `json:"requestsDrift"`
+	AmountDrift         float64    `json:"amountDrift"`
+	UnauditedCurrencies []string   `json:"unauditedCurrencies,omitempty"`
+	OnlyLocal           []string   `json:"onlyLocal,omitempty"`
+}
+
+type AuditReport struct {
+	From       string           `json:"from"`
+	To         string           `json:"to"`
+	Processors []ProcessorAudit `json:"processors"`
+}
+
+func (r *AuditReport) HasDrift() bool {
+	for _, p := range r.Processors {
+		if p.RequestsDrift != 0 || p.AmountDrift != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportRecord é uma linha do export de pagamentos processados.
+type ExportRecord struct {
+	CorrelationId string  `json:"correlationId"`
+	Processor     string  `json:"processor"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	RequestedAt   string  `json:"requestedAt,omitempty"`
+	DispatchedAt  string  `json:"dispatchedAt,omitempty"`
+	ProcessedAt   string  `json:"processedAt"`
+	Attempts      int     `json:"attempts,omitempty"`
+	LatencyMs     float64 `json:"latencyMs,omitempty"`
+	ClientId      string  `json:"clientId,omitempty"`
+}
+
+// ExportTrailer fecha o export: quantidade de linhas e SHA-256 de todos os
+// bytes anteriores ao trailer.
+type ExportTrailer struct {
+	Rows   int64  `json:"rows"`
+	Sha256 string `json:"sha256"`
+}
+
+// PurgeScope restringe o que o purge apaga. Datas zeradas e Api nil valem
+// para todo o período e os dois processadores.
+type PurgeScope struct {
+	Tenant     string
+	From       time.Time
+	To         time.Time
+	Api        *PaymentAPI
+	DropQueued bool // também descarta pagamentos ainda na stream
+}
+
+func (s *PurgeScope) IsFull() bool {
+	return s.From.IsZero() && s.To.IsZero() && s.Api == nil
 }
 
 type PaymentAPI uint8
@@ -44,6 +418,28 @@ const (
 	FALLBACK_API
 )
 
+func (api PaymentAPI) String() string {
+	switch api {
+	case DEFAULT_API:
+		return "default"
+	case FALLBACK_API:
+		return "fallback"
+	default:
+		return "unknown"
+	}
+}
+
+func ParsePaymentAPI(name string) (PaymentAPI, bool) {
+	switch name {
+	case "default":
+		return DEFAULT_API, true
+	case "fallback":
+		return FALLBACK_API, true
+	default:
+		return 0, false
+	}
+}
+
 var ApiUrl = map[PaymentAPI]string{
 	DEFAULT_API:  "http://payment-processor-default:8080",
 	FALLBACK_API: "http://payment-processor-fallback:8080",
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+	"github.com/lckrugel/rinha-backend-25/internal/workers"
+)
+
+type AdminHandlers struct {
+	redisRepo  *repositories.RedisRepository
+	selector   *workers.ServiceSelector
+	workers    *workers.Workers
+	instanceId string
+}
+
+func NewAdminHandlers(redisRepo *repositories.RedisRepository, selector *workers.ServiceSelector, paymentWorkers *workers.Workers, instanceId string) *AdminHandlers {
+	return &AdminHandlers{
+		redisRepo:  redisRepo,
+		selector:   selector,
+		workers:    paymentWorkers,
+		instanceId: instanceId,
+	}
+}
+
+func (h *AdminHandlers) GetState(c *gin.Context) {
+	state := dtos.AdminState{
+		Instance:      h.instanceId,
+		Selector:      h.selector.Snapshot(),
+		WorkersPaused: h.workers.Paused(),
+		PoolSize:      h.workers.PoolSize(),
+	}
+
+	health, err := h.redisRepo.GetHealthState(c)
+	if err != nil {
+		slog.Warn("Erro ao buscar estado de saúde", "err", err)
+	}
+	state.Health = health
+
+	stream, err := h.redisRepo.GetStreamStats(c)
+	if err != nil {
+		slog.Warn("Erro ao buscar estatísticas da stream", "err", err)
+	}
+	state.Stream = stream
+
+	c.JSON(http.StatusOK, state)
+}
+
+func (h *AdminHandlers) PinProcessor(c *gin.Context) {
+	var pinRequest dtos.PinRequest
+	err := c.ShouldBindJSON(&pinRequest)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Corpo inválido", "error": err.Error()})
+		return
+	}
+
+	api, ok := dtos.ParsePaymentAPI(pinRequest.Processor)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Processador deve ser 'default' ou 'fallback'"})
+		return
+	}
+
+	ttl, err := time.ParseDuration(pinRequest.TTL)
+	if err != nil || ttl <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Formato inválido para o parâmetro 'ttl'"})
+		return
+	}
+
+	until := h.selector.Pin(api, ttl)
+	slog.Warn("Processador fixado manualmente", "processor", api, "until", until)
+
+	c.JSON(http.StatusOK, h.selector.Snapshot())
+}
+
+func (h *AdminHandlers) UnpinProcessor(c *gin.Context) {
+	h.selector.Unpin()
+	slog.Warn("Fixação de processador removida")
+
+	c.JSON(http.StatusOK, h.selector.Snapshot())
+}
+
+func (h *AdminHandlers) PauseWorkers(c *gin.Context) {
+	h.workers.Pause()
+	slog.Warn("Workers pausados", "instance", h.instanceId)
+	c.JSON(http.StatusOK, gin.H{"message": "Workers pausados", "instance": h.instanceId})
+}
+
+func (h *AdminHandlers) ResumeWorkers(c *gin.Context) {
+	h.workers.Resume()
+	slog.Warn("Workers retomados", "instance", h.instanceId)
+	c.JSON(http.StatusOK, gin.H{"message": "Workers retomados", "instance": h.instanceId})
+}
+
+func (h *AdminHandlers) ListTenants(c *gin.Context) {
+	tenants, err := h.redisRepo.Tenants(c)
+	if err != nil {
+		slog.Error("Erro ao buscar tenants", "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao buscar tenants"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tenants": tenants})
+}
+
+// RegisterTenant libera um tenant para o header X-Tenant-Id.
+func (h *AdminHandlers) RegisterTenant(c *gin.Context) {
+	var body struct {
+		Tenant string `json:"tenant"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Tenant == "" || !repositories.ValidTenant(body.Tenant) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Tenant inválido"})
+		return
+	}
+
+	err := h.redisRepo.RegisterTenant(c, body.Tenant)
+	if err != nil {
+		slog.Error("Erro ao registrar tenant", "tenant", body.Tenant, "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao registrar tenant"})
+		return
+	}
+	slog.Warn("Tenant registrado", "tenant", body.Tenant)
+	c.JSON(http.StatusCreated, gin.H{"tenant": body.Tenant})
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+)
+
+const (
+	APIKeyHeader       = "X-API-Key"
+	clientContextKey   = "clientId"
+	callbackContextKey = "callbackUrl"
+	apiKeyCacheTTL     = 30 * time.Second
+)
+
+type cachedAPIKey struct {
+	key       *dtos.APIKey
+	expiresAt time.Time
+}
+
+// APIKeyAuth autentica pelo header X-API-Key, procurando primeiro nas chaves
+// da configuração (API_KEYS) e depois no Redis, e aplica o rate limit de cada
+// cliente.
+type APIKeyAuth struct {
+	redisRepo *repositories.RedisRepository
+	static    map[string]dtos.APIKey // por hash da chave
+
+	mu    sync.Mutex
+	cache map[string]cachedAPIKey
+}
+
+func NewAPIKeyAuth(redisRepo *repositories.RedisRepository, static map[string]dtos.APIKey) *APIKeyAuth {
+	hashed := make(map[string]dtos.APIKey, len(static))
+	for apiKey, key := range static {
+		hashed[repositories.HashAPIKey(apiKey)] = key
+	}
+	return &APIKeyAuth{
+		redisRepo: redisRepo,
+		static:    hashed,
+		cache:     make(map[string]cachedAPIKey),
+	}
+}
+
+// ParseAPIKeys lê "chave=cliente:tenant:rate:burst,..." (tenant, rate e burst
+// são opcionais).
+func ParseAPIKeys(spec string) (map[string]dtos.APIKey, error) {
+	keys := make(map[string]dtos.APIKey)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		apiKey, rest, ok := strings.Cut(entry, "=")
+		if !ok || apiKey == "" {
+			return nil, fmt.Errorf("Chave de API inválida: %q", entry)
+		}
+
+		fields := strings.Split(rest, ":")
+		key := dtos.APIKey{ClientId: fields[0]}
+		if len(fields) > 1 {
+			key.Tenant = fields[1]
+		}
+		if len(fields) > 2 && fields[2] != "" {
+			rate, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Rate inválido para %q: %w", key.ClientId, err)
+			}
+			key.Rate = rate
+		}
+		if len(fields) > 3 && fields[3] != "" {
+			burst, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("Burst inválido para %q: %w", key.ClientId, err)
+			}
+			key.Burst = burst
+		}
+
+		if key.ClientId == "" || !repositories.ValidTenant(key.Tenant) {
+			return nil, fmt.Errorf("Chave de API inválida: %q", entry)
+		}
+		keys[apiKey] = key
+	}
+	return keys, nil
+}
+
+func (a *APIKeyAuth) lookup(c *gin.Context, apiKey string) (*dtos.APIKey, error) {
+	hash := repositories.HashAPIKey(apiKey)
+	if key, ok := a.static[hash]; ok {
+		return &key, nil
+	}
+
+	a.mu.Lock()
+	cached, ok := a.cache[hash]
+	a.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.key, nil
+	}
+
+	key, err := a.redisRepo.GetAPIKey(c, apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.cache[hash] = cachedAPIKey{key: key, expiresAt: time.Now().Add(apiKeyCacheTTL)}
+	a.mu.Unlock()
+	return key, nil
+}
+
+// Middleware precisa rodar antes do ResolveTenant: o tenant da chave tem
+// precedência e um X-Tenant-Id diferente dele é recusado.
+func (a *APIKeyAuth) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey := c.GetHeader(APIKeyHeader)
+		if apiKey == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Chave de API ausente"})
+			return
+		}
+
+		key, err := a.lookup(c, apiKey)
+		if err != nil {
+			slog.Error("Erro ao autenticar chave de API", "err", err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"message": "Erro ao autenticar chave de API"})
+			return
+		}
+		if key == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Chave de API inválida"})
+			return
+		}
+
+		if tenant := c.GetHeader(TenantHeader); tenant != "" && tenant != key.Tenant {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "Chave de API não pertence ao tenant"})
+			return
+		}
+		c.Request.Header.Set(TenantHeader, key.Tenant)
+		c.Set(tenantBoundContextKey, true)
+
+		if key.Rate > 0 {
+			burst := max(key.Burst, 1)
+			allowed, wait, err := a.redisRepo.AllowRequest(c, key.ClientId, key.Rate, burst)
+			if err != nil {
+				// Sem Redis o limite não pode ser compartilhado; melhor deixar passar
+				slog.Warn("Rate limit indisponível", "clientId", key.ClientId, "err", err)
+			} else if !allowed {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"message": "Limite de requisições excedido"})
+				return
+			}
+		}
+
+		c.Set(clientContextKey, key.ClientId)
+		c.Set(callbackContextKey, key.CallbackUrl)
+		c.Next()
+	}
+}
+
+func clientOf(c *gin.Context) string {
+	return c.GetString(clientContextKey)
+}
+
+// callbackOf devolve o callbackUrl padrão da chave de API usada na requisição.
+func callbackOf(c *gin.Context) string {
+	return c.GetString(callbackContextKey)
+}
+
+func (a *APIKeyAuth) CreateAPIKey(c *gin.Context) {
+	var key dtos.APIKey
+	err := c.ShouldBindJSON(&key)
+	if err != nil || key.ClientId == "" || !repositories.ValidTenant(key.Tenant) || key.Rate < 0 || key.Burst < 0 || !validCallbackUrl(c, key.CallbackUrl) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Chave de API inválida"})
+		return
+	}
+
+	err = a.redisRepo.RegisterTenant(c, key.Tenant)
+	if err != nil {
+		slog.Error("Erro ao registrar tenant da chave de API", "tenant", key.Tenant, "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao criar chave de API"})
+		return
+	}
+
+	secret := make([]byte, 24)
+	rand.Read(secret)
+	apiKey := hex.EncodeToString(secret)
+
+	err = a.redisRepo.StoreAPIKey(c, apiKey, &key)
+	if err != nil {
+		slog.Error("Erro ao criar chave de API", "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao criar chave de API"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, dtos.CreateAPIKeyResponse{Key: apiKey, APIKey: key})
+}
+
+func (a *APIKeyAuth) RevokeAPIKey(c *gin.Context) {
+	var body struct {
+		APIKey string `json:"apiKey"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.APIKey == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Chave de API ausente"})
+		return
+	}
+
+	removed, err := a.redisRepo.DeleteAPIKey(c, body.APIKey)
+	if err != nil {
+		slog.Error("Erro ao revogar chave de API", "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao revogar chave de API"})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Chave de API não encontrada"})
+		return
+	}
+
+	a.mu.Lock()
+	delete(a.cache, repositories.HashAPIKey(body.APIKey))
+	a.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"message": "Chave de API revogada"})
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+)
+
+const (
+	maxBatchItems = 1000
+	maxBatchBytes = 4 << 20
+)
+
+// HandlePaymentBatch aceita um array JSON ou NDJSON (um pagamento por linha,
+// Content-Type application/x-ndjson). Cada item é validado e respondido
+// separadamente; um item inválido não derruba o lote.
+func (h *PaymentHandlers) HandlePaymentBatch(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBatchBytes+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Erro ao ler corpo do lote", "error": err.Error()})
+		return
+	}
+	if len(body) > maxBatchBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Lote excede o tamanho máximo"})
+		return
+	}
+
+	items, err := splitBatch(body, c.ContentType())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Corpo do lote inválido", "error": err.Error()})
+		return
+	}
+	if len(items) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Lote vazio"})
+		return
+	}
+	if len(items) > maxBatchItems {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Lote excede o número máximo de itens", "max": maxBatchItems})
+		return
+	}
+
+	response := dtos.BatchResponse{Results: make([]dtos.BatchItemResult, len(items))}
+	var payments []*dtos.PaymentRequest
+	var positions []int
+	for i, raw := range items {
+		result := &response.Results[i]
+		result.Index = i
+
+		payment, reason := parseBatchItem(c, raw)
+		if payment != nil {
+			result.CorrelationId = payment.CorrelationId
+		}
+		if reason != "" {
+			result.Status = dtos.BATCH_INVALID
+			result.Error = reason
+			response.Invalid++
+			continue
+		}
+		payments = append(payments, payment)
+		positions = append(positions, i)
+	}
+
+	if len(payments) > 0 {
+		accepted, err := h.redisRepo.AddBatchToStream(c, tenantOf(c), payments)
+		if errors.Is(err, repositories.ErrBacklogFull) {
+			backlogFull(c)
+			return
+		}
+		if err != nil {
+			slog.Error("Erro ao enfileirar lote de pagamentos", "err", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao enfileirar lote de pagamentos"})
+			return
+		}
+		for j, ok := range accepted {
+			result := &response.Results[positions[j]]
+			if ok {
+				result.Status = dtos.BATCH_ACCEPTED
+				response.Accepted++
+			} else {
+				result.Status = dtos.BATCH_DUPLICATE
+				response.Duplicates++
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// splitBatch separa o corpo em itens sem decodificá-los, para que um item
+// malformado vire um resultado inválido em vez de recusar o lote.
+func splitBatch(body []byte, contentType string) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(body)
+	if contentType != "application/x-ndjson" && bytes.HasPrefix(trimmed, []byte("[")) {
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, err
+		}
+		return items, nil
+	}
+
+	var items []json.RawMessage
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchBytes)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		items = append(items, json.RawMessage(line))
+	}
+	return items, scanner.Err()
+}
+
+// parseBatchItem retorna o motivo da recusa, ou "" se o item for válido.
+func parseBatchItem(c *gin.Context, raw json.RawMessage) (*dtos.PaymentRequest, string) {
+	var payment dtos.PaymentRequest
+	if err := json.Unmarshal(raw, &payment); err != nil {
+		return nil, "JSON inválido"
+	}
+	switch {
+	case payment.CorrelationId == "":
+		return &payment, "correlationId ausente"
+	}
+
+	currency, ok := dtos.NormalizeCurrency(payment.Currency)
+	if !ok {
+		return &payment, "moeda não suportada"
+	}
+	if !dtos.ValidAmount(currency, payment.Amount) {
+		return &payment, "amount inválido para a moeda " + currency
+	}
+	payment.Currency = currency
+
+	if payment.CallbackUrl == "" {
+		payment.CallbackUrl = callbackOf(c)
+	}
+	if !validCallbackUrl(c, payment.CallbackUrl) {
+		return &payment, "callbackUrl inválido"
+	}
+	payment.ClientId = clientOf(c)
+	return &payment, ""
+}
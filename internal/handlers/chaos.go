@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lckrugel/rinha-backend-25/internal/chaos"
+)
+
+func ListFaults(c *gin.Context) {
+	c.JSON(http.StatusOK, chaos.List())
+}
+
+func SetFault(c *gin.Context) {
+	var fault chaos.Fault
+	err := c.ShouldBindJSON(&fault)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Corpo inválido", "error": err.Error()})
+		return
+	}
+
+	err = chaos.Set(fault)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Falha inválida", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, chaos.List())
+}
+
+// ClearFaults remove a falha do ponto informado em ?point= ou todas, se vazio.
+func ClearFaults(c *gin.Context) {
+	if point := c.Query("point"); point != "" {
+		chaos.Clear(point)
+	} else {
+		chaos.ClearAll()
+	}
+	c.JSON(http.StatusOK, chaos.List())
+}
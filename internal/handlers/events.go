@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+)
+
+const (
+	// Sem eventos, um comentário mantém a conexão aberta através do nginx
+	eventsKeepAlive = 15 * time.Second
+	// Eventos aguardando um cliente lento antes de ele ser desconectado
+	eventsBuffer           = 256
+	defaultMaxEventClients = 256
+)
+
+var errTooManyEventClients = errors.New("conexões demais no feed de eventos")
+
+type eventClient struct {
+	tenant string
+	events chan dtos.PaymentEvent
+}
+
+// eventHub lê o feed com uma única conexão bloqueada no Redis, enquanto houver
+// clientes, e repassa cada evento aos clientes do tenant. Um cliente que não
+// acompanha é desconectado e retoma pelo Last-Event-ID, sem atrasar os demais.
+type eventHub struct {
+	redisRepo  *repositories.RedisRepository
+	maxClients int
+
+	mu      sync.Mutex
+	clients map[*eventClient]struct{}
+	running bool
+}
+
+func newEventHub(redisRepo *repositories.RedisRepository, maxClients int) *eventHub {
+	return &eventHub{
+		redisRepo:  redisRepo,
+		maxClients: maxClients,
+		clients:    make(map[*eventClient]struct{}),
+	}
+}
+
+func (hub *eventHub) subscribe(ctx context.Context, tenant string) (*eventClient, error) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if len(hub.clients) >= hub.maxClients {
+		return nil, errTooManyEventClients
+	}
+
+	if !hub.running {
+		cursor, err := hub.redisRepo.LastEventId(ctx)
+		if err != nil {
+			return nil, err
+		}
+		hub.running = true
+		go hub.run(cursor)
+	}
+
+	client := &eventClient{tenant: tenant, events: make(chan dtos.PaymentEvent, eventsBuffer)}
+	hub.clients[client] = struct{}{}
+	return client, nil
+}
+
+func (hub *eventHub) unsubscribe(client *eventClient) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.drop(client)
+}
+
+func (hub *eventHub) drop(client *eventClient) {
+	if _, ok := hub.clients[client]; ok {
+		delete(hub.clients, client)
+		close(client.events)
+	}
+}
+
+// run para quando o último cliente sai; o próximo volta a ler do fim do feed.
+func (hub *eventHub) run(cursor string) {
+	for {
+		hub.mu.Lock()
+		if len(hub.clients) == 0 {
+			hub.running = false
+			hub.mu.Unlock()
+			return
+		}
+		hub.mu.Unlock()
+
+		events, next, err := hub.redisRepo.ReadEvents(context.Background(), cursor, true)
+		if err != nil {
+			slog.Warn("Erro ao ler feed de eventos", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		cursor = next
+		hub.broadcast(events)
+	}
+}
+
+func (hub *eventHub) broadcast(events []dtos.PaymentEvent) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for client := range hub.clients {
+		for i := range events {
+			if repositories.EventVisibleTo(&events[i], client.tenant) && !hub.offer(client, &events[i]) {
+				break
+			}
+		}
+	}
+}
+
+// offer desconecta o cliente se o buffer dele estiver cheio.
+func (hub *eventHub) offer(client *eventClient, event *dtos.PaymentEvent) bool {
+	select {
+	case client.events <- *event:
+		return true
+	default:
+		slog.Warn("Cliente do feed de eventos atrasado, desconectando", "tenant", client.tenant)
+		hub.drop(client)
+		return false
+	}
+}
+
+// SetMaxEventClients limita as conexões SSE abertas nesta instância.
+func (h *PaymentHandlers) SetMaxEventClients(maxClients int) {
+	h.events.mu.Lock()
+	h.events.maxClients = maxClients
+	h.events.mu.Unlock()
+}
+
+// StreamEvents serve o feed de eventos do tenant como Server-Sent Events. O
+// cliente retoma de onde parou enviando Last-Event-ID (ou ?lastEventId=);
+// sem ele recebe só os eventos a partir da conexão.
+func (h *PaymentHandlers) StreamEvents(c *gin.Context) {
+	cursor := c.GetHeader("Last-Event-ID")
+	if cursor == "" {
+		cursor = c.Query("lastEventId")
+	}
+	if cursor != "" && !repositories.ValidEventId(cursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Last-Event-ID inválido"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	tenant := tenantOf(c)
+	client, err := h.events.subscribe(ctx, tenant)
+	if errors.Is(err, errTooManyEventClients) {
+		c.Header("Retry-After", "5")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Conexões demais no feed de eventos"})
+		return
+	}
+	if err != nil {
+		slog.Error("Erro ao abrir feed de eventos", "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao abrir feed de eventos"})
+		return
+	}
+	defer h.events.unsubscribe(client)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	// Quem retoma lê o que perdeu direto do Redis até o fim do feed; o que o
+	// leitor repassar até lá e já tiver sido enviado é ignorado.
+	sent := ""
+	for cursor != "" {
+		events, next, err := h.redisRepo.ReadEvents(ctx, cursor, false)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("Erro ao ler feed de eventos", "err", err)
+			}
+			return
+		}
+		for i := range events {
+			if repositories.EventVisibleTo(&events[i], tenant) {
+				writeEvent(c, &events[i])
+			}
+		}
+		if next == cursor {
+			break
+		}
+		cursor, sent = next, next
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-client.events:
+			if !ok {
+				return
+			}
+			if sent != "" && !repositories.EventAfter(event.Id, sent) {
+				continue
+			}
+			writeEvent(c, &event)
+		case <-keepAlive.C:
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeEvent(c *gin.Context, event *dtos.PaymentEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+)
+
+const exportChunk = 500 // pagamentos lidos do Redis por vez
+
+var exportColumns = []string{
+	"correlationId", "processor", "amount", "currency", "requestedAt",
+	"dispatchedAt", "processedAt", "attempts", "latencyMs", "clientId",
+}
+
+// ExportPayments transmite os pagamentos processados do período em CSV ou
+// NDJSON (format=csv|ndjson), bloco a bloco, sem montar o arquivo em memória.
+// Aceita os mesmos from, to (ou last) e processor do purge.
+//
+// O arquivo termina com um trailer com o número de linhas e o SHA-256 de
+// todos os bytes anteriores a ele: no CSV a linha "#rows=N,sha256=...", no
+// NDJSON um objeto {"trailer":{...}}. Os mesmos valores vão nos trailers HTTP
+// X-Export-Rows e X-Export-Sha256. Sem trailer, o export foi interrompido.
+//
+// Pagamentos arquivados pela retenção não estão no Redis: um período que os
+// inclua é recusado com 422 e o archivedUntil de onde o export pode começar.
+func (h *PaymentHandlers) ExportPayments(c *gin.Context) {
+	from, to, ok := parseRangeQuery(c)
+	if !ok {
+		return
+	}
+
+	apis := []dtos.PaymentAPI{dtos.DEFAULT_API, dtos.FALLBACK_API}
+	if processor := c.Query("processor"); processor != "" {
+		api, ok := dtos.ParsePaymentAPI(processor)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Processador deve ser 'default' ou 'fallback'"})
+			return
+		}
+		apis = []dtos.PaymentAPI{api}
+	}
+
+	tenant := tenantOf(c)
+	archivedUntil, err := h.archivedUntil(c, tenant, apis, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao consultar pagamentos arquivados", "error": err.Error()})
+		return
+	}
+	if !archivedUntil.IsZero() {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"message":       "O período inclui pagamentos arquivados, que o export não lê",
+			"archivedUntil": archivedUntil.Format("2006-01-02T15:04:05.000Z"),
+		})
+		return
+	}
+
+	format := c.DefaultQuery("format", "csv")
+	switch format {
+	case "csv":
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	case "ndjson":
+		c.Header("Content-Type", "application/x-ndjson")
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Formato deve ser 'csv' ou 'ndjson'"})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"payments.%s\"", format))
+	c.Header("Trailer", "X-Export-Rows, X-Export-Sha256")
+	c.Status(http.StatusOK)
+
+	checksum := sha256.New()
+	body := io.MultiWriter(c.Writer, checksum)
+	var encoder exportEncoder = &ndjsonExport{encoder: json.NewEncoder(body)}
+	if format == "csv" {
+		encoder = newCSVExport(body)
+	}
+
+	var rows int64
+	err = encoder.header()
+	for _, api := range apis {
+		if err != nil {
+			break
+		}
+		err = h.redisRepo.ScanProcessed(c, tenant, api, from, to, exportChunk, func(payments []dtos.ProcessedPayment) error {
+			for i := range payments {
+				if err := encoder.write(exportRecord(&payments[i])); err != nil {
+					return err
+				}
+				rows++
+			}
+			if err := encoder.flush(); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+			return nil
+		})
+	}
+	if err == nil {
+		err = encoder.flush()
+	}
+	if err == nil {
+		// A retenção pode ter arquivado parte do período durante a leitura
+		if archivedUntil, err = h.archivedUntil(c, tenant, apis, from, to); err == nil && !archivedUntil.IsZero() {
+			err = errExportArchived
+		}
+	}
+	if err != nil {
+		// O status já foi enviado; a falta do trailer marca o arquivo como incompleto
+		slog.Error("Erro ao exportar pagamentos", "err", err, "tenant", tenant, "rows", rows)
+		encoder.abort(c.Writer, err)
+		return
+	}
+
+	trailer := dtos.ExportTrailer{Rows: rows, Sha256: hex.EncodeToString(checksum.Sum(nil))}
+	encoder.trailer(c.Writer, &trailer)
+	c.Writer.Header().Set("X-Export-Rows", strconv.FormatInt(trailer.Rows, 10))
+	c.Writer.Header().Set("X-Export-Sha256", trailer.Sha256)
+}
+
+var errExportArchived = errors.New("pagamentos do período arquivados durante o export")
+
+func (h *PaymentHandlers) archivedUntil(ctx context.Context, tenant string, apis []dtos.PaymentAPI, from, to time.Time) (time.Time, error) {
+	var until time.Time
+	for _, api := range apis {
+		archived, err := h.redisRepo.ArchivedUntil(ctx, tenant, api, from, to)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if archived.After(until) {
+			until = archived
+		}
+	}
+	return until, nil
+}
+
+func exportRecord(payment *dtos.ProcessedPayment) *dtos.ExportRecord {
+	currency := payment.Currency
+	if currency == "" {
+		currency = dtos.DEFAULT_CURRENCY
+	}
+	return &dtos.ExportRecord{
+		CorrelationId: payment.CorrelationId,
+		Processor:     payment.Api.String(),
+		Amount:        payment.Amount,
+		Currency:      currency,
+		RequestedAt:   payment.RequestedAt,
+		DispatchedAt:  payment.DispatchedAt,
+		ProcessedAt:   payment.ProcessedAt,
+		Attempts:      payment.Attempts,
+		LatencyMs:     payment.LatencyMs,
+		ClientId:      payment.ClientId,
+	}
+}
+
+// exportEncoder escreve as linhas pelo writer que alimenta o checksum; o
+// trailer e o aviso de erro vão direto para a resposta, fora do checksum.
+type exportEncoder interface {
+	header() error
+	write(record *dtos.ExportRecord) error
+	flush() error
+	trailer(w io.Writer, trailer *dtos.ExportTrailer)
+	abort(w io.Writer, err error)
+}
+
+type csvExport struct {
+	writer *csv.Writer
+}
+
+func newCSVExport(w io.Writer) *csvExport {
+	return &csvExport{writer: csv.NewWriter(w)}
+}
+
+func (e *csvExport) header() error {
+	return e.writer.Write(exportColumns)
+}
+
+func (e *csvExport) write(record *dtos.ExportRecord) error {
+	attempts := ""
+	if record.Attempts > 0 {
+		attempts = strconv.Itoa(record.Attempts)
+	}
+	latency := ""
+	if record.LatencyMs > 0 {
+		latency = strconv.FormatFloat(record.LatencyMs, 'f', 3, 64)
+	}
+	return e.writer.Write([]string{
+		record.CorrelationId,
+		record.Processor,
+		dtos.FormatAmount(record.Currency, record.Amount),
+		record.Currency,
+		record.RequestedAt,
+		record.DispatchedAt,
+		record.ProcessedAt,
+		attempts,
+		latency,
+		record.ClientId,
+	})
+}
+
+func (e *csvExport) flush() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+func (e *csvExport) trailer(w io.Writer, trailer *dtos.ExportTrailer) {
+	fmt.Fprintf(w, "#rows=%d,sha256=%s\n", trailer.Rows, trailer.Sha256)
+}
+
+func (e *csvExport) abort(w io.Writer, err error) {
+	e.writer.Flush()
+	fmt.Fprintf(w, "#error=%q\n", err.Error())
+}
+
+type ndjsonExport struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonExport) header() error { return nil }
+
+func (e *ndjsonExport) write(record *dtos.ExportRecord) error {
+	return e.encoder.Encode(record)
+}
+
+func (e *ndjsonExport) flush() error { return nil }
+
+func (e *ndjsonExport) trailer(w io.Writer, trailer *dtos.ExportTrailer) {
+	json.NewEncoder(w).Encode(gin.H{"trailer": trailer})
+}
+
+func (e *ndjsonExport) abort(w io.Writer, err error) {
+	json.NewEncoder(w).Encode(gin.H{"error": err.Error()})
+}
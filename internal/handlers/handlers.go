@@ -1,8 +1,10 @@
 package handlers
 
 import (
+	"errors"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -12,11 +14,13 @@ import (
 
 type PaymentHandlers struct {
 	redisRepo *repositories.RedisRepository
+	events    *eventHub
 }
 
 func NewPaymentHandlers(redisRepo *repositories.RedisRepository) *PaymentHandlers {
 	return &PaymentHandlers{
 		redisRepo: redisRepo,
+		events:    newEventHub(redisRepo, defaultMaxEventClients),
 	}
 }
 
@@ -29,74 +33,216 @@ func (h *PaymentHandlers) HandlePayment(c *gin.Context) {
 		return
 	}
 
-	h.redisRepo.AddToStream(c, &paymentData)
+	currency, ok := dtos.NormalizeCurrency(paymentData.Currency)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Moeda não suportada"})
+		return
+	}
+	if !dtos.ValidAmount(currency, paymentData.Amount) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "amount inválido para a moeda " + currency})
+		return
+	}
+	paymentData.Currency = currency
+
+	if paymentData.CallbackUrl == "" {
+		paymentData.CallbackUrl = callbackOf(c)
+	}
+	if !validCallbackUrl(c, paymentData.CallbackUrl) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "callbackUrl inválido"})
+		return
+	}
+
+	paymentData.Tenant = tenantOf(c)
+	paymentData.ClientId = clientOf(c)
+	err := h.redisRepo.AddToStream(c, &paymentData)
+	switch {
+	case errors.Is(err, repositories.ErrBacklogFull):
+		backlogFull(c)
+	case errors.Is(err, repositories.ErrDuplicatePayment):
+		c.JSON(http.StatusConflict, gin.H{"message": "Pagamento já recebido"})
+	case err != nil:
+		slog.Error("Erro ao enfileirar pagamento", "correlationId", paymentData.CorrelationId, "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao enfileirar pagamento"})
+	default:
+		c.Status(http.StatusOK)
+	}
+}
+
+func (h *PaymentHandlers) GetPaymentStatus(c *gin.Context) {
+	correlationId := c.Param("correlationId")
+	status, err := h.redisRepo.GetPaymentStatus(c, tenantOf(c), correlationId)
+	switch {
+	case errors.Is(err, repositories.ErrPaymentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": "Pagamento não encontrado"})
+	case err != nil:
+		slog.Error("Erro ao buscar status do pagamento", "correlationId", correlationId, "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao buscar status do pagamento"})
+	default:
+		c.JSON(http.StatusOK, status)
+	}
+}
+
+// backlogFullRetryAfter é o intervalo sugerido ao cliente quando a fila está
+// cheia: alguns ciclos do BacklogMonitor.
+const backlogFullRetryAfter = "5"
+
+func backlogFull(c *gin.Context) {
+	c.Header("Retry-After", backlogFullRetryAfter)
+	c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Fila de pagamentos cheia, tente novamente mais tarde"})
+}
 
-	c.Status(http.StatusOK)
+// unalignedRange responde 400 a um período que corta os rollups do trecho
+// arquivado, com a largura a que from e to devem se alinhar.
+func unalignedRange(c *gin.Context, err *repositories.UnalignedRangeError) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"message":   "from e to devem estar alinhados aos rollups no trecho arquivado",
+		"alignment": err.Width.String(),
+	})
 }
 
 func (h *PaymentHandlers) HandlePaymentSummary(c *gin.Context) {
-	fromQS := c.Query("from")
-	toQS := c.Query("to")
+	from, to, ok := parseRangeQuery(c)
+	if !ok {
+		return
+	}
 
-	var from time.Time
-	if fromQS != "" {
-		var err error
-		from, err = time.Parse("2006-01-02T15:04:05.000Z", fromQS)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "Formato inválido para o parâmetro 'from'",
-				"error":   err.Error(),
-			})
+	tenant := tenantOf(c)
+	withTiming := c.Query("timing") == "true"
+	slog.Info("Summary", "from", from, "to", to, "tenant", tenant)
+
+	response := dtos.SummaryResponse{
+		Currencies: make(map[string]dtos.CurrencySummary),
+		Timing:     &dtos.ProcessorTimings{},
+	}
+	for _, api := range []dtos.PaymentAPI{dtos.DEFAULT_API, dtos.FALLBACK_API} {
+		byCurrency, timing, err := h.redisRepo.GetProcessorSummary(c, tenant, api, from, to, withTiming)
+		var unaligned *repositories.UnalignedRangeError
+		if errors.As(err, &unaligned) {
+			unalignedRange(c, unaligned)
 			return
 		}
-	}
-
-	var to time.Time
-	if toQS != "" {
-		var err error
-		to, err = time.Parse("2006-01-02T15:04:05.000Z", toQS)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "Formato inválido para o parâmetro 'to'",
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "Erro ao buscar resumo de pagamentos processados pela API " + api.String(),
 				"error":   err.Error(),
 			})
 			return
 		}
+
+		for currency, summary := range byCurrency {
+			currencySummary := response.Currencies[currency]
+			if api == dtos.DEFAULT_API {
+				currencySummary.Default = *summary
+			} else {
+				currencySummary.Fallback = *summary
+			}
+			response.Currencies[currency] = currencySummary
+		}
+
+		if api == dtos.DEFAULT_API {
+			response.Timing.Default = timing
+		} else {
+			response.Timing.Fallback = timing
+		}
+	}
+	if response.Timing.Default == nil && response.Timing.Fallback == nil {
+		response.Timing = nil
 	}
 
-	slog.Info("Summary", "from", from, "to", to)
+	response.Default = response.Currencies[dtos.DEFAULT_CURRENCY].Default
+	response.Fallback = response.Currencies[dtos.DEFAULT_CURRENCY].Fallback
 
-	defaultSummary, err := h.redisRepo.GetSummaryByDateRange(c, dtos.DEFAULT_API, from, to)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": "Erro ao buscar resumo de pagamentos processados pela API default",
-			"error":   err.Error(),
-		})
+	c.JSON(http.StatusOK, response)
+}
+
+// PurgePayments aceita os filtros opcionais from, to (ou last), processor e
+// queue=true (descarta também os pagamentos ainda não processados).
+func (h *PaymentHandlers) PurgePayments(c *gin.Context) {
+	scope := dtos.PurgeScope{
+		Tenant:     tenantOf(c),
+		DropQueued: c.Query("queue") == "true",
+	}
+
+	var ok bool
+	if scope.From, scope.To, ok = parseRangeQuery(c); !ok {
 		return
 	}
 
-	fallbackSummary, err := h.redisRepo.GetSummaryByDateRange(c, dtos.FALLBACK_API, from, to)
+	if processor := c.Query("processor"); processor != "" {
+		api, ok := dtos.ParsePaymentAPI(processor)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Processador deve ser 'default' ou 'fallback'"})
+			return
+		}
+		scope.Api = &api
+	}
+
+	removed, err := h.redisRepo.Purge(c, &scope)
+	var unaligned *repositories.UnalignedRangeError
+	if errors.As(err, &unaligned) {
+		unalignedRange(c, unaligned)
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": "Erro ao buscar resumo de pagamentos processados pela API default",
-			"error":   err.Error(),
-		})
+		slog.Error("Erro ao limpar pagamentos", "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao limpar pagamentos"})
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{"message": "Pagamentos removidos", "removed": removed})
+}
 
-	response := &dtos.SummaryResponse{
-		Default:  *defaultSummary,
-		Fallback: *fallbackSummary,
+// parseRangeQuery lê o período de from e to, ou de last (por exemplo
+// last=5m, até agora). Limites ausentes ficam zerados, o que deixa o período
+// aberto daquele lado. Escreve a resposta de erro e retorna false se os
+// parâmetros forem inválidos.
+func parseRangeQuery(c *gin.Context) (time.Time, time.Time, bool) {
+	if last := c.Query("last"); last != "" {
+		if c.Query("from") != "" || c.Query("to") != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Use 'last' ou 'from'/'to', não os dois"})
+			return time.Time{}, time.Time{}, false
+		}
+		d, err := time.ParseDuration(last)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Formato inválido para o parâmetro 'last'"})
+			return time.Time{}, time.Time{}, false
+		}
+		now := time.Now().UTC()
+		return now.Add(-d), now, true
 	}
 
-	c.JSON(http.StatusOK, response)
+	from, ok := parseTimeQuery(c, "from")
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	to, ok := parseTimeQuery(c, "to")
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "'from' deve ser anterior a 'to'"})
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
 }
 
-func (h *PaymentHandlers) PurgePayments(c *gin.Context) {
-	err := h.redisRepo.FlushDB(c)
+// parseTimeQuery aceita RFC3339 com ou sem frações e com qualquer fuso (o
+// formato da Rinha é um caso particular). Escreve a resposta de erro e
+// retorna false se o parâmetro estiver em formato inválido. Parâmetro
+// ausente retorna o time.Time zero.
+func parseTimeQuery(c *gin.Context, name string) (time.Time, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, true
+	}
+
+	// Um "+01:00" sem escape chega como espaço na query string
+	t, err := time.Parse(time.RFC3339Nano, strings.ReplaceAll(value, " ", "+"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao limpar pagamentos"})
-		return
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Formato inválido para o parâmetro '" + name + "'",
+			"error":   err.Error(),
+		})
+		return time.Time{}, false
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Todos os pagamentos foram deletados"})
+	return t.UTC(), true
 }
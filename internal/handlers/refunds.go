@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+)
+
+// HandleRefund enfileira um reembolso total (corpo vazio ou sem amount) ou
+// parcial do pagamento. Responde 202: o reembolso é concluído pelos workers.
+func (h *PaymentHandlers) HandleRefund(c *gin.Context) {
+	var refundRequest dtos.RefundRequest
+	err := c.ShouldBindJSON(&refundRequest)
+	if err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Corpo inválido", "error": err.Error()})
+		return
+	}
+	amount := refundRequest.Amount
+	if amount < 0 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "amount deve ser positivo"})
+		return
+	}
+
+	correlationId := c.Param("correlationId")
+	response, err := h.redisRepo.RequestRefund(c, tenantOf(c), correlationId, amount)
+	switch {
+	case errors.Is(err, repositories.ErrPaymentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": "Pagamento não encontrado"})
+	case errors.Is(err, repositories.ErrRefundDisabled):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Processador do pagamento não aceita reembolsos"})
+	case errors.Is(err, repositories.ErrInvalidAmount):
+		c.JSON(http.StatusBadRequest, gin.H{"message": "amount inválido para a moeda do pagamento"})
+	case errors.Is(err, repositories.ErrRefundExceeds):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "Valor excede o saldo reembolsável", "remaining": response.Remaining, "currency": response.Currency})
+	case err != nil:
+		slog.Error("Erro ao solicitar reembolso", "correlationId", correlationId, "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao solicitar reembolso"})
+	default:
+		c.JSON(http.StatusAccepted, response)
+	}
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+)
+
+const (
+	TenantHeader          = "X-Tenant-Id"
+	tenantContextKey      = "tenant"
+	tenantBoundContextKey = "tenantBound"
+)
+
+// ResolveTenant lê o tenant do header X-Tenant-Id. Sem o header a requisição
+// usa o tenant padrão. Só passam tenants registrados pela API administrativa
+// ou o tenant da chave de API usada, que é registrado no primeiro uso.
+func (h *PaymentHandlers) ResolveTenant() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant := c.GetHeader(TenantHeader)
+		if !repositories.ValidTenant(tenant) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Tenant inválido"})
+			return
+		}
+
+		var err error
+		if c.GetBool(tenantBoundContextKey) {
+			err = h.redisRepo.RegisterTenant(c, tenant)
+		} else {
+			err = h.redisRepo.CheckTenant(c, tenant)
+		}
+		if errors.Is(err, repositories.ErrUnknownTenant) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "Tenant não registrado"})
+			return
+		}
+		if err != nil {
+			slog.Error("Erro ao verificar tenant", "tenant", tenant, "err", err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"message": "Erro ao verificar tenant"})
+			return
+		}
+
+		c.Set(tenantContextKey, tenant)
+		c.Next()
+	}
+}
+
+func tenantOf(c *gin.Context) string {
+	return c.GetString(tenantContextKey)
+}
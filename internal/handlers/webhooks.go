@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lckrugel/rinha-backend-25/internal/workers"
+)
+
+// validCallbackUrl aceita vazio (sem webhook) ou uma URL http(s) absoluta
+// para um destino permitido, ver workers.CheckCallbackUrl.
+func validCallbackUrl(ctx context.Context, callbackUrl string) bool {
+	err := workers.CheckCallbackUrl(ctx, callbackUrl)
+	if err != nil {
+		slog.Debug("callbackUrl recusado", "url", callbackUrl, "err", err)
+		return false
+	}
+	return true
+}
+
+// GetWebhookLog lista as últimas tentativas de entrega, da mais recente para
+// a mais antiga. O parâmetro count limita a quantidade (padrão 100).
+func (h *AdminHandlers) GetWebhookLog(c *gin.Context) {
+	count := int64(100)
+	if value := c.Query("count"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 || n > 10000 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Formato inválido para o parâmetro 'count'"})
+			return
+		}
+		count = n
+	}
+
+	entries, err := h.redisRepo.GetWebhookLog(c, count)
+	if err != nil {
+		slog.Error("Erro ao buscar log de webhooks", "err", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Erro ao buscar log de webhooks", "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
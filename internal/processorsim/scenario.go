@@ -0,0 +1,109 @@
+package processorsim
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"time"
+)
+
+// Duration aceita "10s", "500ms" etc. no JSON do cenário.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Latency descreve a distribuição do tempo de resposta de POST /payments.
+// Dist pode ser "fixed" (Ms), "uniform" (Ms a MaxMs), "normal" (média Ms,
+// desvio StdDevMs) ou "exponential" (média Ms).
+type Latency struct {
+	Dist     string  `json:"dist"`
+	Ms       float64 `json:"ms"`
+	MaxMs    float64 `json:"maxMs,omitempty"`
+	StdDevMs float64 `json:"stdDevMs,omitempty"`
+}
+
+func (l Latency) sample(rng *rand.Rand) time.Duration {
+	var ms float64
+	switch l.Dist {
+	case "uniform":
+		ms = l.Ms + rng.Float64()*(l.MaxMs-l.Ms)
+	case "normal":
+		ms = l.Ms + rng.NormFloat64()*l.StdDevMs
+	case "exponential":
+		ms = rng.ExpFloat64() * l.Ms
+	default:
+		ms = l.Ms
+	}
+	return time.Duration(math.Max(ms, 0) * float64(time.Millisecond))
+}
+
+// Phase é uma janela do cenário. Failing faz o processador responder 500 em
+// todos os pagamentos e se declarar com falha no service-health; FailRate
+// falha só uma fração deles.
+type Phase struct {
+	Name     string   `json:"name"`
+	Duration Duration `json:"duration"`
+	Failing  bool     `json:"failing"`
+	FailRate float64  `json:"failRate"`
+	Latency  Latency  `json:"latency"`
+}
+
+// Scenario é uma sequência de fases. Depois da última fase o processador
+// continua nela, ou volta para a primeira se Loop for true.
+type Scenario struct {
+	Loop   bool    `json:"loop"`
+	Phases []Phase `json:"phases"`
+}
+
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao ler cenário: %w", err)
+	}
+
+	var scenario Scenario
+	err = json.Unmarshal(data, &scenario)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao decodificar cenário: %w", err)
+	}
+	if len(scenario.Phases) == 0 {
+		return nil, fmt.Errorf("Cenário sem fases")
+	}
+	return &scenario, nil
+}
+
+func (s *Scenario) phaseAt(elapsed time.Duration) Phase {
+	var total time.Duration
+	for _, phase := range s.Phases {
+		total += time.Duration(phase.Duration)
+	}
+
+	if s.Loop && total > 0 {
+		elapsed %= total
+	}
+
+	for _, phase := range s.Phases {
+		if elapsed < time.Duration(phase.Duration) {
+			return phase
+		}
+		elapsed -= time.Duration(phase.Duration)
+	}
+	return s.Phases[len(s.Phases)-1]
+}
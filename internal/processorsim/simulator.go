@@ -0,0 +1,326 @@
+package processorsim
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+)
+
+const timeLayout = "2006-01-02T15:04:05.000Z"
+
+type Config struct {
+	Fee            float64       // taxa por transação
+	Token          string        // X-Rinha-Token dos endpoints /admin
+	HealthInterval time.Duration // intervalo mínimo entre chamadas ao service-health
+	Currencies     []string      // moedas aceitas e declaradas no service-health; vazio aceita todas
+	Scenario       *Scenario
+}
+
+// Simulator implementa a API dos payment-processors da Rinha em memória.
+type Simulator struct {
+	cfg   Config
+	start time.Time
+
+	mu         sync.Mutex
+	rng        *rand.Rand
+	payments   map[string]dtos.ProcessorPaymentResponse
+	refunds    map[string]simRefund // por refundId
+	lastHealth time.Time
+	override   *Phase // definido por PUT /admin/configurations/*
+}
+
+func New(cfg Config) *Simulator {
+	if cfg.Scenario == nil {
+		cfg.Scenario = &Scenario{Phases: []Phase{{Name: "default"}}}
+	}
+	return &Simulator{
+		cfg:      cfg,
+		start:    time.Now(),
+		rng:      rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+		payments: make(map[string]dtos.ProcessorPaymentResponse),
+		refunds:  make(map[string]simRefund),
+	}
+}
+
+type simRefund struct {
+	correlationId string
+	amount        float64
+}
+
+func (s *Simulator) Handler() http.Handler {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(gin.Recovery())
+
+	r.POST("payments", s.handlePayment)
+	r.GET("payments/service-health", s.handleHealth)
+	r.GET("payments/:id", s.handleGetPayment)
+	r.POST("payments/:id/refund", s.handleRefund)
+
+	admin := r.Group("admin", s.requireToken)
+	admin.GET("payments-summary", s.handleSummary)
+	admin.POST("purge-payments", s.handlePurge)
+	admin.PUT("configurations/failure", s.handleSetFailure)
+	admin.PUT("configurations/delay", s.handleSetDelay)
+
+	return r
+}
+
+// SetPhase substitui o cenário por uma fase fixa. nil volta ao cenário.
+func (s *Simulator) SetPhase(phase *Phase) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.override = phase
+}
+
+func (s *Simulator) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payments = make(map[string]dtos.ProcessorPaymentResponse)
+	s.refunds = make(map[string]simRefund)
+}
+
+func (s *Simulator) currentPhase() Phase {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.override != nil {
+		return *s.override
+	}
+	return s.cfg.Scenario.phaseAt(time.Since(s.start))
+}
+
+func (s *Simulator) handlePayment(c *gin.Context) {
+	var payment dtos.ProcessorPaymentResponse
+	if err := c.ShouldBindJSON(&payment); err != nil || payment.CorrelationId == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "invalid payment"})
+		return
+	}
+	if _, err := time.Parse(timeLayout, payment.RequestedAt); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "invalid requestedAt"})
+		return
+	}
+	if len(s.cfg.Currencies) > 0 && !slices.Contains(s.cfg.Currencies, payment.Currency) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "currency not accepted"})
+		return
+	}
+
+	phase := s.currentPhase()
+
+	s.mu.Lock()
+	delay := phase.Latency.sample(s.rng)
+	fail := phase.Failing || s.rng.Float64() < phase.FailRate
+	s.mu.Unlock()
+
+	select {
+	case <-time.After(delay):
+	case <-c.Request.Context().Done():
+		return
+	}
+
+	if fail {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "payment processing failed"})
+		return
+	}
+
+	s.mu.Lock()
+	_, exists := s.payments[payment.CorrelationId]
+	if !exists {
+		s.payments[payment.CorrelationId] = payment
+	}
+	s.mu.Unlock()
+
+	if exists {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "CorrelationId already exists"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "payment processed successfully"})
+}
+
+func (s *Simulator) handleHealth(c *gin.Context) {
+	phase := s.currentPhase()
+
+	s.mu.Lock()
+	now := time.Now()
+	limited := s.cfg.HealthInterval > 0 && now.Sub(s.lastHealth) < s.cfg.HealthInterval
+	if !limited {
+		s.lastHealth = now
+	}
+	s.mu.Unlock()
+
+	if limited {
+		c.Status(http.StatusTooManyRequests)
+		return
+	}
+
+	c.JSON(http.StatusOK, dtos.HealthCheckResponse{
+		Failing:         phase.Failing,
+		MinResponseTime: int(time.Duration(phase.Latency.Ms * float64(time.Millisecond)).Milliseconds()),
+		Currencies:      s.cfg.Currencies,
+	})
+}
+
+func (s *Simulator) handleGetPayment(c *gin.Context) {
+	s.mu.Lock()
+	payment, ok := s.payments[c.Param("id")]
+	s.mu.Unlock()
+
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, payment)
+}
+
+// handleRefund responde 409 para um refundId repetido e 422 quando a soma
+// dos reembolsos passaria do valor do pagamento.
+func (s *Simulator) handleRefund(c *gin.Context) {
+	var refund dtos.ProcessorRefundRequest
+	if err := c.ShouldBindJSON(&refund); err != nil || refund.RefundId == "" || refund.Amount <= 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "invalid refund"})
+		return
+	}
+
+	phase := s.currentPhase()
+	s.mu.Lock()
+	delay := phase.Latency.sample(s.rng)
+	fail := phase.Failing || s.rng.Float64() < phase.FailRate
+	s.mu.Unlock()
+
+	select {
+	case <-time.After(delay):
+	case <-c.Request.Context().Done():
+		return
+	}
+	if fail {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "refund processing failed"})
+		return
+	}
+
+	correlationId := c.Param("id")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payment, ok := s.payments[correlationId]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "payment not found"})
+		return
+	}
+	if _, exists := s.refunds[refund.RefundId]; exists {
+		c.JSON(http.StatusConflict, gin.H{"message": "RefundId already exists"})
+		return
+	}
+	refunded := 0.0
+	for _, r := range s.refunds {
+		if r.correlationId == correlationId {
+			refunded += r.amount
+		}
+	}
+	if math.Round((refunded+refund.Amount)*100) > math.Round(payment.Amount*100) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "refund exceeds payment amount"})
+		return
+	}
+
+	s.refunds[refund.RefundId] = simRefund{correlationId: correlationId, amount: refund.Amount}
+	c.JSON(http.StatusOK, gin.H{"message": "refund processed successfully"})
+}
+
+func (s *Simulator) requireToken(c *gin.Context) {
+	if c.GetHeader("X-Rinha-Token") != s.cfg.Token {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Next()
+}
+
+func (s *Simulator) handleSummary(c *gin.Context) {
+	from, err := parseBound(c.Query("from"), time.Time{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid from"})
+		return
+	}
+	to, err := parseBound(c.Query("to"), time.Unix(math.MaxInt32, 0))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid to"})
+		return
+	}
+
+	var summary dtos.ProcessorSummaryResponse
+	s.mu.Lock()
+	for _, payment := range s.payments {
+		requestedAt, _ := time.Parse(timeLayout, payment.RequestedAt)
+		if requestedAt.Before(from) || requestedAt.After(to) {
+			continue
+		}
+		summary.TotalRequests++
+		summary.TotalAmount += payment.Amount
+	}
+	// Reembolsos entram pela data do pagamento original
+	for _, refund := range s.refunds {
+		requestedAt, _ := time.Parse(timeLayout, s.payments[refund.correlationId].RequestedAt)
+		if requestedAt.Before(from) || requestedAt.After(to) {
+			continue
+		}
+		summary.TotalRefunded += refund.amount
+	}
+	s.mu.Unlock()
+
+	summary.TotalRefunded = math.Round(summary.TotalRefunded*100) / 100
+
+	summary.TotalAmount = math.Round(summary.TotalAmount*100) / 100
+	summary.FeePerTransaction = s.cfg.Fee
+	summary.TotalFee = math.Round(summary.TotalAmount*s.cfg.Fee*100) / 100
+
+	c.JSON(http.StatusOK, summary)
+}
+
+func (s *Simulator) handlePurge(c *gin.Context) {
+	s.Reset()
+	c.JSON(http.StatusOK, gin.H{"message": "All payments purged."})
+}
+
+func (s *Simulator) handleSetFailure(c *gin.Context) {
+	var body struct {
+		Failure bool `json:"failure"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	phase := s.currentPhase()
+	phase.Failing = body.Failure
+	s.SetPhase(&phase)
+	c.Status(http.StatusOK)
+}
+
+func (s *Simulator) handleSetDelay(c *gin.Context) {
+	var body struct {
+		Delay float64 `json:"delay"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	phase := s.currentPhase()
+	phase.Latency = Latency{Dist: "fixed", Ms: body.Delay}
+	s.SetPhase(&phase)
+	c.Status(http.StatusOK)
+}
+
+func parseBound(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	t, err := time.Parse(timeLayout, value)
+	if err != nil {
+		return time.Parse(time.RFC3339Nano, value)
+	}
+	return t, nil
+}
@@ -0,0 +1,96 @@
+package repositories
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+// HashAPIKey é usado como campo do hash de chaves, assim o Redis nunca guarda
+// a chave em texto puro.
+func HashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetAPIKey retorna nil, nil se a chave não existir.
+func (r *RedisRepository) GetAPIKey(ctx context.Context, apiKey string) (*dtos.APIKey, error) {
+	data, err := r.client.HGet(ctx, r.keys.global("apikeys"), HashAPIKey(apiKey)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Erro ao buscar chave de API: %w", err)
+	}
+
+	var key dtos.APIKey
+	err = json.Unmarshal(data, &key)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao desserializar chave de API: %w", err)
+	}
+	return &key, nil
+}
+
+func (r *RedisRepository) StoreAPIKey(ctx context.Context, apiKey string, key *dtos.APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("Erro ao serializar chave de API: %w", err)
+	}
+	err = r.client.HSet(ctx, r.keys.global("apikeys"), HashAPIKey(apiKey), data).Err()
+	if err != nil {
+		return fmt.Errorf("Erro ao armazenar chave de API: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisRepository) DeleteAPIKey(ctx context.Context, apiKey string) (bool, error) {
+	removed, err := r.client.HDel(ctx, r.keys.global("apikeys"), HashAPIKey(apiKey)).Result()
+	if err != nil {
+		return false, fmt.Errorf("Erro ao remover chave de API: %w", err)
+	}
+	return removed > 0, nil
+}
+
+// Token bucket: o balde guarda tokens e o instante da última recarga. Retorna
+// {permitido, ms até haver um token}.
+var tokenBucketScript = newLuaScript("token-bucket", 1, `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, wait}
+`)
+
+// AllowRequest consome um token do balde do cliente, compartilhado entre as
+// instâncias. Quando negado, retorna quanto tempo falta para o próximo token.
+func (r *RedisRepository) AllowRequest(ctx context.Context, clientId string, rate float64, burst int) (bool, time.Duration, error) {
+	result, err := tokenBucketScript.Run(ctx, r.client, []string{r.keys.global("ratelimit:" + clientId)},
+		rate, burst, time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("Erro ao aplicar rate limit: %w", err)
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
@@ -0,0 +1,86 @@
+package repositories
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+)
+
+// FileArchiver grava os pagamentos em NDJSON comprimido com gzip, um arquivo
+// por dia do sumário em <dir>/[tenants/<tenant>/]<processador>/<dia>.ndjson.gz.
+// Cada Store acrescenta um novo membro gzip ao arquivo do dia, o que gunzip e
+// o compress/gzip leem como um arquivo só.
+type FileArchiver struct {
+	dir string
+}
+
+func NewFileArchiver(dir string) *FileArchiver {
+	return &FileArchiver{dir: dir}
+}
+
+func (a *FileArchiver) Store(ctx context.Context, tenant string, api dtos.PaymentAPI, payments []dtos.ProcessedPayment) error {
+	byDay := make(map[string][]dtos.ProcessedPayment)
+	var days []string
+	for _, payment := range payments {
+		at, err := payment.SummaryTime()
+		if err != nil {
+			return fmt.Errorf("Erro ao converter data do pagamento %s: %w", payment.CorrelationId, err)
+		}
+		day := at.UTC().Format("2006-01-02")
+		if _, ok := byDay[day]; !ok {
+			days = append(days, day)
+		}
+		byDay[day] = append(byDay[day], payment)
+	}
+
+	for _, day := range days {
+		if err := a.appendDay(a.path(tenant, api, day), byDay[day]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *FileArchiver) path(tenant string, api dtos.PaymentAPI, day string) string {
+	dir := a.dir
+	if tenant != DefaultTenant {
+		dir = filepath.Join(dir, "tenants", tenant)
+	}
+	return filepath.Join(dir, api.String(), day+".ndjson.gz")
+}
+
+func (a *FileArchiver) appendDay(path string, payments []dtos.ProcessedPayment) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("Erro ao criar diretório do arquivo: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("Erro ao abrir arquivo %s: %w", path, err)
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	encoder := json.NewEncoder(gz)
+	for i := range payments {
+		if err := encoder.Encode(&payments[i]); err != nil {
+			return fmt.Errorf("Erro ao escrever arquivo %s: %w", path, err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("Erro ao escrever arquivo %s: %w", path, err)
+	}
+	// Os pagamentos só saem do Redis depois do fsync
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("Erro ao sincronizar arquivo %s: %w", path, err)
+	}
+	return file.Close()
+}
+
+func (a *FileArchiver) Close() error {
+	return nil
+}
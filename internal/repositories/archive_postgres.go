@@ -0,0 +1,78 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+)
+
+const createArchiveTable = `
+CREATE TABLE IF NOT EXISTS archived_payments (
+	tenant         text           NOT NULL,
+	correlation_id text           NOT NULL,
+	processor      text           NOT NULL,
+	amount         numeric(20, 4) NOT NULL,
+	currency       text           NOT NULL,
+	requested_at   timestamptz    NOT NULL,
+	payload        jsonb          NOT NULL,
+	PRIMARY KEY (tenant, correlation_id)
+);
+CREATE INDEX IF NOT EXISTS archived_payments_requested_at
+	ON archived_payments (tenant, processor, requested_at);
+`
+
+// PostgresArchiver grava os pagamentos na tabela archived_payments. Um
+// pagamento arquivado de novo após uma queda é ignorado pela chave primária.
+type PostgresArchiver struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresArchiver(ctx context.Context, url string) (*PostgresArchiver, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao conectar ao Postgres: %w", err)
+	}
+	if _, err := pool.Exec(ctx, createArchiveTable); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("Erro ao criar tabela de arquivo: %w", err)
+	}
+	return &PostgresArchiver{pool: pool}, nil
+}
+
+func (a *PostgresArchiver) Store(ctx context.Context, tenant string, api dtos.PaymentAPI, payments []dtos.ProcessedPayment) error {
+	batch := &pgx.Batch{}
+	for i := range payments {
+		payment := &payments[i]
+		at, err := payment.SummaryTime()
+		if err != nil {
+			return fmt.Errorf("Erro ao converter data do pagamento %s: %w", payment.CorrelationId, err)
+		}
+		payload, err := json.Marshal(payment)
+		if err != nil {
+			return fmt.Errorf("Erro ao serializar pagamento: %w", err)
+		}
+
+		currency := paymentCurrency(payment)
+		batch.Queue(`INSERT INTO archived_payments
+			(tenant, correlation_id, processor, amount, currency, requested_at, payload)
+			VALUES ($1, $2, $3, $4::numeric, $5, $6, $7)
+			ON CONFLICT (tenant, correlation_id) DO NOTHING`,
+			tenant, payment.CorrelationId, api.String(), dtos.FormatAmount(currency, payment.Amount),
+			currency, at, payload)
+	}
+
+	// O lote roda numa transação implícita: ou entram todos ou nenhum
+	if err := a.pool.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("Erro ao gravar pagamentos no Postgres: %w", err)
+	}
+	return nil
+}
+
+func (a *PostgresArchiver) Close() error {
+	a.pool.Close()
+	return nil
+}
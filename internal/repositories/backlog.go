@@ -0,0 +1,151 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrBacklogFull = errors.New("fila de pagamentos cheia")
+
+// SetMaxBacklog limita quantos pagamentos podem estar nas streams (na fila ou
+// pendentes com algum worker) somando todos os tenants. Zero desliga o limite.
+func (r *RedisRepository) SetMaxBacklog(max int64) {
+	r.maxBacklog = max
+}
+
+// reserveBacklog conta n pagamentos novos no backlog, ou retorna
+// ErrBacklogFull se eles passariam do limite. A contagem é local e o
+// TrimStreams a corrige com o valor real, então o limite pode ser excedido
+// pelo que as outras instâncias aceitaram desde a última leitura.
+func (r *RedisRepository) reserveBacklog(n int64) error {
+	if r.maxBacklog <= 0 {
+		return nil
+	}
+	if r.backlog.Add(n) > r.maxBacklog {
+		r.backlog.Add(-n)
+		return ErrBacklogFull
+	}
+	return nil
+}
+
+// releaseBacklog devolve reservas de pagamentos que não entraram na stream.
+func (r *RedisRepository) releaseBacklog(n int64) {
+	if r.maxBacklog > 0 && n > 0 {
+		r.backlog.Add(-n)
+	}
+}
+
+// TrimStreams remove as entradas já confirmadas das streams de pagamentos,
+// webhooks e reembolsos e retorna o backlog de pagamentos que sobrou.
+func (r *RedisRepository) TrimStreams(ctx context.Context) (int64, error) {
+	tenants, err := r.Tenants(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var backlog int64
+	for _, tenant := range tenants {
+		length, err := r.trimStream(ctx, r.keys.stream(tenant))
+		if err != nil {
+			return 0, err
+		}
+		backlog += length
+	}
+	for _, stream := range []string{r.keys.webhookStream(), r.keys.refundStream()} {
+		if _, err := r.trimStream(ctx, stream); err != nil {
+			return 0, err
+		}
+	}
+
+	r.backlog.Store(backlog)
+	return backlog, nil
+}
+
+// trimStream apaga, com XTRIM MINID, as entradas anteriores à pendente mais
+// antiga do read group, ou até a última entregue se não houver pendentes. Tudo
+// antes disso já recebeu ack; entradas novas e pendentes nunca são apagadas.
+//
+// Retorna o backlog: as pendentes mais o lag do read group (entradas ainda não
+// entregues). Entradas já confirmadas depois de uma pendente antiga continuam
+// na stream até o trim alcançá-las, então o XLEN sozinho superestimaria.
+func (r *RedisRepository) trimStream(ctx context.Context, stream string) (int64, error) {
+	// O último entregue é lido antes dos pendentes: uma entrada entregue entre
+	// as duas leituras fica acima dele ou aparece como pendente, e em nenhum
+	// dos casos é apagada
+	groups, err := r.client.XInfoGroups(ctx, stream).Result()
+	if err != nil && !isNoGroup(err) {
+		return 0, fmt.Errorf("Erro ao buscar informações do read group: %w", err)
+	}
+	var group *redis.XInfoGroup
+	for i := range groups {
+		if groups[i].Name == r.readGroup {
+			group = &groups[i]
+		}
+	}
+
+	var pending *redis.XPending
+	if group != nil {
+		pending, err = r.client.XPending(ctx, stream, r.readGroup).Result()
+		if err != nil && !isNoGroup(err) {
+			return 0, fmt.Errorf("Erro ao buscar pendentes da stream: %w", err)
+		}
+	}
+
+	var minId string
+	if pending != nil && pending.Count > 0 {
+		minId = pending.Lower
+	} else if group != nil {
+		minId = nextStreamId(group.LastDeliveredID)
+	}
+
+	pipe := r.client.Pipeline()
+	if minId != "" && minId != "0-0" {
+		pipe.XTrimMinID(ctx, stream, minId)
+	}
+	length := pipe.XLen(ctx, stream)
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Erro ao aparar stream: %w", err)
+	}
+
+	if group == nil {
+		return length.Val(), nil
+	}
+	// Sem lag conhecido (-1), tudo que não está pendente conta como não entregue
+	undelivered := max(length.Val()-group.Pending, 0)
+	if group.Lag >= 0 && group.Lag < undelivered {
+		undelivered = group.Lag
+	}
+	return group.Pending + undelivered, nil
+}
+
+// Sem stream ou sem read group não há o que aparar.
+func isNoGroup(err error) bool {
+	if errors.Is(err, redis.Nil) {
+		return true
+	}
+	return err != nil && (strings.Contains(err.Error(), "NOGROUP") || strings.Contains(err.Error(), "no such key"))
+}
+
+// nextStreamId é o menor ID maior que id ("<ms>-<seq>").
+func nextStreamId(id string) string {
+	ms, seq, ok := strings.Cut(id, "-")
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if !ok || err != nil {
+		return id
+	}
+	if n == math.MaxUint64 {
+		t, err := strconv.ParseUint(ms, 10, 64)
+		if err != nil || t == math.MaxUint64 {
+			return id
+		}
+		return strconv.FormatUint(t+1, 10) + "-0"
+	}
+	return ms + "-" + strconv.FormatUint(n+1, 10)
+}
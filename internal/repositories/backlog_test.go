@@ -0,0 +1,97 @@
+package repositories
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestNextStreamId(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"0-0", "0-1"},
+		{"1-0", "1-1"},
+		{"1526919030474-55", "1526919030474-56"},
+		{"5-18446744073709551615", "6-0"},
+		{"18446744073709551615-18446744073709551615", "18446744073709551615-18446744073709551615"},
+		{"x-18446744073709551615", "x-18446744073709551615"},
+		{"1526919030474", "1526919030474"},
+		{"1-x", "1-x"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := nextStreamId(tt.id); got != tt.want {
+			t.Errorf("nextStreamId(%q) = %q, esperava %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+// deliverBetweenReads entrega a próxima entrada da stream ao read group logo
+// depois da primeira leitura do trimStream (XINFO ou XPENDING), simulando um
+// worker que lê entre as duas.
+type deliverBetweenReads struct {
+	client    *redis.Client
+	stream    string
+	delivered bool
+}
+
+func (h *deliverBetweenReads) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *deliverBetweenReads) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (h *deliverBetweenReads) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		name := strings.ToLower(cmd.Name())
+		if !h.delivered && (name == "xinfo" || name == "xpending") {
+			h.delivered = true
+			h.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    "read-group",
+				Consumer: "worker",
+				Streams:  []string{h.stream, ">"},
+				Count:    1,
+			})
+		}
+		return err
+	}
+}
+
+func TestTrimStreamKeepsEntryDeliveredBetweenReads(t *testing.T) {
+	m := miniredis.RunT(t)
+	repo := NewRedisRepository(m.Addr(), "")
+	ctx := context.Background()
+	stream := repo.keys.stream(DefaultTenant)
+
+	worker := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { worker.Close() })
+
+	// A primeira entrada já foi entregue e confirmada: nada pendente
+	first := worker.XAdd(ctx, &redis.XAddArgs{Stream: stream, Values: []any{"p", "1"}}).Val()
+	worker.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "read-group", Consumer: "worker", Streams: []string{stream, ">"}})
+	worker.XAck(ctx, stream, "read-group", first)
+	second := worker.XAdd(ctx, &redis.XAddArgs{Stream: stream, Values: []any{"p", "2"}}).Val()
+
+	repo.client.AddHook(&deliverBetweenReads{client: worker, stream: stream})
+	backlog, err := repo.trimStream(ctx, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := worker.XRange(ctx, stream, "-", "+").Result()
+	if len(entries) != 1 || entries[0].ID != second {
+		t.Fatalf("a entrada entregue entre as leituras foi apagada: %+v", entries)
+	}
+	if backlog != 1 {
+		t.Errorf("esperava backlog 1, obteve %d", backlog)
+	}
+	if pending, _ := worker.XPending(ctx, stream, "read-group").Result(); pending.Count != 1 || pending.Lower != second {
+		t.Errorf("esperava %s pendente, obteve %+v", second, pending)
+	}
+}
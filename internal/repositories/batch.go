@@ -0,0 +1,67 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+// AddBatchToStream enfileira os pagamentos de um lote do mesmo tenant e
+// retorna, para cada um, se foi aceito (false indica duplicata). Cada item
+// passa pelo script de entrada num único pipeline; os que voltarem NOSCRIPT
+// são repetidos um a um com o fallback para EVAL. Se o lote falhar no meio,
+// os itens já aceitos ficam na stream e voltam como duplicatas no reenvio.
+func (r *RedisRepository) AddBatchToStream(ctx context.Context, tenant string, payments []*dtos.PaymentRequest) ([]bool, error) {
+	err := r.ensureTenant(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	// O lote entra inteiro ou é recusado, mesmo que parte seja duplicata
+	if err := r.reserveBacklog(int64(len(payments))); err != nil {
+		return nil, err
+	}
+
+	calls := make([]*intakeCall, len(payments))
+	requestedAt := time.Now().UTC()
+	for i, payment := range payments {
+		payment.Tenant = tenant
+		payment.RequestedAt = requestedAt
+		calls[i], err = r.intakeCall(payment)
+		if err != nil {
+			r.releaseBacklog(int64(len(payments)))
+			return nil, err
+		}
+	}
+
+	cmds := make([]*redis.Cmd, len(calls))
+	// Os erros ficam em cada comando e são conferidos abaixo
+	r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, call := range calls {
+			cmds[i] = intakeScript.EvalSha(ctx, pipe, call.keys, call.args...)
+		}
+		return nil
+	})
+
+	accepted := make([]bool, len(payments))
+	var added []*intakeCall
+	for i, call := range calls {
+		n, err := cmds[i].Int64()
+		if isNoScript(err) {
+			n, err = intakeScript.Run(ctx, r.client, call.keys, call.args...).Int64()
+		}
+		if err != nil {
+			r.releaseBacklog(int64(len(payments) - len(added)))
+			return nil, fmt.Errorf("Falha ao adicionar lote à stream: %w", err)
+		}
+		if n == 1 {
+			accepted[i] = true
+			added = append(added, call)
+		}
+	}
+	r.releaseBacklog(int64(len(payments) - len(added)))
+	r.publishQueued(ctx, added)
+	return accepted, nil
+}
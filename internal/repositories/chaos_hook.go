@@ -0,0 +1,43 @@
+package repositories
+
+import (
+	"context"
+	"net"
+
+	"github.com/lckrugel/rinha-backend-25/internal/chaos"
+	"github.com/redis/go-redis/v9"
+)
+
+// chaosHook injeta falhas nos comandos do Redis. Só é registrado quando o
+// chaos está habilitado.
+type chaosHook struct{}
+
+func (chaosHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (chaosHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := chaos.Inject(ctx, chaos.POINT_REDIS+cmd.Name()); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (chaosHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			if err := chaos.Inject(ctx, chaos.POINT_REDIS+cmd.Name()); err != nil {
+				for _, c := range cmds {
+					c.SetErr(err)
+				}
+				return err
+			}
+		}
+		return next(ctx, cmds)
+	}
+}
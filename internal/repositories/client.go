@@ -0,0 +1,107 @@
+package repositories
+
+import (
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisMode escolhe como o repositório se conecta ao Redis (REDIS_MODE).
+type RedisMode uint8
+
+const (
+	RedisStandalone RedisMode = iota
+	// Sentinel: os endereços são dos sentinels, que apontam o master atual
+	// de MasterName e avisam o cliente a cada failover.
+	RedisSentinel
+	// Cluster: os endereços são nós quaisquer do cluster. As chaves ganham
+	// hash tags (ver keyspace) e o que cruza slots deixa de ser atômico.
+	RedisCluster
+)
+
+func ParseRedisMode(name string) (RedisMode, bool) {
+	switch name {
+	case "", "standalone":
+		return RedisStandalone, true
+	case "sentinel":
+		return RedisSentinel, true
+	case "cluster":
+		return RedisCluster, true
+	default:
+		return 0, false
+	}
+}
+
+func (m RedisMode) String() string {
+	switch m {
+	case RedisSentinel:
+		return "sentinel"
+	case RedisCluster:
+		return "cluster"
+	default:
+		return "standalone"
+	}
+}
+
+type RedisConfig struct {
+	Mode     RedisMode
+	Addrs    []string
+	Password string
+
+	MasterName       string // só Sentinel
+	SentinelPassword string // só Sentinel
+}
+
+const (
+	redisPoolSize     = 15
+	redisMaxRetries   = 3
+	redisDialTimeout  = 5 * time.Second
+	redisReadTimeout  = 3 * time.Second
+	redisWriteTimeout = 3 * time.Second
+)
+
+// newRedisClient monta o cliente do modo configurado. Os três reconectam
+// sozinhos: o de Sentinel troca de master quando o sentinel anuncia o
+// failover, o de cluster recarrega os slots ao receber MOVED, e todos repetem
+// comandos que falham com READONLY, LOADING ou CLUSTERDOWN.
+func newRedisClient(cfg RedisConfig) redis.UniversalClient {
+	switch cfg.Mode {
+	case RedisSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.MasterName,
+			SentinelAddrs:    cfg.Addrs,
+			SentinelPassword: cfg.SentinelPassword,
+			Password:         cfg.Password,
+			DB:               0,
+			PoolSize:         redisPoolSize,
+			MinIdleConns:     1,
+			MaxRetries:       redisMaxRetries,
+			DialTimeout:      redisDialTimeout,
+			ReadTimeout:      redisReadTimeout,
+			WriteTimeout:     redisWriteTimeout,
+		})
+	case RedisCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        cfg.Addrs,
+			Password:     cfg.Password,
+			PoolSize:     redisPoolSize,
+			MinIdleConns: 1,
+			MaxRetries:   redisMaxRetries,
+			DialTimeout:  redisDialTimeout,
+			ReadTimeout:  redisReadTimeout,
+			WriteTimeout: redisWriteTimeout,
+		})
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:         cfg.Addrs[0],
+			Password:     cfg.Password,
+			DB:           0,
+			PoolSize:     redisPoolSize,
+			MinIdleConns: 1,
+			MaxRetries:   redisMaxRetries,
+			DialTimeout:  redisDialTimeout,
+			ReadTimeout:  redisReadTimeout,
+			WriteTimeout: redisWriteTimeout,
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// No cluster, cada tenant fica no seu slot e as chaves compartilhadas (feed
+// de eventos, webhooks, reembolsos, intenções) em outros. Scripts e
+// transações não cruzam slots, então o que junta os dois lados é dividido
+// em passos, ordenados para que uma queda no meio repita trabalho em vez de
+// perdê-lo.
+
+// clusterPollInterval é a espera de uma leitura sem mensagens no cluster,
+// onde as streams dos tenants não podem ser lidas num único XREADGROUP
+// bloqueante.
+const clusterPollInterval = 100 * time.Millisecond
+
+// execThen executa os comandos de build e depois os de then, que só valem se
+// os primeiros valeram (ack, fim da intenção). Fora do cluster vai tudo numa
+// transação; no cluster then só é enviado depois que build teve sucesso.
+func (r *RedisRepository) execThen(ctx context.Context, build func(redis.Pipeliner) error, then func(redis.Pipeliner)) error {
+	if !r.keys.cluster {
+		pipe := r.client.TxPipeline()
+		if err := build(pipe); err != nil {
+			return err
+		}
+		then(pipe)
+		_, err := pipe.Exec(ctx)
+		return err
+	}
+
+	pipe := r.client.Pipeline()
+	if err := build(pipe); err != nil {
+		return err
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	then(pipe)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// sharedEffects publica, fora do script do tenant, o evento e o webhook de um
+// pagamento concluído ou recusado. Roda depois do script e só quando ele
+// mudou o status: uma nova entrega de um pagamento já concluído não publica
+// de novo. É a exceção à ordem acima: se a instância cair entre o script e a
+// publicação, o evento e o webhook se perdem, já que o XADD gera um id novo
+// a cada vez e uma repetição não seria reconhecida como tal.
+func (r *RedisRepository) sharedEffects(ctx context.Context, tenant string, event, delivery []byte) error {
+	pipe := r.client.Pipeline()
+	r.addEvent(ctx, pipe, tenant, event)
+	if len(delivery) > 0 {
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: r.keys.webhookStream(), Values: map[string]any{"delivery": delivery}})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("Erro ao publicar evento do pagamento: %w", err)
+	}
+	return nil
+}
+
+// finishShared conclui no cluster um StoreProcessed ou DeadLetter depois do
+// script do tenant: publica o evento e o webhook se o script mudou o status e
+// encerra a intenção.
+func (r *RedisRepository) finishShared(ctx context.Context, tenant, correlationId string, fresh bool, event, delivery []byte) error {
+	if fresh {
+		if err := r.sharedEffects(ctx, tenant, event, delivery); err != nil {
+			return err
+		}
+	}
+	return r.ClearIntent(ctx, tenant, correlationId)
+}
+
+// xReadGroupEach lê cada stream com um XREADGROUP próprio e sem bloqueio,
+// todos num pipeline, e espera clusterPollInterval quando nenhuma tem
+// mensagens.
+func (r *RedisRepository) xReadGroupEach(ctx context.Context, consumerId string, streams []string) ([]redis.XStream, error) {
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.XStreamSliceCmd, len(streams))
+	for i, stream := range streams {
+		cmds[i] = pipe.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Streams:  []string{stream, ">"},
+			Group:    r.readGroup,
+			Consumer: consumerId,
+			Count:    1,
+			Block:    -1,
+		})
+	}
+	// Os erros ficam em cada comando e são conferidos abaixo
+	pipe.Exec(ctx)
+
+	var data []redis.XStream
+	var missing []string
+	for i, cmd := range cmds {
+		result, err := cmd.Result()
+		switch {
+		case err == redis.Nil:
+		case isNoGroup(err):
+			missing = append(missing, streams[i])
+		case err != nil:
+			return nil, err
+		default:
+			data = append(data, result...)
+		}
+	}
+	if len(missing) > 0 {
+		if err := r.recreateGroups(ctx, missing); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(data) == 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(min(r.ReadBlock, clusterPollInterval)):
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,283 @@
+package repositories
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+)
+
+// Encoding é o formato em que os pagamentos processados e as entradas da
+// stream são gravados. O leitor aceita todos os formatos, então trocar o
+// escritor não exige parar o sistema; os registros antigos são convertidos
+// por MigrateEncoding (cmd/migrate-encoding).
+type Encoding uint8
+
+const (
+	EncodingJSON Encoding = iota
+	// Layout binário versionado: o primeiro byte é a versão, o que nunca se
+	// confunde com o '{' do JSON.
+	EncodingBinary
+)
+
+const binaryV1 = 0x01
+
+func ParseEncoding(name string) (Encoding, bool) {
+	switch name {
+	case "json":
+		return EncodingJSON, true
+	case "binary":
+		return EncodingBinary, true
+	default:
+		return 0, false
+	}
+}
+
+func (e Encoding) String() string {
+	if e == EncodingBinary {
+		return "binary"
+	}
+	return "json"
+}
+
+// SetEncoding define o formato dos registros novos; o padrão é EncodingJSON.
+// Só passe para EncodingBinary depois que todas as instâncias lerem os dois
+// formatos.
+func (r *RedisRepository) SetEncoding(encoding Encoding) {
+	r.encoding = encoding
+}
+
+var errUnknownEncoding = errors.New("formato de registro desconhecido")
+
+const timeLayout = "2006-01-02T15:04:05.000Z"
+
+// encodeProcessed serializa o membro do sorted set de processados.
+//
+// Binário v1: versão, processador, flags dos horários (bits 0, 1 e 2 para
+// requestedAt, dispatchedAt e processedAt), o primeiro horário
+// presente em ms (uvarint) e os demais como diferença para ele (varint),
+// valor em unidades mínimas (varint), moeda, tentativas, latência em µs e os
+// textos correlationId, tenant e clientId (uvarint do tamanho + bytes).
+//
+// Um pagamento que não cabe no layout sem perda (horário fora do formato ou
+// valor com mais casas que a moeda) é gravado em JSON.
+func encodeProcessed(encoding Encoding, payment *dtos.ProcessedPayment) ([]byte, error) {
+	if encoding == EncodingBinary {
+		if data, ok := encodeProcessedBinary(payment); ok {
+			return data, nil
+		}
+	}
+	data, err := json.Marshal(payment)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao serializar pagamento: %w", err)
+	}
+	return data, nil
+}
+
+func encodeProcessedBinary(payment *dtos.ProcessedPayment) ([]byte, bool) {
+	currency := paymentCurrency(payment)
+	minor := dtos.ToMinor(currency, payment.Amount)
+	if dtos.FromMinor(currency, minor) != payment.Amount {
+		return nil, false
+	}
+
+	var flags byte
+	var times []int64
+	for i, at := range []string{payment.RequestedAt, payment.DispatchedAt, payment.ProcessedAt} {
+		if at == "" {
+			continue
+		}
+		parsed, err := time.Parse(timeLayout, at)
+		if err != nil || parsed.Format(timeLayout) != at {
+			return nil, false
+		}
+		flags |= 1 << i
+		times = append(times, parsed.UnixMilli())
+	}
+	latencyUs := math.Round(payment.LatencyMs * 1000)
+	if len(times) == 0 || times[0] < 0 || payment.Attempts < 0 || payment.LatencyMs < 0 || latencyUs/1000 != payment.LatencyMs {
+		return nil, false
+	}
+
+	data := make([]byte, 0, 48+len(payment.CorrelationId)+len(payment.Tenant)+len(payment.ClientId))
+	data = append(data, binaryV1, byte(payment.Api), flags)
+	data = binary.AppendUvarint(data, uint64(times[0]))
+	for _, at := range times[1:] {
+		data = binary.AppendVarint(data, at-times[0])
+	}
+	data = binary.AppendVarint(data, minor)
+	data = appendString(data, payment.Currency)
+	data = binary.AppendUvarint(data, uint64(payment.Attempts))
+	data = binary.AppendUvarint(data, uint64(latencyUs))
+	data = appendString(data, payment.CorrelationId)
+	data = appendString(data, payment.Tenant)
+	data = appendString(data, payment.ClientId)
+	return data, true
+}
+
+// decodeProcessed lê um membro em qualquer um dos formatos.
+func decodeProcessed(data []byte) (dtos.ProcessedPayment, error) {
+	var payment dtos.ProcessedPayment
+	if len(data) > 0 && data[0] == '{' {
+		err := json.Unmarshal(data, &payment)
+		return payment, err
+	}
+	if len(data) < 3 || data[0] != binaryV1 {
+		return payment, errUnknownEncoding
+	}
+	if dtos.PaymentAPI(data[1]) > dtos.FALLBACK_API || data[2] == 0 || data[2] > 0b111 {
+		return payment, fmt.Errorf("Registro binário inválido: %w", errCorrupt)
+	}
+
+	payment.Api = dtos.PaymentAPI(data[1])
+	flags := data[2]
+	d := decoder{data: data[3:]}
+
+	var base int64
+	first := true
+	for i, field := range []*string{&payment.RequestedAt, &payment.DispatchedAt, &payment.ProcessedAt} {
+		if flags&(1<<i) == 0 {
+			continue
+		}
+		if first {
+			base, first = int64(d.uvarint()), false
+			*field = time.UnixMilli(base).UTC().Format(timeLayout)
+			continue
+		}
+		*field = time.UnixMilli(base + d.varint()).UTC().Format(timeLayout)
+	}
+	minor := d.varint()
+	payment.Currency = d.string()
+	payment.Amount = dtos.FromMinor(paymentCurrency(&payment), minor)
+	payment.Attempts = int(d.uvarint())
+	payment.LatencyMs = float64(d.uvarint()) / 1000
+	payment.CorrelationId = d.string()
+	payment.Tenant = d.string()
+	payment.ClientId = d.string()
+	if err := d.finish(); err != nil {
+		return payment, fmt.Errorf("Registro binário inválido: %w", err)
+	}
+	return payment, nil
+}
+
+// isEncoded diz se o membro já está no formato encoding.
+func isEncoded(encoding Encoding, data []byte) bool {
+	isJSON := len(data) > 0 && data[0] == '{'
+	return isJSON == (encoding == EncodingJSON)
+}
+
+// encodeStreamPayment serializa uma entrada da stream no campo "p". Binário
+// v1: versão, requestedAt em ms, valor em unidades mínimas, moeda,
+// correlationId, clientId e callbackUrl. O tenant vem da stream.
+func encodeStreamPayment(payment *dtos.PaymentRequest) ([]byte, bool) {
+	currency := payment.Currency
+	if currency == "" {
+		currency = dtos.DEFAULT_CURRENCY
+	}
+	minor := dtos.ToMinor(currency, payment.Amount)
+	requestedAt := payment.RequestedAt.UnixMilli()
+	if dtos.FromMinor(currency, minor) != payment.Amount || requestedAt < 0 {
+		return nil, false
+	}
+
+	data := make([]byte, 0, 32+len(payment.CorrelationId)+len(payment.ClientId)+len(payment.CallbackUrl))
+	data = append(data, binaryV1)
+	data = binary.AppendUvarint(data, uint64(requestedAt))
+	data = binary.AppendVarint(data, minor)
+	data = appendString(data, payment.Currency)
+	data = appendString(data, payment.CorrelationId)
+	data = appendString(data, payment.ClientId)
+	data = appendString(data, payment.CallbackUrl)
+	return data, true
+}
+
+func decodeStreamPayment(data []byte) (*dtos.PaymentRequest, error) {
+	if len(data) < 1 || data[0] != binaryV1 {
+		return nil, errUnknownEncoding
+	}
+	d := decoder{data: data[1:]}
+	payment := &dtos.PaymentRequest{}
+	payment.RequestedAt = time.UnixMilli(int64(d.uvarint())).UTC()
+	minor := d.varint()
+	payment.Currency = d.string()
+	if payment.Currency == "" {
+		payment.Currency = dtos.DEFAULT_CURRENCY
+	}
+	payment.Amount = dtos.FromMinor(payment.Currency, minor)
+	payment.CorrelationId = d.string()
+	payment.ClientId = d.string()
+	payment.CallbackUrl = d.string()
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("Entrada binária inválida: %w", err)
+	}
+	return payment, nil
+}
+
+func appendString(data []byte, s string) []byte {
+	data = binary.AppendUvarint(data, uint64(len(s)))
+	return append(data, s...)
+}
+
+// decoder lê os campos em sequência e guarda o primeiro erro, para o
+// chamador conferir uma vez só no fim.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+var (
+	errTruncated = errors.New("registro truncado")
+	errCorrupt   = errors.New("registro corrompido")
+)
+
+// finish retorna o primeiro erro da leitura, ou errCorrupt se sobraram bytes.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.err = errCorrupt
+	}
+	return d.err
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.data)) < n {
+		d.err = errTruncated
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
@@ -0,0 +1,279 @@
+package repositories
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+)
+
+var codecCurrencies = []string{
+	"", "ARS", "AUD", "BHD", "BRL", "CAD", "CHF", "CLP", "CNY", "COP", "EUR",
+	"GBP", "JPY", "KRW", "KWD", "MXN", "PEN", "PYG", "USD", "UYU",
+}
+
+func fullPayment() dtos.ProcessedPayment {
+	return dtos.ProcessedPayment{
+		CorrelationId: "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3",
+		Api:           dtos.FALLBACK_API,
+		Amount:        19.9,
+		Currency:      "BRL",
+		RequestedAt:   "2025-07-15T12:34:56.789Z",
+		DispatchedAt:  "2025-07-15T12:34:57.001Z",
+		ProcessedAt:   "2025-07-15T12:34:57.250Z",
+		Attempts:      3,
+		LatencyMs:     12.345,
+		Tenant:        "acme",
+		ClientId:      "mobile",
+	}
+}
+
+func TestProcessedRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*dtos.ProcessedPayment)
+	}{
+		{"completo", func(p *dtos.ProcessedPayment) {}},
+		{"legado só com processedAt", func(p *dtos.ProcessedPayment) {
+			*p = dtos.ProcessedPayment{CorrelationId: "legacy", Amount: 10, ProcessedAt: "2025-07-15T12:00:00.000Z"}
+		}},
+		{"sem dispatchedAt", func(p *dtos.ProcessedPayment) { p.DispatchedAt = "" }},
+		{"sem processedAt", func(p *dtos.ProcessedPayment) { p.ProcessedAt = "" }},
+		{"despacho antes do requestedAt", func(p *dtos.ProcessedPayment) { p.DispatchedAt = "2025-07-15T12:34:50.000Z" }},
+		{"sem tentativas nem latência", func(p *dtos.ProcessedPayment) { p.Attempts, p.LatencyMs = 0, 0 }},
+		{"sem tenant", func(p *dtos.ProcessedPayment) { p.Tenant = "" }},
+		{"sem clientId", func(p *dtos.ProcessedPayment) { p.ClientId = "" }},
+		{"default", func(p *dtos.ProcessedPayment) { p.Api = dtos.DEFAULT_API }},
+		{"textos com unicode", func(p *dtos.ProcessedPayment) { p.CorrelationId, p.ClientId = "pagamento-ç-日本", "clï" }},
+		{"valor grande", func(p *dtos.ProcessedPayment) { p.Amount = 92233720368.54 }},
+	}
+	for _, encoding := range []Encoding{EncodingJSON, EncodingBinary} {
+		for _, tt := range tests {
+			t.Run(encoding.String()+"/"+tt.name, func(t *testing.T) {
+				payment := fullPayment()
+				tt.modify(&payment)
+				assertProcessedRoundTrip(t, encoding, payment, encoding)
+			})
+		}
+	}
+}
+
+func TestProcessedRoundTripEveryCurrency(t *testing.T) {
+	amounts := map[int]float64{0: 1500, 2: 15.25, 3: 1.125}
+	for _, currency := range codecCurrencies {
+		for _, encoding := range []Encoding{EncodingJSON, EncodingBinary} {
+			t.Run(encoding.String()+"/"+currency, func(t *testing.T) {
+				payment := fullPayment()
+				payment.Currency = currency
+				code, _ := dtos.NormalizeCurrency(currency)
+				// O maior número de casas que a moeda aceita
+				for places := 3; places >= 0; places-- {
+					if amount, ok := amounts[places]; ok && dtos.ValidAmount(code, amount) {
+						payment.Amount = amount
+						break
+					}
+				}
+				assertProcessedRoundTrip(t, encoding, payment, encoding)
+			})
+		}
+	}
+}
+
+// O binário nunca perde informação: o que não cabe nele vai em JSON.
+func TestProcessedBinaryFallsBackToJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*dtos.ProcessedPayment)
+	}{
+		{"valor com casas demais", func(p *dtos.ProcessedPayment) { p.Amount = 1.005 }},
+		{"JPY com centavos", func(p *dtos.ProcessedPayment) { p.Currency, p.Amount = "JPY", 10.5 }},
+		{"latência abaixo de µs", func(p *dtos.ProcessedPayment) { p.LatencyMs = 1.0005 }},
+		{"horário fora do formato", func(p *dtos.ProcessedPayment) { p.RequestedAt = "2025-07-15T12:34:56Z" }},
+		{"horário com fuso", func(p *dtos.ProcessedPayment) { p.DispatchedAt = "2025-07-15T09:34:57.001-03:00" }},
+		{"sem horários", func(p *dtos.ProcessedPayment) { p.RequestedAt, p.DispatchedAt, p.ProcessedAt = "", "", "" }},
+		{"antes de 1970", func(p *dtos.ProcessedPayment) { p.RequestedAt = "1969-12-31T23:59:59.000Z" }},
+		{"tentativas negativas", func(p *dtos.ProcessedPayment) { p.Attempts = -1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payment := fullPayment()
+			tt.modify(&payment)
+			assertProcessedRoundTrip(t, EncodingBinary, payment, EncodingJSON)
+		})
+	}
+}
+
+func assertProcessedRoundTrip(t *testing.T, encoding Encoding, payment dtos.ProcessedPayment, want Encoding) {
+	t.Helper()
+	payment.CallbackUrl = "https://example.com/hook" // não é gravado
+	data, err := encodeProcessed(encoding, &payment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncoded(want, data) {
+		t.Errorf("esperava registro em %s, obteve %q", want, data)
+	}
+
+	decoded, err := decodeProcessed(data)
+	if err != nil {
+		t.Fatalf("erro ao decodificar %q: %v", data, err)
+	}
+	payment.CallbackUrl = ""
+	if decoded != payment {
+		t.Errorf("ida e volta diferente:\n  antes  %+v\n  depois %+v", payment, decoded)
+	}
+}
+
+func TestDecodeProcessedRejectsCorruptInput(t *testing.T) {
+	payment := fullPayment()
+	valid, ok := encodeProcessedBinary(&payment)
+	if !ok {
+		t.Fatal("pagamento completo deveria caber no binário")
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"vazio", nil},
+		{"versão desconhecida", append([]byte{0x02}, valid[1:]...)},
+		{"processador desconhecido", append([]byte{binaryV1, 7}, valid[2:]...)},
+		{"sem horários", append([]byte{binaryV1, 0, 0}, valid[3:]...)},
+		{"flags desconhecidas", append([]byte{binaryV1, 0, 0b1001}, valid[3:]...)},
+		{"bytes sobrando", append(append([]byte{}, valid...), 0)},
+		{"JSON inválido", []byte(`{"correlationId": `)},
+		{"texto", []byte("not a payment")},
+	}
+	// Cortado em qualquer ponto
+	for n := range len(valid) {
+		tests = append(tests, struct {
+			name string
+			data []byte
+		}{fmt.Sprintf("truncado em %d bytes", n), valid[:n]})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if decoded, err := decodeProcessed(tt.data); err == nil {
+				t.Errorf("esperava erro para %x, obteve %+v", tt.data, decoded)
+			}
+		})
+	}
+}
+
+func TestEncodingDetection(t *testing.T) {
+	payment := fullPayment()
+	jsonData, _ := encodeProcessed(EncodingJSON, &payment)
+	binaryData, _ := encodeProcessed(EncodingBinary, &payment)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		isJSON     bool
+		isBinary   bool
+		decodeFail bool
+	}{
+		{"json", jsonData, true, false, false},
+		{"binário", binaryData, false, true, false},
+		// Um registro vazio não é JSON; ao migrar ele é tratado como binário
+		// e o decode falha
+		{"vazio", nil, false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isEncoded(EncodingJSON, tt.data); got != tt.isJSON {
+				t.Errorf("isEncoded(json) = %v", got)
+			}
+			if got := isEncoded(EncodingBinary, tt.data); got != tt.isBinary {
+				t.Errorf("isEncoded(binary) = %v", got)
+			}
+			if _, err := decodeProcessed(tt.data); (err != nil) != tt.decodeFail {
+				t.Errorf("decode: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		want Encoding
+		ok   bool
+	}{
+		{"json", EncodingJSON, true},
+		{"binary", EncodingBinary, true},
+		{"msgpack", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseEncoding(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseEncoding(%q) = %v, %v", tt.name, got, ok)
+		}
+		if ok && got.String() != tt.name {
+			t.Errorf("%v.String() = %q", got, got.String())
+		}
+	}
+}
+
+func TestStreamPaymentRoundTrip(t *testing.T) {
+	requestedAt := time.Date(2025, 7, 15, 12, 34, 56, 789000000, time.UTC)
+	base := dtos.PaymentRequest{
+		CorrelationId: "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3",
+		Amount:        19.9,
+		Currency:      "BRL",
+		RequestedAt:   requestedAt,
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*dtos.PaymentRequest)
+	}{
+		{"mínimo", func(p *dtos.PaymentRequest) {}},
+		{"com clientId", func(p *dtos.PaymentRequest) { p.ClientId = "mobile" }},
+		{"com callbackUrl", func(p *dtos.PaymentRequest) { p.CallbackUrl = "https://example.com/hook?a=1" }},
+		{"sem moeda", func(p *dtos.PaymentRequest) { p.Currency = "" }},
+	}
+	for _, currency := range codecCurrencies[1:] {
+		tests = append(tests, struct {
+			name   string
+			modify func(*dtos.PaymentRequest)
+		}{"moeda " + currency, func(p *dtos.PaymentRequest) { p.Currency, p.Amount = currency, 7 }})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payment := base
+			tt.modify(&payment)
+			data, ok := encodeStreamPayment(&payment)
+			if !ok {
+				t.Fatal("esperava caber no binário")
+			}
+			decoded, err := decodeStreamPayment(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if payment.Currency == "" {
+				payment.Currency = dtos.DEFAULT_CURRENCY
+			}
+			if *decoded != payment {
+				t.Errorf("ida e volta diferente:\n  antes  %+v\n  depois %+v", payment, *decoded)
+			}
+
+			for n := range len(data) {
+				if _, err := decodeStreamPayment(data[:n]); err == nil {
+					t.Errorf("entrada truncada em %d bytes foi aceita", n)
+				}
+			}
+			if _, err := decodeStreamPayment(append(data, 0)); !errors.Is(err, errCorrupt) {
+				t.Errorf("bytes sobrando: esperava errCorrupt, obteve %v", err)
+			}
+		})
+	}
+
+	if _, ok := encodeStreamPayment(&dtos.PaymentRequest{Amount: 1.001, RequestedAt: requestedAt}); ok {
+		t.Error("valor com casas demais não deveria caber no binário")
+	}
+}
@@ -0,0 +1,151 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+// O feed é uma stream lida com XREAD simples (sem read group). Cada instância
+// tem um único leitor que repassa os eventos aos clientes SSE conectados nela;
+// o id da stream continua sendo o Last-Event-ID, o que permite retomar em
+// qualquer instância.
+
+const (
+	eventsMaxLen = 100000
+	allTenants   = "*"
+)
+
+var eventIdPattern = regexp.MustCompile(`^\d+(-\d+)?$`)
+
+func ValidEventId(id string) bool {
+	return eventIdPattern.MatchString(id)
+}
+
+func (r *RedisRepository) appendEvent(ctx context.Context, pipe redis.Pipeliner, tenant string, event *dtos.PaymentEvent) error {
+	data, err := marshalEvent(event)
+	if err != nil {
+		return err
+	}
+	r.addEvent(ctx, pipe, tenant, data)
+	return nil
+}
+
+func (r *RedisRepository) addEvent(ctx context.Context, pipe redis.Pipeliner, tenant string, data []byte) {
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: r.keys.events(),
+		MaxLen: eventsMaxLen,
+		Approx: true,
+		Values: map[string]any{"tenant": tenant, "event": data},
+	})
+}
+
+func marshalEvent(event *dtos.PaymentEvent) ([]byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao serializar evento: %w", err)
+	}
+	return data, nil
+}
+
+// PublishProcessorSwitch registra a troca do processador ativo. O evento vai
+// para os clientes de todos os tenants.
+func (r *RedisRepository) PublishProcessorSwitch(ctx context.Context, previous, active dtos.PaymentAPI) error {
+	pipe := r.client.Pipeline()
+	err := r.appendEvent(ctx, pipe, allTenants, &dtos.PaymentEvent{
+		Type:      dtos.PAYMENT_EVENT_PROCESSOR_SWITCHED,
+		Processor: active.String(),
+		Previous:  previous.String(),
+		At:        time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("Erro ao publicar troca de processador: %w", err)
+	}
+	return nil
+}
+
+// LastEventId retorna o id do evento mais recente, ou "0-0" se o feed estiver
+// vazio. É o cursor de quem conecta sem Last-Event-ID.
+func (r *RedisRepository) LastEventId(ctx context.Context) (string, error) {
+	messages, err := r.client.XRevRangeN(ctx, r.keys.events(), "+", "-", 1).Result()
+	if err != nil {
+		return "", fmt.Errorf("Erro ao buscar último evento: %w", err)
+	}
+	if len(messages) == 0 {
+		return "0-0", nil
+	}
+	return messages[0].ID, nil
+}
+
+// ReadEvents retorna os eventos de todos os tenants depois de after junto com
+// o novo cursor. Com wait espera até ReadBlock por eventos novos; sem wait
+// retorna logo, o que serve para alcançar o fim do feed.
+func (r *RedisRepository) ReadEvents(ctx context.Context, after string, wait bool) ([]dtos.PaymentEvent, string, error) {
+	block := time.Duration(-1)
+	if wait {
+		block = r.ReadBlock
+	}
+	data, err := r.client.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{r.keys.events(), after},
+		Count:   100,
+		Block:   block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, after, nil
+	}
+	if err != nil {
+		return nil, after, fmt.Errorf("Erro ao ler feed de eventos: %w", err)
+	}
+
+	var events []dtos.PaymentEvent
+	for _, stream := range data {
+		for _, message := range stream.Messages {
+			after = message.ID
+			raw, _ := message.Values["event"].(string)
+			var event dtos.PaymentEvent
+			if err := json.Unmarshal([]byte(raw), &event); err != nil {
+				slog.Warn("Failed to unmarshall payment event. Skipping")
+				continue
+			}
+			event.Id = message.ID
+			event.Tenant, _ = message.Values["tenant"].(string)
+			events = append(events, event)
+		}
+	}
+	return events, after, nil
+}
+
+// EventVisibleTo diz se o evento vai para os clientes do tenant: os do
+// próprio tenant e os publicados para todos.
+func EventVisibleTo(event *dtos.PaymentEvent, tenant string) bool {
+	return event.Tenant == tenant || event.Tenant == allTenants
+}
+
+// EventAfter compara dois ids da stream de eventos.
+func EventAfter(id, other string) bool {
+	ms, seq := splitStreamId(id)
+	otherMs, otherSeq := splitStreamId(other)
+	if ms != otherMs {
+		return ms > otherMs
+	}
+	return seq > otherSeq
+}
+
+func splitStreamId(id string) (uint64, uint64) {
+	msPart, seqPart, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseUint(msPart, 10, 64)
+	seq, _ := strconv.ParseUint(seqPart, 10, 64)
+	return ms, seq
+}
@@ -0,0 +1,86 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+// ScanProcessed percorre os pagamentos do período em blocos de até chunk,
+// em ordem de requestedAt, sem carregar o período inteiro. O cursor é o
+// último score lido mais quantos membros com esse score já foram entregues,
+// então inserções em outros pontos do sorted set não desalinham a leitura.
+func (r *RedisRepository) ScanProcessed(ctx context.Context, tenant string, api dtos.PaymentAPI, from, to time.Time, chunk int64, fn func([]dtos.ProcessedPayment) error) error {
+	key := r.keys.processed(tenant, api)
+	min, max := scoreRange(from, to)
+	var offset int64
+
+	for {
+		results, err := r.client.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+			Min:    min,
+			Max:    max,
+			Offset: offset,
+			Count:  chunk,
+		}).Result()
+		if err != nil {
+			return fmt.Errorf("Erro ao ler pagamentos processados: %w", err)
+		}
+		if len(results) == 0 {
+			return nil
+		}
+
+		payments := make([]dtos.ProcessedPayment, 0, len(results))
+		for _, result := range results {
+			member, _ := result.Member.(string)
+			payment, err := decodeProcessed([]byte(member))
+			if err != nil {
+				slog.Warn("Failed to unmarshall processed payment. Skipping")
+				continue
+			}
+			payments = append(payments, payment)
+		}
+		if err := fn(payments); err != nil {
+			return err
+		}
+
+		if int64(len(results)) < chunk {
+			return nil
+		}
+
+		last := results[len(results)-1].Score
+		lastMin := strconv.FormatFloat(last, 'f', -1, 64)
+		if lastMin != min {
+			offset = 0
+		}
+		for _, result := range results {
+			if result.Score == last {
+				offset++
+			}
+		}
+		min = lastMin
+	}
+}
+
+// ArchivedUntil retorna o fim do último bucket de rollup que toca o período,
+// ou o time.Time zero se nada do período foi arquivado. O export lê só o
+// Redis, então um período arquivado sairia incompleto.
+func (r *RedisRepository) ArchivedUntil(ctx context.Context, tenant string, api dtos.PaymentAPI, from, to time.Time) (time.Time, error) {
+	entries, err := r.rollupsInRange(ctx, tenant, api, from, to)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var until int64
+	for _, entry := range entries {
+		until = max(until, entry.start+entry.level.width)
+	}
+	if until == 0 {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(until).UTC(), nil
+}
@@ -0,0 +1,134 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestScanProcessedCursor(t *testing.T) {
+	// scores[i] é o requestedAt em ms do pagamento i
+	tests := []struct {
+		name   string
+		scores []int64
+	}{
+		{"scores distintos", []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{"todos iguais", []int64{5, 5, 5, 5, 5, 5, 5, 5}},
+		{"misturados", []int64{1, 1, 1, 2, 3, 3, 3, 3, 3, 4, 5, 5}},
+	}
+	for _, tt := range tests {
+		for _, chunk := range []int64{1, 2, 3, 7, 100} {
+			t.Run(fmt.Sprintf("%s/chunk=%d", tt.name, chunk), func(t *testing.T) {
+				repo := newScanRepository(t)
+				var want []string
+				for i, score := range tt.scores {
+					want = append(want, repo.addProcessed(t, fmt.Sprintf("p%02d", i), score))
+				}
+				slices.Sort(want) // p00, p01... já saem na ordem de score e membro
+
+				got := repo.scan(t, chunk, nil)
+				if !slices.Equal(got, want) {
+					t.Errorf("esperava %v, obteve %v", want, got)
+				}
+			})
+		}
+	}
+}
+
+// Membros inseridos durante a leitura antes do cursor não repetem nem pulam
+// os já existentes; os inseridos depois dele também são entregues.
+func TestScanProcessedCursorWithConcurrentInserts(t *testing.T) {
+	for _, chunk := range []int64{1, 2, 3, 7} {
+		t.Run(fmt.Sprintf("chunk=%d", chunk), func(t *testing.T) {
+			repo := newScanRepository(t)
+			var want []string
+			for i, score := range []int64{10, 10, 20, 20, 20, 30, 40, 40, 50} {
+				want = append(want, repo.addProcessed(t, fmt.Sprintf("p%02d", i), score))
+			}
+
+			inserted := 0
+			got := repo.scan(t, chunk, func(last bool) {
+				if last || inserted == 3 {
+					return
+				}
+				inserted++
+				repo.addProcessed(t, fmt.Sprintf("antes%02d", inserted), 1)
+				want = append(want, repo.addProcessed(t, fmt.Sprintf("q%02d", inserted), 1000+int64(inserted)))
+			})
+
+			seen := make(map[string]int)
+			for _, id := range got {
+				seen[id]++
+			}
+			for _, id := range want {
+				if seen[id] != 1 {
+					t.Errorf("%s entregue %d vezes: %v", id, seen[id], got)
+				}
+			}
+			for id := range seen {
+				if strings.HasPrefix(id, "antes") {
+					t.Errorf("%s foi inserido antes do cursor e não deveria ser entregue", id)
+				}
+			}
+		})
+	}
+}
+
+type scanRepository struct {
+	*RedisRepository
+}
+
+func newScanRepository(t *testing.T) scanRepository {
+	m := miniredis.RunT(t)
+	return scanRepository{NewRedisRepository(m.Addr(), "")}
+}
+
+func (r scanRepository) addProcessed(t *testing.T, id string, score int64) string {
+	t.Helper()
+	payment := dtos.ProcessedPayment{
+		CorrelationId: id,
+		Amount:        10,
+		RequestedAt:   time.UnixMilli(score).UTC().Format(timeLayout),
+		ProcessedAt:   time.UnixMilli(score).UTC().Format(timeLayout),
+	}
+	data, err := encodeProcessed(EncodingJSON, &payment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := r.keys.processed(DefaultTenant, dtos.DEFAULT_API)
+	if err := r.client.ZAdd(context.Background(), key, redis.Z{Score: float64(score), Member: data}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// scan devolve os correlationIds na ordem entregue, chamando between depois
+// de cada bloco; last indica um bloco incompleto, depois do qual a leitura
+// termina.
+func (r scanRepository) scan(t *testing.T, chunk int64, between func(last bool)) []string {
+	t.Helper()
+	var ids []string
+	err := r.ScanProcessed(context.Background(), DefaultTenant, dtos.DEFAULT_API, time.Time{}, time.Time{}, chunk, func(payments []dtos.ProcessedPayment) error {
+		if int64(len(payments)) > chunk {
+			t.Errorf("bloco com %d pagamentos, limite %d", len(payments), chunk)
+		}
+		for _, payment := range payments {
+			ids = append(ids, payment.CorrelationId)
+		}
+		if between != nil {
+			between(int64(len(payments)) < chunk)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
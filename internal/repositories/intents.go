@@ -0,0 +1,243 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+// As intenções ficam num hash por instância (CONSUMER_ID), assim o reconciliador
+// de uma instância não interfere nos pagamentos em andamento da outra. Cada
+// instância com hash entra no set intentOwners, por onde o líder encontra as
+// intenções de uma instância que não voltou mais.
+
+// intentField é o campo da intenção no hash. O tenant entra no campo para
+// dois tenants com o mesmo correlationId não se sobrescreverem; o tenant
+// padrão fica só com o correlationId, como antes.
+func intentField(tenant, correlationId string) string {
+	if tenant == DefaultTenant {
+		return correlationId
+	}
+	return tenant + ":" + correlationId
+}
+
+func (r *RedisRepository) RecordIntent(ctx context.Context, intent *dtos.PaymentIntent) error {
+	intent.RecordedAt = time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	data, err := json.Marshal(intent)
+	if err != nil {
+		return fmt.Errorf("Erro ao serializar intenção de pagamento: %w", err)
+	}
+
+	pipe := r.client.TxPipeline()
+	pipe.HSet(ctx, r.intentsKey, intentField(intent.Tenant, intent.CorrelationId), data)
+	pipe.SAdd(ctx, r.keys.intentOwners(), r.ConsumerId)
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("Erro ao registrar intenção de pagamento: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisRepository) ClearIntent(ctx context.Context, tenant, correlationId string) error {
+	err := r.client.HDel(ctx, r.intentsKey, intentField(tenant, correlationId)).Err()
+	if err != nil {
+		return fmt.Errorf("Erro ao remover intenção de pagamento: %w", err)
+	}
+	return nil
+}
+
+// GetIntents retorna as intenções desta instância.
+func (r *RedisRepository) GetIntents(ctx context.Context) ([]dtos.PaymentIntent, error) {
+	values, err := r.client.HGetAll(ctx, r.intentsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao buscar intenções de pagamento: %w", err)
+	}
+
+	intents := make([]dtos.PaymentIntent, 0, len(values))
+	// Intenções de tenants gravadas antes do tenant entrar no campo mudam de
+	// campo, para o StoreProcessed conseguir removê-las
+	renamed := r.client.TxPipeline()
+	for field, value := range values {
+		var intent dtos.PaymentIntent
+		if err := json.Unmarshal([]byte(value), &intent); err != nil {
+			slog.Warn("Failed to unmarshall payment intent. Skipping")
+			continue
+		}
+		if expected := intentField(intent.Tenant, intent.CorrelationId); field != expected {
+			renamed.HSetNX(ctx, r.intentsKey, expected, value)
+			renamed.HDel(ctx, r.intentsKey, field)
+		}
+		intents = append(intents, intent)
+	}
+	if renamed.Len() > 0 {
+		if _, err := renamed.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("Erro ao migrar intenções de pagamento: %w", err)
+		}
+	}
+	return intents, nil
+}
+
+// adoptIntentsScript move intenções do hash de outra instância para o desta,
+// conferindo que cada uma não mudou desde a leitura (a dona pode ter voltado
+// e concluído o pagamento). Esvaziado o hash, a outra instância sai do set.
+//
+// KEYS[1] = intenções da outra instância, KEYS[2] = intenções desta,
+// KEYS[3] = set de instâncias com intenções
+// ARGV[1] = id da outra instância, ARGV[2..] = pares campo, intenção lida
+var adoptIntentsScript = newLuaScript("adopt-intents", 1, `
+local adopted = 0
+for i = 2, #ARGV, 2 do
+	if redis.call('HGET', KEYS[1], ARGV[i]) == ARGV[i+1] then
+		redis.call('HDEL', KEYS[1], ARGV[i])
+		redis.call('HSET', KEYS[2], ARGV[i], ARGV[i+1])
+		adopted = adopted + 1
+	end
+end
+if redis.call('HLEN', KEYS[1]) == 0 then
+	redis.call('SREM', KEYS[3], ARGV[1])
+end
+return adopted
+`)
+
+// AdoptStaleIntents traz para esta instância as intenções de qualquer
+// instância gravadas antes de before e retorna essas e as desta instância
+// também anteriores a before. Com before depois do timeout dos workers, o
+// worker que gravou a intenção já desistiu dela.
+func (r *RedisRepository) AdoptStaleIntents(ctx context.Context, before time.Time) ([]dtos.PaymentIntent, error) {
+	owners, err := r.client.SMembers(ctx, r.keys.intentOwners()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao buscar instâncias com intenções: %w", err)
+	}
+
+	var stale []dtos.PaymentIntent
+	for _, owner := range owners {
+		key := r.keys.intents(owner)
+		values, err := r.client.HGetAll(ctx, key).Result()
+		if err != nil {
+			return stale, fmt.Errorf("Erro ao buscar intenções de pagamento: %w", err)
+		}
+
+		var found []dtos.PaymentIntent
+		args := []any{owner}
+		for field, value := range values {
+			var intent dtos.PaymentIntent
+			if err := json.Unmarshal([]byte(value), &intent); err != nil {
+				slog.Warn("Failed to unmarshall payment intent. Skipping")
+				continue
+			}
+			// Sem recordedAt a intenção é de antes do campo e com certeza abandonada
+			recordedAt, err := time.Parse("2006-01-02T15:04:05.000Z", intent.RecordedAt)
+			if err == nil && !recordedAt.Before(before) {
+				continue
+			}
+			found = append(found, intent)
+			args = append(args, field, value)
+		}
+
+		if owner == r.ConsumerId {
+			stale = append(stale, found...)
+			continue
+		}
+		if len(found) == 0 && len(values) > 0 {
+			continue
+		}
+		adopted, err := adoptIntentsScript.Run(ctx, r.client,
+			[]string{key, r.intentsKey, r.keys.intentOwners()}, args...).Int()
+		if err != nil {
+			return stale, fmt.Errorf("Erro ao adotar intenções de pagamento: %w", err)
+		}
+		// Se a dona mexeu em alguma no meio, a próxima rodada confere de novo
+		if adopted == len(found) {
+			stale = append(stale, found...)
+		}
+	}
+	return stale, nil
+}
+
+// HasIntent diz se alguma instância tem intenção gravada para o pagamento.
+func (r *RedisRepository) HasIntent(ctx context.Context, tenant, correlationId string) (bool, error) {
+	owners, err := r.client.SMembers(ctx, r.keys.intentOwners()).Result()
+	if err != nil {
+		return false, fmt.Errorf("Erro ao buscar instâncias com intenções: %w", err)
+	}
+
+	field := intentField(tenant, correlationId)
+	for _, owner := range owners {
+		found, err := r.client.HExists(ctx, r.keys.intents(owner), field).Result()
+		if err != nil {
+			return false, fmt.Errorf("Erro ao buscar intenção de pagamento: %w", err)
+		}
+		if found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// clearTenantIntents apaga as intenções do tenant em todas as instâncias,
+// para o reconciliador não regravar pagamentos de um tenant apagado.
+func (r *RedisRepository) clearTenantIntents(ctx context.Context, tenant string) error {
+	owners, err := r.client.SMembers(ctx, r.keys.intentOwners()).Result()
+	if err != nil {
+		return fmt.Errorf("Erro ao buscar instâncias com intenções: %w", err)
+	}
+
+	for _, owner := range owners {
+		key := r.keys.intents(owner)
+		values, err := r.client.HGetAll(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("Erro ao buscar intenções de pagamento: %w", err)
+		}
+
+		var fields []string
+		for field, value := range values {
+			var intent dtos.PaymentIntent
+			if err := json.Unmarshal([]byte(value), &intent); err == nil && intent.Tenant == tenant {
+				fields = append(fields, field)
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if err := r.client.HDel(ctx, key, fields...).Err(); err != nil {
+			return fmt.Errorf("Erro ao remover intenções de pagamento: %w", err)
+		}
+	}
+	return nil
+}
+
+// RequeueIntent devolve à stream um pagamento que o processador não recebeu,
+// mantendo o requestedAt original, e dá ack na mensagem antiga.
+func (r *RedisRepository) RequeueIntent(ctx context.Context, intent *dtos.PaymentIntent) error {
+	requestedAt, err := time.Parse("2006-01-02T15:04:05.000Z", intent.RequestedAt)
+	if err != nil {
+		return fmt.Errorf("Erro ao converter data: %w", err)
+	}
+	values := r.streamValues(&dtos.PaymentRequest{
+		CorrelationId: intent.CorrelationId,
+		Amount:        intent.Amount,
+		Currency:      intent.Currency,
+		RequestedAt:   requestedAt,
+		ClientId:      intent.ClientId,
+		CallbackUrl:   intent.CallbackUrl,
+	})
+
+	err = r.execThen(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: r.keys.stream(intent.Tenant), Values: values})
+		return nil
+	}, func(pipe redis.Pipeliner) {
+		pipe.HDel(ctx, r.intentsKey, intentField(intent.Tenant, intent.CorrelationId))
+		if intent.RedisStreamId != "" {
+			r.AckMessage(ctx, intent.Tenant, intent.RedisStreamId, &pipe)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("Erro ao reenfileirar pagamento: %w", err)
+	}
+	return nil
+}
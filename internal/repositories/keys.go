@@ -0,0 +1,160 @@
+package repositories
+
+import (
+	"regexp"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+)
+
+// DefaultTenant é usado quando a requisição não identifica um tenant. Suas
+// chaves não levam o segmento de tenant, o que mantém os nomes antigos.
+const DefaultTenant = ""
+
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func ValidTenant(tenant string) bool {
+	return tenant == DefaultTenant || tenantPattern.MatchString(tenant)
+}
+
+// keyspace monta os nomes das chaves a partir do prefixo configurado
+// (KEY_PREFIX) e do tenant.
+//
+// No cluster as chaves de um tenant levam o tenant como hash tag
+// ("tenants:{t}:payments:..." e "{payments}:..." para o padrão), para a
+// stream, os sorted sets, o índice, o status e os rollups ficarem no mesmo
+// slot e caberem num script ou numa transação. As chaves de webhooks dividem
+// a tag "{webhooks}". Fora do cluster os nomes continuam sem tags.
+type keyspace struct {
+	prefix  string
+	cluster bool
+}
+
+func (k keyspace) tag(name string) string {
+	if k.cluster {
+		return "{" + name + "}"
+	}
+	return name
+}
+
+func (k keyspace) base(tenant string) string {
+	if tenant == DefaultTenant {
+		return k.prefix + k.tag("payments") + ":"
+	}
+	return k.prefix + "tenants:" + k.tag(tenant) + ":payments:"
+}
+
+func (k keyspace) stream(tenant string) string {
+	return k.base(tenant) + "stream"
+}
+
+func (k keyspace) processed(tenant string, api dtos.PaymentAPI) string {
+	return k.base(tenant) + "processed:" + api.String()
+}
+
+// status guarda, por correlationId, a situação do pagamento: "queued",
+// "processed:<processador>", "failed" ou "archived:<processador>". A presença
+// do campo, exceto como failed, é o que recusa duplicatas na entrada; a
+// retenção o troca por archived, mais curto, em vez de removê-lo.
+func (k keyspace) status(tenant string) string {
+	return k.base(tenant) + "status"
+}
+
+// submitted é o set de correlationIds recebidos de antes do hash de status.
+// Só é lido, para continuar recusando duplicatas desses pagamentos, e perde
+// cada membro quando a retenção arquiva o pagamento.
+func (k keyspace) submitted(tenant string) string {
+	return k.base(tenant) + "submitted"
+}
+
+// index é o hash legado que ligava o correlationId ao membro do pagamento
+// processado. Não é mais gravado nem lido; o reembolso acha o membro pelo
+// score guardado no status, e o hash sai quando o tenant é carregado.
+func (k keyspace) index(tenant string) string {
+	return k.base(tenant) + "index"
+}
+
+// refunded guarda, por correlationId, quantos centavos já foram reservados
+// para reembolso (incluindo os ainda na fila).
+func (k keyspace) refunded(tenant string) string {
+	return k.base(tenant) + "refunded"
+}
+
+func (k keyspace) refunds(tenant string, api dtos.PaymentAPI) string {
+	return k.base(tenant) + "refunds:" + api.String()
+}
+
+func (k keyspace) refundStream() string {
+	return k.prefix + "refunds:stream"
+}
+
+// rollups acumula, por minuto e moeda, a contagem e o valor dos pagamentos
+// já arquivados, para o sumário continuar cobrindo o período.
+func (k keyspace) rollups(tenant string, api dtos.PaymentAPI) string {
+	return k.base(tenant) + "rollups:" + api.String()
+}
+
+// rollupIndex é o sorted set dos buckets "<início>:<moeda>" de rollups, com o
+// início como score, para o sumário ler só os campos do período.
+func (k keyspace) rollupIndex(tenant string, api dtos.PaymentAPI) string {
+	return k.base(tenant) + "rollups-index:" + api.String()
+}
+
+// hourlyRollups e hourlyRollupIndex são os rollups por hora em que os por
+// minuto mais antigos são compactados.
+func (k keyspace) hourlyRollups(tenant string, api dtos.PaymentAPI) string {
+	return k.base(tenant) + "rollups-hourly:" + api.String()
+}
+
+func (k keyspace) hourlyRollupIndex(tenant string, api dtos.PaymentAPI) string {
+	return k.base(tenant) + "rollups-hourly-index:" + api.String()
+}
+
+func (k keyspace) deadLetter(tenant string) string {
+	return k.base(tenant) + "deadletter"
+}
+
+// As intenções são por instância e guardam o tenant de cada pagamento. No
+// cluster os hashes de todas as instâncias dividem a tag "{intents}", para o
+// líder poder adotar as intenções de outra instância num script.
+func (k keyspace) intents(consumerId string) string {
+	if k.cluster {
+		return k.prefix + "{intents}:" + consumerId
+	}
+	return k.prefix + "payments:intents:" + consumerId
+}
+
+// intentOwners é o set das instâncias que têm hash de intenções.
+func (k keyspace) intentOwners() string {
+	if k.cluster {
+		return k.prefix + "{intents}"
+	}
+	return k.prefix + "payments:intents"
+}
+
+func (k keyspace) webhookStream() string {
+	return k.prefix + k.tag("webhooks") + ":stream"
+}
+
+func (k keyspace) webhookRetries() string {
+	return k.prefix + k.tag("webhooks") + ":retry"
+}
+
+func (k keyspace) webhookLog() string {
+	return k.prefix + k.tag("webhooks") + ":log"
+}
+
+// O feed de eventos é único para todos os tenants; cada entrada carrega o
+// tenant para que o leitor filtre.
+func (k keyspace) events() string {
+	return k.prefix + "events:stream"
+}
+
+func (k keyspace) tenants() string {
+	return k.prefix + "tenants"
+}
+
+// global é usado pelas chaves compartilhadas entre tenants (liderança,
+// estado de saúde, canais de pub/sub).
+func (k keyspace) global(name string) string {
+	return k.prefix + name
+}
@@ -0,0 +1,114 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	HealthLeaderKey        = "health:leader"
+	healthStateKey         = "health:state"
+	processorEventsChannel = "processors:events"
+)
+
+// Renova o lock apenas se ele ainda pertence a quem está pedindo.
+var renewLeadershipScript = newLuaScript("renew-leadership", 1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// AcquireLeadership tenta obter ou renovar o lock de liderança em key (sem o
+// prefixo). Retorna true enquanto id for o dono do lock.
+func (r *RedisRepository) AcquireLeadership(ctx context.Context, key, id string, ttl time.Duration) (bool, error) {
+	key = r.keys.global(key)
+	acquired, err := r.client.SetNX(ctx, key, id, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("Erro ao adquirir liderança: %w", err)
+	}
+	if acquired {
+		return true, nil
+	}
+
+	renewed, err := renewLeadershipScript.Run(ctx, r.client, []string{key}, id, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("Erro ao renovar liderança: %w", err)
+	}
+	return renewed == 1, nil
+}
+
+func (r *RedisRepository) PublishHealthState(ctx context.Context, state *dtos.HealthState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Erro ao serializar estado de saúde: %w", err)
+	}
+
+	err = r.client.Set(ctx, r.keys.global(healthStateKey), data, 0).Err()
+	if err != nil {
+		return fmt.Errorf("Erro ao publicar estado de saúde: %w", err)
+	}
+	return nil
+}
+
+// GetHealthState retorna nil, nil se nenhum líder publicou ainda.
+func (r *RedisRepository) GetHealthState(ctx context.Context) (*dtos.HealthState, error) {
+	data, err := r.client.Get(ctx, r.keys.global(healthStateKey)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Erro ao buscar estado de saúde: %w", err)
+	}
+
+	var state dtos.HealthState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao desserializar estado de saúde: %w", err)
+	}
+	return &state, nil
+}
+
+func (r *RedisRepository) PublishProcessorEvent(ctx context.Context, event *dtos.ProcessorEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("Erro ao serializar evento de processador: %w", err)
+	}
+
+	err = r.client.Publish(ctx, r.keys.global(processorEventsChannel), data).Err()
+	if err != nil {
+		return fmt.Errorf("Erro ao publicar evento de processador: %w", err)
+	}
+	return nil
+}
+
+// ListenProcessorEvents chama handler para cada evento publicado até ctx ser
+// cancelado. O cliente do go-redis reconecta a assinatura sozinho.
+func (r *RedisRepository) ListenProcessorEvents(ctx context.Context, handler func(*dtos.ProcessorEvent)) {
+	sub := r.client.Subscribe(ctx, r.keys.global(processorEventsChannel))
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			var event dtos.ProcessorEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				slog.Warn("Failed to unmarshall processor event. Skipping")
+				continue
+			}
+			handler(&event)
+		}
+	}
+}
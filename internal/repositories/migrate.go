@@ -0,0 +1,159 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+// migrateScript troca membros do sorted set de processados mantendo o
+// score. Um membro que sumiu nesse meio tempo (purge, retenção) é ignorado.
+//
+// KEYS[1] = sorted set de processados
+// ARGV em pares: membro antigo, membro novo
+var migrateScript = newLuaScript("migrate-encoding", 2, `
+local migrated = 0
+for i = 1, #ARGV, 2 do
+	local score = redis.call('ZSCORE', KEYS[1], ARGV[i])
+	if score then
+		redis.call('ZREM', KEYS[1], ARGV[i])
+		redis.call('ZADD', KEYS[1], score, ARGV[i+1])
+		migrated = migrated + 1
+	end
+end
+return migrated
+`)
+
+// MigrateEncoding regrava no formato configurado (SetEncoding) os pagamentos
+// processados de api gravados em outro formato, em blocos de até chunk. Pode
+// rodar com o sistema no ar: o ZSCAN devolve todo membro que existia no
+// início, e os já convertidos são pulados. Um reembolso pedido exatamente
+// durante a troca do seu pagamento recebe 404 e pode ser repetido.
+func (r *RedisRepository) MigrateEncoding(ctx context.Context, tenant string, api dtos.PaymentAPI, chunk int64) (int64, error) {
+	keys := []string{r.keys.processed(tenant, api)}
+
+	var total int64
+	var cursor uint64
+	for {
+		// ZSCAN devolve membro e score alternados
+		entries, next, err := r.client.ZScan(ctx, keys[0], cursor, "", chunk).Result()
+		if err != nil {
+			return total, fmt.Errorf("Erro ao percorrer pagamentos processados: %w", err)
+		}
+
+		var args []any
+		for i := 0; i < len(entries); i += 2 {
+			member := []byte(entries[i])
+			if isEncoded(r.encoding, member) {
+				continue
+			}
+			payment, err := decodeProcessed(member)
+			if err != nil {
+				slog.Warn("Failed to decode processed payment. Skipping migration", "err", err)
+				continue
+			}
+			converted, err := encodeProcessed(r.encoding, &payment)
+			if err != nil {
+				return total, err
+			}
+			if !isEncoded(r.encoding, converted) {
+				continue // não cabe no formato novo e fica como está
+			}
+			args = append(args, entries[i], converted)
+		}
+
+		if len(args) > 0 {
+			migrated, err := migrateScript.Run(ctx, r.client, keys, args...).Int64()
+			if err != nil {
+				return total, fmt.Errorf("Erro ao migrar pagamentos processados: %w", err)
+			}
+			total += migrated
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return total, nil
+		}
+	}
+}
+
+// dropLegacyIndex apaga o hash index do tenant, que ligava o correlationId ao
+// membro do pagamento processado. Antes, os pagamentos do índice ainda sem
+// status ganham um, com o score, para continuarem aceitando reembolso.
+func (r *RedisRepository) dropLegacyIndex(ctx context.Context, tenant string) error {
+	key := r.keys.index(tenant)
+	var cursor uint64
+	for {
+		// HSCAN devolve campo e valor alternados
+		entries, next, err := r.client.HScan(ctx, key, cursor, "", 500).Result()
+		if err != nil {
+			return fmt.Errorf("Erro ao percorrer índice legado: %w", err)
+		}
+
+		pipe := r.client.Pipeline()
+		for i := 0; i+1 < len(entries); i += 2 {
+			payment, err := decodeProcessed([]byte(entries[i+1]))
+			if err != nil {
+				continue
+			}
+			at, err := payment.SummaryTime()
+			if err != nil {
+				continue
+			}
+			pipe.HSetNX(ctx, r.keys.status(tenant), entries[i], processedStatus(payment.Api, at.UnixMilli()))
+		}
+		if pipe.Len() > 0 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return fmt.Errorf("Erro ao migrar índice legado: %w", err)
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if err := r.client.Unlink(ctx, key).Err(); err != nil {
+		return fmt.Errorf("Erro ao apagar índice legado: %w", err)
+	}
+	return nil
+}
+
+// indexLegacyRollups registra no índice os buckets de rollups gravados antes
+// dele existir, para o sumário e o purge continuarem encontrando-os.
+func (r *RedisRepository) indexLegacyRollups(ctx context.Context, tenant string) error {
+	for _, api := range []dtos.PaymentAPI{dtos.DEFAULT_API, dtos.FALLBACK_API} {
+		key := r.keys.rollups(tenant, api)
+		var cursor uint64
+		for {
+			entries, next, err := r.client.HScan(ctx, key, cursor, "", 500).Result()
+			if err != nil {
+				return fmt.Errorf("Erro ao percorrer rollups: %w", err)
+			}
+
+			var buckets []redis.Z
+			for i := 0; i < len(entries); i += 2 {
+				minute, currency, kind, ok := parseRollupField(entries[i])
+				if ok && kind == "n" {
+					buckets = append(buckets, redis.Z{Score: float64(minute), Member: strconv.FormatInt(minute, 10) + ":" + currency})
+				}
+			}
+			if len(buckets) > 0 {
+				if err := r.client.ZAdd(ctx, r.keys.rollupIndex(tenant, api), buckets...).Err(); err != nil {
+					return fmt.Errorf("Erro ao indexar rollups: %w", err)
+				}
+			}
+
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+// Purge apaga apenas as chaves de dados do tenant do escopo. Um purge completo
+// apaga também as intenções do tenant em todas as instâncias.
+// A stream só é apagada com DropQueued, e nesse caso o read group é recriado
+// na mesma transação para os workers nunca verem NOGROUP.
+func (r *RedisRepository) Purge(ctx context.Context, scope *dtos.PurgeScope) (int64, error) {
+	apis := []dtos.PaymentAPI{dtos.DEFAULT_API, dtos.FALLBACK_API}
+	if scope.Api != nil {
+		apis = []dtos.PaymentAPI{*scope.Api}
+	}
+
+	min, max := scoreRange(scope.From, scope.To)
+
+	// Os rollups dos pagamentos arquivados saem junto com o período
+	var archived int64
+	rollups := make(map[dtos.PaymentAPI][]rollupEntry)
+	for _, api := range apis {
+		entries, err := r.rollupsInRange(ctx, scope.Tenant, api, scope.From, scope.To)
+		if err != nil {
+			return 0, err
+		}
+		// Os buckets saem inteiros; um que o período corta apagaria dados de fora dele
+		if !scope.IsFull() {
+			if err := checkAligned(entries, scope.From, scope.To); err != nil {
+				return 0, err
+			}
+		}
+		rollups[api] = entries
+		for _, entry := range entries {
+			archived += int64(entry.requests)
+		}
+	}
+
+	pipe := r.client.TxPipeline()
+
+	var removed []*redis.IntCmd
+	for _, api := range apis {
+		key := r.keys.processed(scope.Tenant, api)
+		refunds := r.keys.refunds(scope.Tenant, api)
+		if scope.IsFull() {
+			removed = append(removed, pipe.ZCard(ctx, key))
+			pipe.Del(ctx, key, refunds)
+			for _, level := range rollupLevels {
+				pipe.Del(ctx, level.hash(r.keys, scope.Tenant, api), level.index(r.keys, scope.Tenant, api))
+			}
+		} else {
+			removed = append(removed, pipe.ZRemRangeByScore(ctx, key, min, max))
+			pipe.ZRemRangeByScore(ctx, refunds, min, max)
+			for _, entry := range rollups[api] {
+				pipe.HDel(ctx, entry.level.hash(r.keys, scope.Tenant, api), entry.bucket+":n", entry.bucket+":amount", entry.bucket+":refunded")
+				pipe.ZRem(ctx, entry.level.index(r.keys, scope.Tenant, api), entry.bucket)
+			}
+		}
+	}
+	// Num purge parcial o status pode apontar para pagamentos apagados; o
+	// reembolso confere o sorted set antes de aceitar.
+	if scope.IsFull() {
+		pipe.Del(ctx, r.keys.status(scope.Tenant), r.keys.submitted(scope.Tenant), r.keys.index(scope.Tenant), r.keys.refunded(scope.Tenant))
+	}
+
+	stream := r.keys.stream(scope.Tenant)
+	if scope.DropQueued {
+		pipe.Del(ctx, stream)
+		pipe.XGroupCreateMkStream(ctx, stream, r.readGroup, "$")
+	}
+
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Erro ao limpar pagamentos: %w", err)
+	}
+
+	if !scope.DropQueued {
+		// Recupera o read group caso alguém tenha apagado a stream por fora
+		err = createStreamGroup(ctx, r.client, stream, r.readGroup, "$")
+		if err != nil {
+			return 0, fmt.Errorf("Erro ao recriar read group: %w", err)
+		}
+	}
+
+	if scope.IsFull() {
+		if err := r.clearTenantIntents(ctx, scope.Tenant); err != nil {
+			return 0, err
+		}
+	}
+
+	total := archived
+	for _, cmd := range removed {
+		total += cmd.Val()
+	}
+	return total, nil
+}
+
+// scoreRange converte o período para os limites do ZRANGEBYSCORE. Uma data
+// zerada deixa o limite aberto (-inf ou +inf).
+func scoreRange(from, to time.Time) (string, string) {
+	min, max := "-inf", "+inf"
+	if !from.IsZero() {
+		min = strconv.FormatInt(from.UnixMilli(), 10)
+	}
+	if !to.IsZero() {
+		max = strconv.FormatInt(to.UnixMilli(), 10)
+	}
+	return min, max
+}
@@ -0,0 +1,69 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+// StaleEntry é uma entrada de pagamento que ficou pendente além do limite e
+// foi reclamada para outro consumidor.
+type StaleEntry struct {
+	Tenant     string
+	Id         string
+	Deliveries int64                // entregas, contando a do XAUTOCLAIM
+	Payment    *dtos.PaymentRequest // nil se a entrada não pôde ser lida
+}
+
+// ReclaimStale transfere para consumerId, com XAUTOCLAIM, até count entradas
+// de cada tenant pendentes há mais de minIdle: o worker que as leu caiu antes
+// do ack. Sem isso elas ficariam pendentes para sempre e segurariam o trim da
+// stream.
+func (r *RedisRepository) ReclaimStale(ctx context.Context, consumerId string, minIdle time.Duration, count int64) ([]StaleEntry, error) {
+	tenants, err := r.Tenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []StaleEntry
+	for _, tenant := range tenants {
+		stream := r.keys.stream(tenant)
+		messages, _, err := r.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    r.readGroup,
+			Consumer: consumerId,
+			MinIdle:  minIdle,
+			Start:    "0-0",
+			Count:    count,
+		}).Result()
+		if isNoGroup(err) {
+			continue
+		}
+		if err != nil {
+			return entries, fmt.Errorf("Erro ao reclamar pendentes da stream: %w", err)
+		}
+
+		for i := range messages {
+			entry := StaleEntry{Tenant: tenant, Id: messages[i].ID, Deliveries: 1}
+			pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: stream,
+				Group:  r.readGroup,
+				Start:  entry.Id,
+				End:    entry.Id,
+				Count:  1,
+			}).Result()
+			if err == nil && len(pending) == 1 {
+				entry.Deliveries = pending[0].RetryCount
+			}
+			if payment, err := parseStreamMessage(&messages[i]); err == nil {
+				payment.Tenant = tenant
+				entry.Payment = payment
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
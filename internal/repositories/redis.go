@@ -2,116 +2,414 @@ package repositories
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
-	"math"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/lckrugel/rinha-backend-25/internal/chaos"
 	"github.com/lckrugel/rinha-backend-25/internal/dtos"
 	"github.com/redis/go-redis/v9"
 )
 
-type processedSet uint8
-
-const (
-	PROCESSED_DEFAULT = iota
-	PROCESSED_FALLBACK
-)
-
-var processedSetKey = map[processedSet]string{
-	PROCESSED_DEFAULT:  "payments:processed:default",
-	PROCESSED_FALLBACK: "payments:processed:fallback",
-}
-
-func createStreamGroup(r *redis.Client, stream, group string) error {
-	err := r.XGroupCreateMkStream(context.Background(), stream, group, "$").Err()
+// createStreamGroup cria o read group (e a stream, se preciso) começando em
+// start; um grupo que já existe é mantido como está.
+func createStreamGroup(ctx context.Context, client redis.UniversalClient, stream, group, start string) error {
+	err := client.XGroupCreateMkStream(ctx, stream, group, start).Err()
 	if err != nil && !strings.Contains(err.Error(), "BUSYGROUP") {
 		return err
 	}
 	return nil
 }
 
+// recreateGroups recria o read group das streams que o perderam, o que
+// acontece quando um failover promove uma réplica que não recebeu a criação
+// do grupo (ou a stream inteira). O grupo volta do início da stream: o que
+// já tinha sido confirmado e ainda não foi aparado é entregue de novo, e o
+// worker descarta pelo status os pagamentos já concluídos.
+func (r *RedisRepository) recreateGroups(ctx context.Context, streams []string) error {
+	slog.Warn("Read group não encontrado, recriando", "streams", streams)
+	for _, stream := range streams {
+		if err := createStreamGroup(ctx, r.client, stream, r.readGroup, "0"); err != nil {
+			return fmt.Errorf("Erro ao recriar read group: %w", err)
+		}
+	}
+	return nil
+}
+
 type RedisRepository struct {
-	client     *redis.Client
-	streamKey  string
+	client     redis.UniversalClient
+	keys       keyspace
 	readGroup  string
+	intentsKey string
 	ConsumerId string
+	ReadBlock  time.Duration // quanto tempo ReadFromStream espera por mensagens
+
+	encoding     Encoding // formato dos registros novos
+	recordTiming bool     // ver SetRecordTiming
+	maxBacklog   int64
+	backlog      atomic.Int64 // pagamentos nas streams, ver reserveBacklog
+
+	refundable map[dtos.PaymentAPI]bool // ver SetRefundable
+
+	tenantsMu       sync.Mutex
+	knownTenants    map[string]bool // tenants com read group garantido
+	tenantsLoadedAt time.Time
 }
 
+// NewRedisRepository conecta a um Redis standalone.
 func NewRedisRepository(addr, password string) *RedisRepository {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:         addr,
-		Password:     password,
-		DB:           0,
-		PoolSize:     15,
-		MinIdleConns: 1,
-		MaxRetries:   3,
-		DialTimeout:  5 * time.Second,
-		ReadTimeout:  3 * time.Second,
-		WriteTimeout: 3 * time.Second,
-	})
+	return NewRedisRepositoryWithConfig(RedisConfig{Addrs: []string{addr}, Password: password})
+}
+
+func NewRedisRepositoryWithConfig(cfg RedisConfig) *RedisRepository {
+	rdb := newRedisClient(cfg)
 
-	stream := "payments:stream"
+	if chaos.Enabled() {
+		rdb.AddHook(chaosHook{})
+	}
+
+	keys := keyspace{prefix: os.Getenv("KEY_PREFIX"), cluster: cfg.Mode == RedisCluster}
 	group := "read-group"
 
-	err := createStreamGroup(rdb, stream, group)
-	if err != nil {
-		log.Fatalf("Falha ao criar redis stream com read group: %v", err)
+	for _, stream := range []string{keys.stream(DefaultTenant), keys.webhookStream(), keys.refundStream()} {
+		err := createStreamGroup(context.Background(), rdb, stream, group, "$")
+		if err != nil {
+			log.Fatalf("Falha ao criar redis stream com read group: %v", err)
+		}
 	}
 
-	return &RedisRepository{
-		client:     rdb,
-		streamKey:  stream,
-		readGroup:  group,
-		ConsumerId: os.Getenv("CONSUMER_ID"),
+	consumerId := os.Getenv("CONSUMER_ID")
+
+	repo := &RedisRepository{
+		client:       rdb,
+		keys:         keys,
+		readGroup:    group,
+		intentsKey:   keys.intents(consumerId),
+		ConsumerId:   consumerId,
+		ReadBlock:    5 * time.Second,
+		encoding:     EncodingJSON,
+		refundable:   make(map[dtos.PaymentAPI]bool),
+		knownTenants: map[string]bool{DefaultTenant: true},
+	}
+	if err := repo.dropLegacyIndex(context.Background(), DefaultTenant); err != nil {
+		slog.Warn("Erro ao remover índice legado", "err", err)
 	}
+	if err := repo.indexLegacyRollups(context.Background(), DefaultTenant); err != nil {
+		slog.Warn("Erro ao indexar rollups", "err", err)
+	}
+	return repo
 }
 
 func (r *RedisRepository) Close() error {
 	return r.client.Close()
 }
 
+var ErrUnknownTenant = errors.New("tenant não registrado")
+
+// ensureTenant garante o read group de um tenant registrado. Um tenant fora
+// do set de tenants retorna ErrUnknownTenant, assim um X-Tenant-Id qualquer
+// não cria streams.
+func (r *RedisRepository) ensureTenant(ctx context.Context, tenant string) error {
+	r.tenantsMu.Lock()
+	known := r.knownTenants[tenant]
+	r.tenantsMu.Unlock()
+	if known {
+		return nil
+	}
+
+	registered, err := r.client.SIsMember(ctx, r.keys.tenants(), tenant).Result()
+	if err != nil {
+		return fmt.Errorf("Erro ao buscar tenant: %w", err)
+	}
+	if !registered {
+		return ErrUnknownTenant
+	}
+	return r.ensureGroup(ctx, tenant)
+}
+
+// ensureGroup cria a stream e o read group do tenant para que os workers
+// passem a ler dele.
+func (r *RedisRepository) ensureGroup(ctx context.Context, tenant string) error {
+	err := createStreamGroup(ctx, r.client, r.keys.stream(tenant), r.readGroup, "$")
+	if err != nil {
+		return fmt.Errorf("Falha ao criar stream do tenant: %w", err)
+	}
+	if err := r.dropLegacyIndex(ctx, tenant); err != nil {
+		slog.Warn("Erro ao remover índice legado", "tenant", tenant, "err", err)
+	}
+	if err := r.indexLegacyRollups(ctx, tenant); err != nil {
+		slog.Warn("Erro ao indexar rollups", "tenant", tenant, "err", err)
+	}
+
+	r.tenantsMu.Lock()
+	r.knownTenants[tenant] = true
+	r.tenantsMu.Unlock()
+	return nil
+}
+
+// CheckTenant retorna ErrUnknownTenant se o tenant não foi registrado.
+func (r *RedisRepository) CheckTenant(ctx context.Context, tenant string) error {
+	return r.ensureTenant(ctx, tenant)
+}
+
+// RegisterTenant registra o tenant e cria a stream dele. Um tenant já
+// conhecido por esta instância já está no set.
+func (r *RedisRepository) RegisterTenant(ctx context.Context, tenant string) error {
+	r.tenantsMu.Lock()
+	known := r.knownTenants[tenant]
+	r.tenantsMu.Unlock()
+	if known {
+		return nil
+	}
+
+	err := r.client.SAdd(ctx, r.keys.tenants(), tenant).Err()
+	if err != nil {
+		return fmt.Errorf("Falha ao registrar tenant: %w", err)
+	}
+	return r.ensureGroup(ctx, tenant)
+}
+
+// Tenants retorna o tenant padrão e todos os tenants registrados.
+func (r *RedisRepository) Tenants(ctx context.Context) ([]string, error) {
+	registered, err := r.client.SMembers(ctx, r.keys.tenants()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao buscar tenants: %w", err)
+	}
+	slices.Sort(registered)
+	return append([]string{DefaultTenant}, registered...), nil
+}
+
+// readTenants recarrega a lista de tenants a cada 5s, garantindo o read group
+// dos que foram registrados por outra instância.
+func (r *RedisRepository) readTenants(ctx context.Context) ([]string, error) {
+	r.tenantsMu.Lock()
+	stale := time.Since(r.tenantsLoadedAt) > 5*time.Second
+	r.tenantsMu.Unlock()
+
+	if stale {
+		tenants, err := r.Tenants(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, tenant := range tenants {
+			if err := r.ensureGroup(ctx, tenant); err != nil {
+				return nil, err
+			}
+		}
+		r.tenantsMu.Lock()
+		r.tenantsLoadedAt = time.Now()
+		r.tenantsMu.Unlock()
+	}
+
+	r.tenantsMu.Lock()
+	defer r.tenantsMu.Unlock()
+	tenants := make([]string, 0, len(r.knownTenants))
+	for tenant := range r.knownTenants {
+		tenants = append(tenants, tenant)
+	}
+	slices.Sort(tenants)
+	return tenants, nil
+}
+
+// AddToStream enfileira o pagamento, ou retorna ErrDuplicatePayment se o
+// correlationId já foi recebido. Um pagamento que foi para a dead-letter
+// pode ser enviado de novo.
 func (r *RedisRepository) AddToStream(ctx context.Context, payment *dtos.PaymentRequest) error {
+	err := r.ensureTenant(ctx, payment.Tenant)
+	if err != nil {
+		return err
+	}
+
+	if err := r.reserveBacklog(1); err != nil {
+		return err
+	}
+
 	payment.RequestedAt = time.Now().UTC()
-	values := map[string]any{
-		"correlationId": payment.CorrelationId,
-		"amount":        payment.Amount,
-		"requestedAt":   payment.RequestedAt.Format("2006-01-02T15:04:05.000Z"),
+	call, err := r.intakeCall(payment)
+	if err != nil {
+		r.releaseBacklog(1)
+		return err
 	}
-	err := r.client.XAdd(ctx, &redis.XAddArgs{Stream: r.streamKey, Values: values}).Err()
+	added, err := intakeScript.Run(ctx, r.client, call.keys, call.args...).Int64()
 	if err != nil {
+		r.releaseBacklog(1)
 		return fmt.Errorf("Falha ao adicionar pagamento à stream: %w", err)
 	}
+	if added == 0 {
+		r.releaseBacklog(1)
+		return ErrDuplicatePayment
+	}
+	r.publishQueued(ctx, []*intakeCall{call})
 	return nil
 }
 
-func (r *RedisRepository) ReadFromStream(ctx context.Context, consumerId string) (*dtos.PaymentRequest, error) {
-	data, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{Streams: []string{r.streamKey, ">"},
+type intakeCall struct {
+	tenant string
+	keys   []string
+	args   []any
+	event  []byte
+}
+
+func (r *RedisRepository) intakeCall(payment *dtos.PaymentRequest) (*intakeCall, error) {
+	event, err := marshalEvent(&dtos.PaymentEvent{
+		Type:          dtos.PAYMENT_EVENT_QUEUED,
+		CorrelationId: payment.CorrelationId,
+		Amount:        payment.Amount,
+		Currency:      payment.Currency,
+		At:            payment.RequestedAt.Format("2006-01-02T15:04:05.000Z"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{
+		r.keys.status(payment.Tenant),
+		r.keys.submitted(payment.Tenant),
+		r.keys.stream(payment.Tenant),
+	}
+	if !r.keys.cluster {
+		keys = append(keys, r.keys.events())
+	}
+	args := []any{payment.CorrelationId, payment.Tenant, event, eventsMaxLen}
+	return &intakeCall{
+		tenant: payment.Tenant,
+		keys:   keys,
+		args:   fieldArgs(args, r.streamValues(payment)),
+		event:  event,
+	}, nil
+}
+
+// publishQueued publica, no cluster, os eventos dos pagamentos aceitos. Vem
+// depois do script, que é quem decide se o pagamento é duplicata; uma falha
+// aqui perde só o evento, e o pagamento continua aceito.
+func (r *RedisRepository) publishQueued(ctx context.Context, calls []*intakeCall) {
+	if !r.keys.cluster || len(calls) == 0 {
+		return
+	}
+	pipe := r.client.Pipeline()
+	for _, call := range calls {
+		r.addEvent(ctx, pipe, call.tenant, call.event)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Warn("Failed to publish queued events", "count", len(calls), "err", err)
+	}
+}
+
+// ReadFromStream lê de todas as streams de tenants de uma vez, então pode
+// retornar até um pagamento por tenant.
+func (r *RedisRepository) ReadFromStream(ctx context.Context, consumerId string) ([]*dtos.PaymentRequest, error) {
+	tenants, err := r.readTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	streams := make([]string, 0, len(tenants))
+	streamTenant := make(map[string]string, len(tenants))
+	for _, tenant := range tenants {
+		stream := r.keys.stream(tenant)
+		streams = append(streams, stream)
+		streamTenant[stream] = tenant
+	}
+
+	data, err := r.xReadGroup(ctx, consumerId, streams)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao ler stream de pagamentos: %w", err)
+	}
+
+	var payments []*dtos.PaymentRequest
+	var errs []error
+	for _, stream := range data {
+		for _, message := range stream.Messages {
+			payment, err := parseStreamMessage(&message)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			payment.Tenant = streamTenant[stream.Stream]
+			payments = append(payments, payment)
+		}
+	}
+	return payments, errors.Join(errs...)
+}
+
+// xReadGroup lê até uma mensagem nova de cada stream pelo read group. Retorna
+// nil, nil quando o bloqueio expira sem mensagens ou quando precisou recriar
+// um read group perdido num failover.
+func (r *RedisRepository) xReadGroup(ctx context.Context, consumerId string, streams []string) ([]redis.XStream, error) {
+	if r.keys.cluster && len(streams) > 1 {
+		return r.xReadGroupEach(ctx, consumerId, streams)
+	}
+
+	args := make([]string, 0, 2*len(streams))
+	args = append(args, streams...)
+	for range streams {
+		args = append(args, ">")
+	}
+
+	data, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{Streams: args,
 		Group:    r.readGroup,
 		Consumer: consumerId,
 		Count:    1,
-		Block:    5 * time.Second,
+		Block:    r.ReadBlock,
 		NoAck:    false,
 	}).Result()
-	if err != nil {
-		if err == redis.Nil {
-			return nil, nil // Timeout, sem mensagens
+	if err == redis.Nil {
+		return nil, nil // Timeout, sem mensagens
+	}
+	if isNoGroup(err) {
+		return nil, r.recreateGroups(ctx, streams)
+	}
+	return data, err
+}
+
+// streamValues monta a entrada da stream. No formato binário o pagamento vai
+// inteiro no campo "p"; no JSON, em um campo por atributo.
+func (r *RedisRepository) streamValues(payment *dtos.PaymentRequest) map[string]any {
+	if r.encoding == EncodingBinary {
+		if data, ok := encodeStreamPayment(payment); ok {
+			return map[string]any{"p": data}
 		}
-		return nil, fmt.Errorf("Erro ao ler stream de pagamentos: %w", err)
 	}
+	return fieldStreamValues(payment)
+}
 
-	if len(data) == 0 || len(data[0].Messages) == 0 {
-		return nil, nil // Não leu nada
+func fieldStreamValues(payment *dtos.PaymentRequest) map[string]any {
+	values := map[string]any{
+		"correlationId": payment.CorrelationId,
+		"amount":        payment.Amount,
+		"requestedAt":   payment.RequestedAt.Format("2006-01-02T15:04:05.000Z"),
+	}
+	if payment.Currency != "" {
+		values["currency"] = payment.Currency
+	}
+	if payment.ClientId != "" {
+		values["clientId"] = payment.ClientId
 	}
+	if payment.CallbackUrl != "" {
+		values["callbackUrl"] = payment.CallbackUrl
+	}
+	return values
+}
 
-	message := data[0].Messages[0]
-	messageId := data[0].Messages[0].ID
+func parseStreamMessage(message *redis.XMessage) (*dtos.PaymentRequest, error) {
+	if data, ok := message.Values["p"].(string); ok {
+		payment, err := decodeStreamPayment([]byte(data))
+		if err != nil {
+			return nil, err
+		}
+		payment.RedisStreamId = message.ID
+		return payment, nil
+	}
 
+	var err error
 	correlationId, _ := message.Values["correlationId"].(string)
 	amount := 0.0
 	switch v := message.Values["amount"].(type) {
@@ -124,6 +422,12 @@ func (r *RedisRepository) ReadFromStream(ctx context.Context, consumerId string)
 		}
 	}
 	requestedAtStr, _ := message.Values["requestedAt"].(string)
+	clientId, _ := message.Values["clientId"].(string)
+	callbackUrl, _ := message.Values["callbackUrl"].(string)
+	currency, _ := message.Values["currency"].(string)
+	if currency == "" {
+		currency = dtos.DEFAULT_CURRENCY
+	}
 
 	requestedAt, err := time.Parse("2006-01-02T15:04:05.000Z", requestedAtStr)
 	if err != nil {
@@ -133,52 +437,144 @@ func (r *RedisRepository) ReadFromStream(ctx context.Context, consumerId string)
 	return &dtos.PaymentRequest{
 		CorrelationId: correlationId,
 		Amount:        amount,
-		RedisStreamId: messageId,
+		Currency:      currency,
+		RedisStreamId: message.ID,
 		RequestedAt:   requestedAt,
+		ClientId:      clientId,
+		CallbackUrl:   callbackUrl,
 	}, nil
 }
 
 func (r *RedisRepository) StoreProcessed(ctx context.Context, payment *dtos.ProcessedPayment, messageId string) error {
-	processedAt, err := time.Parse("2006-01-02T15:04:05.000Z", payment.ProcessedAt)
+	// O score é o requestedAt, o mesmo horário que os processadores usam nos
+	// seus sumários
+	requestedAt, err := payment.SummaryTime()
 	if err != nil {
 		return fmt.Errorf("Erro ao converter data: %w", err)
 	}
 
-	paymentData, err := json.Marshal(payment)
+	paymentData, err := encodeProcessed(r.encoding, r.recordedPayment(payment))
 	if err != nil {
-		return fmt.Errorf("Erro ao serializar pagamento: %w", err)
+		return err
 	}
 
-	pipe := r.client.TxPipeline()
+	event, err := marshalEvent(&dtos.PaymentEvent{
+		Type:          dtos.PAYMENT_EVENT_PROCESSED,
+		CorrelationId: payment.CorrelationId,
+		Amount:        payment.Amount,
+		Currency:      payment.Currency,
+		Processor:     payment.Api.String(),
+		At:            payment.ProcessedAt,
+	})
+	if err != nil {
+		return err
+	}
 
-	score := float64(processedAt.UnixMilli())
-	key := processedSetKey[processedSet(payment.Api)]
+	var delivery []byte
+	if payment.CallbackUrl != "" {
+		delivery, err = webhookDelivery(payment.CallbackUrl, &dtos.WebhookEvent{
+			Type:          dtos.WEBHOOK_PROCESSED,
+			CorrelationId: payment.CorrelationId,
+			Amount:        payment.Amount,
+			Currency:      payment.Currency,
+			Processor:     payment.Api.String(),
+			RequestedAt:   requestedAt.Format("2006-01-02T15:04:05.000Z"),
+			ClientId:      payment.ClientId,
+		})
+		if err != nil {
+			return err
+		}
+	}
 
-	pipe.ZAdd(ctx, key, redis.Z{
-		Score:  score,
-		Member: paymentData,
-	})
+	keys := []string{
+		r.keys.processed(payment.Tenant, payment.Api),
+		r.keys.status(payment.Tenant),
+		r.keys.stream(payment.Tenant),
+	}
+	if !r.keys.cluster {
+		keys = append(keys, r.intentsKey, r.keys.events(), r.keys.webhookStream())
+	}
 
-	err = r.AckMessage(ctx, messageId, &pipe)
+	fresh, err := completeScript.Run(ctx, r.client, keys,
+		paymentData, requestedAt.UnixMilli(), payment.CorrelationId,
+		processedStatus(payment.Api, requestedAt.UnixMilli()),
+		r.readGroup, messageId, payment.Tenant, event, eventsMaxLen, delivery,
+		intentField(payment.Tenant, payment.CorrelationId)).Int()
+	if err != nil {
+		return fmt.Errorf("Erro armazenar pagamento processado: %w", err)
+	}
+
+	if r.keys.cluster {
+		return r.finishShared(ctx, payment.Tenant, payment.CorrelationId, fresh == 1, event, delivery)
+	}
+	return nil
+}
+
+// DeadLetter move um pagamento que não pode ser processado para a stream de
+// dead-letter do tenant, junto com o ack.
+func (r *RedisRepository) DeadLetter(ctx context.Context, payment *dtos.PaymentRequest, reason string) error {
+	// A dead-letter é lida por gente, então fica sempre com um campo por atributo
+	values := fieldStreamValues(payment)
+	values["reason"] = reason
+
+	event, err := marshalEvent(&dtos.PaymentEvent{
+		Type:          dtos.PAYMENT_EVENT_FAILED,
+		CorrelationId: payment.CorrelationId,
+		Amount:        payment.Amount,
+		Currency:      payment.Currency,
+		Reason:        reason,
+		At:            time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+	})
 	if err != nil {
 		return err
 	}
 
-	_, err = pipe.Exec(ctx)
+	var delivery []byte
+	if payment.CallbackUrl != "" {
+		delivery, err = webhookDelivery(payment.CallbackUrl, &dtos.WebhookEvent{
+			Type:          dtos.WEBHOOK_FAILED,
+			CorrelationId: payment.CorrelationId,
+			Amount:        payment.Amount,
+			Currency:      payment.Currency,
+			RequestedAt:   payment.RequestedAt.Format("2006-01-02T15:04:05.000Z"),
+			Reason:        reason,
+			ClientId:      payment.ClientId,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	keys := []string{
+		r.keys.deadLetter(payment.Tenant),
+		r.keys.status(payment.Tenant),
+		r.keys.stream(payment.Tenant),
+	}
+	if !r.keys.cluster {
+		keys = append(keys, r.intentsKey, r.keys.events(), r.keys.webhookStream())
+	}
+
+	args := []any{payment.CorrelationId, r.readGroup, payment.RedisStreamId,
+		payment.Tenant, event, eventsMaxLen, delivery, intentField(payment.Tenant, payment.CorrelationId)}
+	fresh, err := deadLetterScript.Run(ctx, r.client, keys, fieldArgs(args, values)...).Int()
 	if err != nil {
-		return fmt.Errorf("Erro armazenar pagamento processado: %w", err)
+		return fmt.Errorf("Erro ao mover pagamento para dead-letter: %w", err)
 	}
 
+	if r.keys.cluster {
+		return r.finishShared(ctx, payment.Tenant, payment.CorrelationId, fresh == 1, event, delivery)
+	}
 	return nil
 }
 
-func (r *RedisRepository) AckMessage(ctx context.Context, messageId string, pipePtr *redis.Pipeliner) error {
+func (r *RedisRepository) AckMessage(ctx context.Context, tenant, messageId string, pipePtr *redis.Pipeliner) error {
+	stream := r.keys.stream(tenant)
 	if pipePtr != nil {
 		pipe := *pipePtr
-		pipe.XAck(ctx, r.streamKey, r.readGroup, messageId)
+		pipe.XAck(ctx, stream, r.readGroup, messageId)
 		return nil
 	} else {
-		err := r.client.XAck(ctx, r.streamKey, r.readGroup, messageId).Err()
+		err := r.client.XAck(ctx, stream, r.readGroup, messageId).Err()
 		if err != nil {
 			return fmt.Errorf("Erro ao dar ack no pagamento: %w", err)
 		}
@@ -186,44 +582,138 @@ func (r *RedisRepository) AckMessage(ctx context.Context, messageId string, pipe
 	return nil
 }
 
-func (r *RedisRepository) FlushDB(ctx context.Context) error {
-	err := r.client.FlushDB(ctx).Err()
+// GetStreamStats soma as streams de todos os tenants.
+func (r *RedisRepository) GetStreamStats(ctx context.Context) (*dtos.StreamStats, error) {
+	tenants, err := r.Tenants(ctx)
 	if err != nil {
-		return fmt.Errorf("Erro ao limpar todos os dados do Redis: %w", err)
+		return nil, err
 	}
-	return nil
-}
 
-func (r *RedisRepository) GetSummaryByDateRange(ctx context.Context, api dtos.PaymentAPI, from, to time.Time) (*dtos.APISummary, error) {
-	fromScore := from.UnixMilli()
-	toScore := to.UnixMilli()
+	stats := &dtos.StreamStats{}
+	for _, tenant := range tenants {
+		stream := r.keys.stream(tenant)
+		length, err := r.client.XLen(ctx, stream).Result()
+		if err != nil {
+			return nil, fmt.Errorf("Erro ao buscar tamanho da stream: %w", err)
+		}
+
+		groups, err := r.client.XInfoGroups(ctx, stream).Result()
+		if err != nil {
+			return nil, fmt.Errorf("Erro ao buscar informações do read group: %w", err)
+		}
+
+		stats.Length += length
+		for _, group := range groups {
+			if group.Name == r.readGroup {
+				stats.Pending += group.Pending
+				stats.Lag += group.Lag
+			}
+		}
+	}
+	return stats, nil
+}
 
-	key := processedSetKey[processedSet(api)]
+// GetProcessedByDateRange inclui os dois limites; datas zeradas deixam o
+// período aberto daquele lado.
+func (r *RedisRepository) GetProcessedByDateRange(ctx context.Context, tenant string, api dtos.PaymentAPI, from, to time.Time) ([]dtos.ProcessedPayment, error) {
+	min, max := scoreRange(from, to)
+	key := r.keys.processed(tenant, api)
 
 	results, err := r.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{
-		Min: fmt.Sprintf("%d", fromScore),
-		Max: fmt.Sprintf("%d", toScore),
+		Min: min,
+		Max: max,
 	}).Result()
 	if err != nil {
 		return nil, fmt.Errorf("Erro ao buscar pagamentos por data: %w", err)
 	}
 
-	totalAmount := 0.0
-	totalRequests := 0
+	payments := make([]dtos.ProcessedPayment, 0, len(results))
 	for _, result := range results {
-		var payment dtos.ProcessedPayment
-		if err := json.Unmarshal([]byte(result), &payment); err != nil {
+		payment, err := decodeProcessed([]byte(result))
+		if err != nil {
 			slog.Warn("Failed to unmarshall processed payment. Skipping")
 			continue // Pula entrada inválida
 		}
-		totalAmount += payment.Amount
-		totalRequests++
+		payments = append(payments, payment)
+	}
+	return payments, nil
+}
+
+// GetSummaryByDateRange retorna o sumário só da DEFAULT_CURRENCY; somar
+// valores de moedas diferentes não tem significado. As outras moedas estão
+// no GetSummaryByCurrency.
+func (r *RedisRepository) GetSummaryByDateRange(ctx context.Context, tenant string, api dtos.PaymentAPI, from, to time.Time) (*dtos.APISummary, error) {
+	byCurrency, err := r.GetSummaryByCurrency(ctx, tenant, api, from, to)
+	if err != nil {
+		return nil, err
 	}
+	if summary, ok := byCurrency[dtos.DEFAULT_CURRENCY]; ok {
+		return summary, nil
+	}
+	return &dtos.APISummary{}, nil
+}
 
-	totalAmount = math.Round(totalAmount*100) / 100
+func (r *RedisRepository) GetSummaryByCurrency(ctx context.Context, tenant string, api dtos.PaymentAPI, from, to time.Time) (map[string]*dtos.APISummary, error) {
+	summaries, _, err := r.GetProcessorSummary(ctx, tenant, api, from, to, false)
+	return summaries, err
+}
 
-	return &dtos.APISummary{
-		TotalRequests: totalRequests,
-		TotalAmount:   totalAmount,
-	}, nil
+// GetProcessorSummary agrupa o sumário do processador por moeda, somando em
+// unidades mínimas para não acumular erro de ponto flutuante, e calcula os
+// percentis de tempo na mesma leitura. Pagamentos já arquivados entram pelos
+// rollups, mas não nos percentis; um período que corta um bucket de rollup
+// retorna *UnalignedRangeError. Os percentis ordenam todos os pagamentos
+// do período, então só são calculados com withTiming; o TimingSummary é nil
+// sem ele ou se nenhum pagamento do período tiver os horários registrados.
+func (r *RedisRepository) GetProcessorSummary(ctx context.Context, tenant string, api dtos.PaymentAPI, from, to time.Time, withTiming bool) (map[string]*dtos.APISummary, *dtos.TimingSummary, error) {
+	payments, err := r.GetProcessedByDateRange(ctx, tenant, api, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	refunded, err := r.getRefundedByDateRange(ctx, tenant, api, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	rollups, err := r.getRollupsByDateRange(ctx, tenant, api, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	requests := make(map[string]int)
+	amounts := make(map[string]int64)
+	for _, payment := range payments {
+		currency := paymentCurrency(&payment)
+		requests[currency]++
+		amounts[currency] += dtos.ToMinor(currency, payment.Amount)
+	}
+	for currency, archived := range rollups {
+		requests[currency] += archived.requests
+		amounts[currency] += archived.amount
+		if archived.refunded != 0 {
+			refunded[currency] += archived.refunded
+		}
+	}
+
+	summaries := make(map[string]*dtos.APISummary)
+	for currency, count := range requests {
+		summaries[currency] = &dtos.APISummary{
+			TotalRequests: count,
+			TotalAmount:   dtos.FromMinor(currency, amounts[currency]),
+		}
+	}
+	for currency, minor := range refunded {
+		summary, ok := summaries[currency]
+		if !ok {
+			summary = &dtos.APISummary{}
+			summaries[currency] = summary
+		}
+		summary.TotalRefunded = dtos.FromMinor(currency, minor)
+	}
+	for currency, summary := range summaries {
+		summary.NetAmount = dtos.FromMinor(currency, amounts[currency]-refunded[currency])
+	}
+	if !withTiming {
+		return summaries, nil, nil
+	}
+	return summaries, summarizeTiming(payments), nil
 }
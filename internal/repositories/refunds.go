@@ -0,0 +1,408 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrPaymentNotFound = errors.New("pagamento não encontrado")
+	ErrRefundExceeds   = errors.New("valor excede o saldo reembolsável")
+	ErrInvalidAmount   = errors.New("valor inválido para a moeda")
+	ErrRefundDisabled  = errors.New("processador não aceita reembolsos")
+)
+
+// globEscaper protege o correlationId no MATCH do ZSCAN.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// requestRefundScript reserva o valor e enfileira o reembolso atomicamente,
+// para que dois pedidos simultâneos não reembolsem mais que o pagamento.
+// Valores na menor unidade da moeda.
+//
+// KEYS[1] = sorted set de processados, KEYS[2] = hash de reservas,
+// KEYS[3] = stream de reembolsos (opcional; no cluster o repositório faz o
+// XADD depois do script)
+// ARGV[1] = membro do pagamento, ARGV[2] = correlationId, ARGV[3] = valor
+// pedido (0 = saldo todo), ARGV[4] = valor original, ARGV[5] = tenant,
+// ARGV[6] = processador, ARGV[7] = requestedAt, ARGV[8] = moeda,
+// ARGV[9] = horário do pagamento original
+//
+// Retorna {refundId, valor, saldo restante}. Sem refundId, valor 0 indica que
+// o pagamento não existe mais e -1 que o pedido excede o saldo.
+var requestRefundScript = newLuaScript("request-refund", 3, `
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return {'', 0, 0}
+end
+
+local reserved = tonumber(redis.call('HGET', KEYS[2], ARGV[2]) or '0')
+local remaining = tonumber(ARGV[4]) - reserved
+local amount = tonumber(ARGV[3])
+if amount == 0 then
+	amount = remaining
+end
+if amount <= 0 or amount > remaining then
+	return {'', -1, remaining}
+end
+
+redis.call('HINCRBY', KEYS[2], ARGV[2], amount)
+local seq = redis.call('HINCRBY', KEYS[2], ARGV[2] .. ':seq', 1)
+local refundId = ARGV[2] .. '-r' .. seq
+if KEYS[3] then
+	redis.call('XADD', KEYS[3], '*',
+		'refundId', refundId, 'correlationId', ARGV[2], 'amount', amount,
+		'tenant', ARGV[5], 'paymentAPI', ARGV[6], 'requestedAt', ARGV[7],
+		'currency', ARGV[8], 'paymentRequestedAt', ARGV[9])
+end
+return {refundId, amount, remaining - amount}
+`)
+
+// SetRefundable liga os reembolsos do processador. A rota de reembolso não
+// faz parte da API dos processadores da Rinha, então fica desligada até a
+// configuração dizer que o processador a oferece.
+func (r *RedisRepository) SetRefundable(api dtos.PaymentAPI, enabled bool) {
+	r.refundable[api] = enabled
+}
+
+// findProcessed acha o membro do pagamento no sorted set do processador que o
+// recebeu, pelo score guardado no status. Status gravados antes do score
+// fazem o ZSCAN procurar o correlationId no sorted set.
+func (r *RedisRepository) findProcessed(ctx context.Context, tenant, correlationId string) (string, *dtos.ProcessedPayment, error) {
+	value, err := r.client.HGet(ctx, r.keys.status(tenant), correlationId).Result()
+	if err == redis.Nil {
+		return "", nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("Erro ao buscar pagamento: %w", err)
+	}
+	api, score, ok := parseProcessedStatus(value)
+	if !ok {
+		return "", nil, ErrPaymentNotFound
+	}
+
+	key := r.keys.processed(tenant, api)
+	var members []string
+	if score != "" {
+		members, err = r.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: score, Max: score}).Result()
+	} else {
+		members, err = r.scanMembers(ctx, key, "*"+globEscaper.Replace(correlationId)+"*")
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("Erro ao buscar pagamento: %w", err)
+	}
+
+	for _, member := range members {
+		payment, err := decodeProcessed([]byte(member))
+		if err == nil && payment.CorrelationId == correlationId {
+			return member, &payment, nil
+		}
+	}
+	return "", nil, ErrPaymentNotFound
+}
+
+func (r *RedisRepository) scanMembers(ctx context.Context, key, pattern string) ([]string, error) {
+	var members []string
+	var cursor uint64
+	for {
+		// ZSCAN devolve membro e score alternados
+		entries, next, err := r.client.ZScan(ctx, key, cursor, pattern, 500).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(entries); i += 2 {
+			members = append(members, entries[i])
+		}
+		cursor = next
+		if cursor == 0 {
+			return members, nil
+		}
+	}
+}
+
+// RequestRefund enfileira um reembolso de amount (zero para o saldo todo)
+// para o processador que recebeu o pagamento original.
+func (r *RedisRepository) RequestRefund(ctx context.Context, tenant, correlationId string, amount float64) (*dtos.RefundResponse, error) {
+	member, payment, err := r.findProcessed(ctx, tenant, correlationId)
+	if err != nil {
+		return nil, err
+	}
+	if !r.refundable[payment.Api] {
+		return nil, ErrRefundDisabled
+	}
+	currency := paymentCurrency(payment)
+	if amount != 0 && !dtos.ValidAmount(currency, amount) {
+		return nil, ErrInvalidAmount
+	}
+
+	keys := []string{r.keys.processed(tenant, payment.Api), r.keys.refunded(tenant)}
+	if !r.keys.cluster {
+		keys = append(keys, r.keys.refundStream())
+	}
+	paymentAt, err := payment.SummaryTime()
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao ler horário do pagamento: %w", err)
+	}
+	paymentRequestedAt := paymentAt.UTC().Format("2006-01-02T15:04:05.000Z")
+	requestedAt := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	result, err := requestRefundScript.Run(ctx, r.client, keys,
+		member, correlationId, dtos.ToMinor(currency, amount), dtos.ToMinor(currency, payment.Amount), tenant, int(payment.Api),
+		requestedAt, currency, paymentRequestedAt,
+	).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao enfileirar reembolso: %w", err)
+	}
+
+	refundId, _ := result[0].(string)
+	refundMinor, _ := result[1].(int64)
+	remainingMinor, _ := result[2].(int64)
+	switch {
+	case refundId == "" && refundMinor == 0:
+		return nil, ErrPaymentNotFound
+	case refundId == "":
+		return &dtos.RefundResponse{
+			CorrelationId: correlationId,
+			Currency:      currency,
+			Remaining:     dtos.FromMinor(currency, remainingMinor),
+		}, ErrRefundExceeds
+	}
+
+	if r.keys.cluster {
+		refund := &dtos.Refund{
+			RefundId:           refundId,
+			CorrelationId:      correlationId,
+			Amount:             dtos.FromMinor(currency, refundMinor),
+			Currency:           currency,
+			Tenant:             tenant,
+			Api:                payment.Api,
+			RequestedAt:        requestedAt,
+			PaymentRequestedAt: paymentRequestedAt,
+		}
+		if err := r.enqueueReservedRefund(ctx, refund, refundMinor); err != nil {
+			return nil, err
+		}
+	}
+
+	return &dtos.RefundResponse{
+		RefundId:      refundId,
+		CorrelationId: correlationId,
+		Amount:        dtos.FromMinor(currency, refundMinor),
+		Currency:      currency,
+		Processor:     payment.Api.String(),
+		Remaining:     dtos.FromMinor(currency, remainingMinor),
+	}, nil
+}
+
+// enqueueReservedRefund enfileira, no cluster, o reembolso que o script já
+// reservou. Se o XADD falhar a reserva é devolvida e o pedido pode ser
+// repetido; uma queda entre os dois deixa o valor reservado sem reembolso.
+func (r *RedisRepository) enqueueReservedRefund(ctx context.Context, refund *dtos.Refund, minor int64) error {
+	err := r.client.XAdd(ctx, &redis.XAddArgs{Stream: r.keys.refundStream(), Values: refundValues(refund)}).Err()
+	if err == nil {
+		return nil
+	}
+	if undoErr := r.client.HIncrBy(ctx, r.keys.refunded(refund.Tenant), refund.CorrelationId, -minor).Err(); undoErr != nil {
+		slog.Error("Erro ao devolver reserva de reembolso", "refundId", refund.RefundId, "err", undoErr)
+	}
+	return fmt.Errorf("Erro ao enfileirar reembolso: %w", err)
+}
+
+// ReadRefunds lê os reembolsos novos, ou com pending os que ficaram sem ack
+// com este consumidor (após uma queda).
+func (r *RedisRepository) ReadRefunds(ctx context.Context, consumerId string, pending bool) ([]*dtos.Refund, error) {
+	id := ">"
+	if pending {
+		id = "0"
+	}
+	data, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Streams:  []string{r.keys.refundStream(), id},
+		Group:    r.readGroup,
+		Consumer: consumerId,
+		Count:    10,
+		Block:    r.ReadBlock,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if isNoGroup(err) {
+		return nil, r.recreateGroups(ctx, []string{r.keys.refundStream()})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao ler stream de reembolsos: %w", err)
+	}
+
+	var refunds []*dtos.Refund
+	for _, stream := range data {
+		for _, message := range stream.Messages {
+			refund, err := parseRefundMessage(&message)
+			if err != nil {
+				slog.Warn("Failed to parse refund message. Skipping", "err", err)
+				r.client.XAck(ctx, r.keys.refundStream(), r.readGroup, message.ID)
+				continue
+			}
+			refunds = append(refunds, refund)
+		}
+	}
+	return refunds, nil
+}
+
+func parseRefundMessage(message *redis.XMessage) (*dtos.Refund, error) {
+	refund := &dtos.Refund{RedisStreamId: message.ID}
+	refund.RefundId, _ = message.Values["refundId"].(string)
+	refund.CorrelationId, _ = message.Values["correlationId"].(string)
+	refund.Tenant, _ = message.Values["tenant"].(string)
+	refund.RequestedAt, _ = message.Values["requestedAt"].(string)
+	refund.Currency, _ = message.Values["currency"].(string)
+	refund.PaymentRequestedAt, _ = message.Values["paymentRequestedAt"].(string)
+	if refund.Currency == "" {
+		refund.Currency = dtos.DEFAULT_CURRENCY
+	}
+
+	amountStr, _ := message.Values["amount"].(string)
+	minor, err := strconv.ParseInt(amountStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao converter valor do reembolso: %w", err)
+	}
+	refund.Amount = dtos.FromMinor(refund.Currency, minor)
+
+	apiStr, _ := message.Values["paymentAPI"].(string)
+	api, err := strconv.ParseUint(apiStr, 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao converter processador do reembolso: %w", err)
+	}
+	refund.Api = dtos.PaymentAPI(api)
+	return refund, nil
+}
+
+func refundValues(refund *dtos.Refund) map[string]any {
+	return map[string]any{
+		"refundId":           refund.RefundId,
+		"correlationId":      refund.CorrelationId,
+		"amount":             dtos.ToMinor(refund.Currency, refund.Amount),
+		"currency":           refund.Currency,
+		"tenant":             refund.Tenant,
+		"paymentAPI":         int(refund.Api),
+		"requestedAt":        refund.RequestedAt,
+		"paymentRequestedAt": refund.PaymentRequestedAt,
+	}
+}
+
+// StoreRefund registra o reembolso concluído e dá ack na mesma transação. O
+// score é o horário do pagamento original, o mesmo do sorted set de
+// processados, para o sumário de um período descontar só os reembolsos dos
+// pagamentos dele; o refundedAt fica no registro.
+func (r *RedisRepository) StoreRefund(ctx context.Context, refund *dtos.Refund) error {
+	refundedAt := time.Now().UTC()
+	refund.RefundedAt = refundedAt.Format("2006-01-02T15:04:05.000Z")
+	score := refundedAt
+	// Reembolsos enfileirados antes do campo ficam no horário em que concluíram
+	if paymentAt, err := time.Parse("2006-01-02T15:04:05.000Z", refund.PaymentRequestedAt); err == nil {
+		score = paymentAt
+	}
+
+	data, err := json.Marshal(refund)
+	if err != nil {
+		return fmt.Errorf("Erro ao serializar reembolso: %w", err)
+	}
+
+	err = r.execThen(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, r.keys.refunds(refund.Tenant, refund.Api), redis.Z{
+			Score:  float64(score.UnixMilli()),
+			Member: data,
+		})
+		return r.appendEvent(ctx, pipe, refund.Tenant, &dtos.PaymentEvent{
+			Type:          dtos.PAYMENT_EVENT_REFUNDED,
+			CorrelationId: refund.CorrelationId,
+			RefundId:      refund.RefundId,
+			Amount:        refund.Amount,
+			Currency:      refund.Currency,
+			Processor:     refund.Api.String(),
+			At:            refund.RefundedAt,
+		})
+	}, func(pipe redis.Pipeliner) {
+		pipe.XAck(ctx, r.keys.refundStream(), r.readGroup, refund.RedisStreamId)
+	})
+	if err != nil {
+		return fmt.Errorf("Erro ao armazenar reembolso: %w", err)
+	}
+	return nil
+}
+
+// FailRefund devolve o valor reservado ao saldo reembolsável do pagamento.
+func (r *RedisRepository) FailRefund(ctx context.Context, refund *dtos.Refund, reason string) error {
+	err := r.execThen(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, r.keys.refunded(refund.Tenant), refund.CorrelationId, -dtos.ToMinor(refund.Currency, refund.Amount))
+		return r.appendEvent(ctx, pipe, refund.Tenant, &dtos.PaymentEvent{
+			Type:          dtos.PAYMENT_EVENT_REFUND_FAILED,
+			CorrelationId: refund.CorrelationId,
+			RefundId:      refund.RefundId,
+			Amount:        refund.Amount,
+			Currency:      refund.Currency,
+			Processor:     refund.Api.String(),
+			Reason:        reason,
+			At:            time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		})
+	}, func(pipe redis.Pipeliner) {
+		pipe.XAck(ctx, r.keys.refundStream(), r.readGroup, refund.RedisStreamId)
+	})
+	if err != nil {
+		return fmt.Errorf("Erro ao registrar falha do reembolso: %w", err)
+	}
+	return nil
+}
+
+// RequeueRefund devolve o reembolso ao fim da fila com o mesmo refundId, que
+// o processador usa para não reembolsar duas vezes.
+func (r *RedisRepository) RequeueRefund(ctx context.Context, refund *dtos.Refund) error {
+	pipe := r.client.TxPipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{Stream: r.keys.refundStream(), Values: refundValues(refund)})
+	pipe.XAck(ctx, r.keys.refundStream(), r.readGroup, refund.RedisStreamId)
+
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("Erro ao reenfileirar reembolso: %w", err)
+	}
+	return nil
+}
+
+// getRefundedByDateRange soma por moeda, em unidades mínimas, os reembolsos
+// concluídos dos pagamentos do período.
+func (r *RedisRepository) getRefundedByDateRange(ctx context.Context, tenant string, api dtos.PaymentAPI, from, to time.Time) (map[string]int64, error) {
+	min, max := scoreRange(from, to)
+	results, err := r.client.ZRangeByScore(ctx, r.keys.refunds(tenant, api), &redis.ZRangeBy{
+		Min: min,
+		Max: max,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao buscar reembolsos por data: %w", err)
+	}
+
+	refunded := make(map[string]int64)
+	for _, result := range results {
+		var refund dtos.Refund
+		if err := json.Unmarshal([]byte(result), &refund); err != nil {
+			slog.Warn("Failed to unmarshall refund. Skipping")
+			continue
+		}
+		if refund.Currency == "" {
+			refund.Currency = dtos.DEFAULT_CURRENCY
+		}
+		refunded[refund.Currency] += dtos.ToMinor(refund.Currency, refund.Amount)
+	}
+	return refunded, nil
+}
+
+// Pagamentos gravados antes do campo currency são da moeda padrão.
+func paymentCurrency(payment *dtos.ProcessedPayment) string {
+	if payment.Currency == "" {
+		return dtos.DEFAULT_CURRENCY
+	}
+	return payment.Currency
+}
@@ -0,0 +1,403 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	RetentionLeaderKey = "retention:leader"
+	rollupBucket       = int64(time.Minute / time.Millisecond)
+)
+
+// Archiver guarda fora do Redis os pagamentos removidos pela retenção. Store
+// só deve retornar depois que os pagamentos estiverem duráveis; uma queda
+// entre o Store e a remoção faz o mesmo pagamento ser arquivado de novo.
+type Archiver interface {
+	Store(ctx context.Context, tenant string, api dtos.PaymentAPI, payments []dtos.ProcessedPayment) error
+	Close() error
+}
+
+// archiveScript remove os pagamentos arquivados e soma cada um ao rollup do
+// seu minuto, registrando o bucket no índice. Só conta quem o ZREM de fato
+// removeu, para um purge concorrente não deixar rollup de pagamento apagado.
+// O correlationId sai do set legado de recebidos e das reservas de
+// reembolso, que assim encolhem com a retenção; no hash de status fica só
+// "archived:<processador>", para a entrada continuar recusando o reenvio.
+//
+// KEYS[1] = sorted set de processados, KEYS[2] = hash de rollups,
+// KEYS[3] = set legado de recebidos, KEYS[4] = índice dos rollups,
+// KEYS[5] = hash de status, KEYS[6] = hash de reservas de reembolso
+// ARGV[1] = status dos arquivados, e depois em grupos de 5: membro,
+// correlationId, bucket ("<minuto>:<moeda>", vazio para membros inválidos),
+// valor em unidades mínimas e minuto.
+var archiveScript = newLuaScript("archive", 7, `
+local archived = 0
+for i = 2, #ARGV, 5 do
+	if redis.call('ZREM', KEYS[1], ARGV[i]) == 1 and ARGV[i+2] ~= '' then
+		redis.call('HINCRBY', KEYS[2], ARGV[i+2] .. ':n', 1)
+		redis.call('HINCRBY', KEYS[2], ARGV[i+2] .. ':amount', ARGV[i+3])
+		redis.call('ZADD', KEYS[4], ARGV[i+4], ARGV[i+2])
+		redis.call('SREM', KEYS[3], ARGV[i+1])
+		redis.call('HSET', KEYS[5], ARGV[i+1], ARGV[1])
+		redis.call('HDEL', KEYS[6], ARGV[i+1], ARGV[i+1] .. ':seq')
+		archived = archived + 1
+	end
+end
+return archived
+`)
+
+// ArchiveProcessed move para o archiver os pagamentos de api com horário
+// anterior a before, em blocos de até chunk. Pagamentos arquivados deixam de
+// aceitar reembolso, mas continuam sendo recusados como duplicatas.
+func (r *RedisRepository) ArchiveProcessed(ctx context.Context, tenant string, api dtos.PaymentAPI, before time.Time, chunk int64, archiver Archiver) (int64, error) {
+	key := r.keys.processed(tenant, api)
+	keys := []string{key, r.keys.rollups(tenant, api), r.keys.submitted(tenant), r.keys.rollupIndex(tenant, api), r.keys.status(tenant), r.keys.refunded(tenant)}
+	max := "(" + strconv.FormatInt(before.UnixMilli(), 10)
+
+	var total int64
+	for {
+		results, err := r.client.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   max,
+			Count: chunk,
+		}).Result()
+		if err != nil {
+			return total, fmt.Errorf("Erro ao ler pagamentos para arquivar: %w", err)
+		}
+		if len(results) == 0 {
+			return total, nil
+		}
+
+		payments := make([]dtos.ProcessedPayment, 0, len(results))
+		args := make([]any, 1, 1+len(results)*5)
+		args[0] = archivedStatus(api)
+		for _, result := range results {
+			member, _ := result.Member.(string)
+			payment, err := decodeProcessed([]byte(member))
+			if err != nil {
+				// Nunca entrou nos sumários; sai do Redis sem rollup
+				slog.Warn("Failed to unmarshall processed payment. Dropping from retention")
+				args = append(args, member, "", "", 0, 0)
+				continue
+			}
+			payments = append(payments, payment)
+
+			currency := paymentCurrency(&payment)
+			minute := int64(result.Score) / rollupBucket * rollupBucket
+			args = append(args, member, payment.CorrelationId,
+				strconv.FormatInt(minute, 10)+":"+currency, dtos.ToMinor(currency, payment.Amount), minute)
+		}
+
+		if len(payments) > 0 {
+			if err := archiver.Store(ctx, tenant, api, payments); err != nil {
+				return total, fmt.Errorf("Erro ao arquivar pagamentos: %w", err)
+			}
+		}
+
+		archived, err := archiveScript.Run(ctx, r.client, keys, args...).Int64()
+		if err != nil {
+			return total, fmt.Errorf("Erro ao remover pagamentos arquivados: %w", err)
+		}
+		total += archived
+
+		if int64(len(results)) < chunk {
+			return total, nil
+		}
+	}
+}
+
+// archiveRefundsScript remove os reembolsos anteriores ao corte e soma cada
+// um ao rollup do minuto do pagamento original, o mesmo bucket em que o
+// pagamento foi arquivado.
+//
+// KEYS[1] = sorted set de reembolsos, KEYS[2] = hash de rollups,
+// KEYS[3] = índice dos rollups
+// ARGV em grupos de 4: membro, bucket ("<minuto>:<moeda>", vazio para
+// membros inválidos), valor em unidades mínimas e minuto.
+var archiveRefundsScript = newLuaScript("archive-refunds", 1, `
+local archived = 0
+for i = 1, #ARGV, 4 do
+	if redis.call('ZREM', KEYS[1], ARGV[i]) == 1 and ARGV[i+1] ~= '' then
+		redis.call('HINCRBY', KEYS[2], ARGV[i+1] .. ':refunded', ARGV[i+2])
+		redis.call('ZADD', KEYS[3], ARGV[i+3], ARGV[i+1])
+		archived = archived + 1
+	end
+end
+return archived
+`)
+
+// ArchiveRefunds move para os rollups os reembolsos de pagamentos com horário
+// anterior a before, em blocos de até chunk, para o sumário de um período
+// arquivado continuar descontando-os.
+func (r *RedisRepository) ArchiveRefunds(ctx context.Context, tenant string, api dtos.PaymentAPI, before time.Time, chunk int64) (int64, error) {
+	key := r.keys.refunds(tenant, api)
+	keys := []string{key, r.keys.rollups(tenant, api), r.keys.rollupIndex(tenant, api)}
+	max := "(" + strconv.FormatInt(before.UnixMilli(), 10)
+
+	var total int64
+	for {
+		results, err := r.client.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   max,
+			Count: chunk,
+		}).Result()
+		if err != nil {
+			return total, fmt.Errorf("Erro ao ler reembolsos para arquivar: %w", err)
+		}
+		if len(results) == 0 {
+			return total, nil
+		}
+
+		args := make([]any, 0, len(results)*4)
+		for _, result := range results {
+			member, _ := result.Member.(string)
+			var refund dtos.Refund
+			if err := json.Unmarshal([]byte(member), &refund); err != nil {
+				slog.Warn("Failed to unmarshall refund. Dropping from retention")
+				args = append(args, member, "", 0, 0)
+				continue
+			}
+			if refund.Currency == "" {
+				refund.Currency = dtos.DEFAULT_CURRENCY
+			}
+			minute := int64(result.Score) / rollupBucket * rollupBucket
+			args = append(args, member, strconv.FormatInt(minute, 10)+":"+refund.Currency,
+				dtos.ToMinor(refund.Currency, refund.Amount), minute)
+		}
+
+		archived, err := archiveRefundsScript.Run(ctx, r.client, keys, args...).Int64()
+		if err != nil {
+			return total, fmt.Errorf("Erro ao remover reembolsos arquivados: %w", err)
+		}
+		total += archived
+
+		if int64(len(results)) < chunk {
+			return total, nil
+		}
+	}
+}
+
+type rollup struct {
+	requests int
+	amount   int64
+	refunded int64 // reembolsos dos pagamentos do bucket
+}
+
+// Os rollups por minuto mais antigos que a compactação viram rollups por
+// hora; dentro desse trecho a precisão do sumário é de uma hora. Cada nível
+// tem o hash com os totais ("<início>:<moeda>:n", ":amount" e ":refunded") e
+// o índice dos buckets por início.
+type rollupLevel struct {
+	width int64
+	hash  func(keyspace, string, dtos.PaymentAPI) string
+	index func(keyspace, string, dtos.PaymentAPI) string
+}
+
+var (
+	minuteRollups = rollupLevel{width: rollupBucket, hash: keyspace.rollups, index: keyspace.rollupIndex}
+	hourlyRollups = rollupLevel{width: int64(time.Hour / time.Millisecond), hash: keyspace.hourlyRollups, index: keyspace.hourlyRollupIndex}
+	rollupLevels  = []rollupLevel{minuteRollups, hourlyRollups}
+)
+
+// rollupEntry é um bucket de rollup que toca o período, com os totais lidos.
+type rollupEntry struct {
+	level    rollupLevel
+	bucket   string // "<início>:<moeda>"
+	start    int64
+	currency string
+	rollup
+}
+
+// rollupsInRange lê, pelo índice de cada nível, só os buckets que tocam o
+// período; datas zeradas deixam o período aberto daquele lado.
+func (r *RedisRepository) rollupsInRange(ctx context.Context, tenant string, api dtos.PaymentAPI, from, to time.Time) ([]rollupEntry, error) {
+	var entries []rollupEntry
+	for _, level := range rollupLevels {
+		min, max := "-inf", "+inf"
+		if !from.IsZero() {
+			min = strconv.FormatInt(from.UnixMilli()-level.width+1, 10)
+		}
+		if !to.IsZero() {
+			max = strconv.FormatInt(to.UnixMilli(), 10)
+		}
+		buckets, err := r.client.ZRangeByScoreWithScores(ctx, level.index(r.keys, tenant, api), &redis.ZRangeBy{Min: min, Max: max}).Result()
+		if err != nil {
+			return nil, fmt.Errorf("Erro ao buscar índice de rollups: %w", err)
+		}
+		if len(buckets) == 0 {
+			continue
+		}
+
+		fields := make([]string, 0, len(buckets)*2)
+		for _, bucket := range buckets {
+			member, _ := bucket.Member.(string)
+			fields = append(fields, member+":n", member+":amount", member+":refunded")
+		}
+		values, err := r.client.HMGet(ctx, level.hash(r.keys, tenant, api), fields...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("Erro ao buscar rollups: %w", err)
+		}
+
+		for i, bucket := range buckets {
+			member, _ := bucket.Member.(string)
+			_, currency, ok := strings.Cut(member, ":")
+			if !ok {
+				slog.Warn("Bucket de rollup inválido. Skipping", "bucket", member)
+				continue
+			}
+			entry := rollupEntry{level: level, bucket: member, start: int64(bucket.Score), currency: currency}
+			entry.requests = int(rollupValue(values[3*i]))
+			entry.amount = rollupValue(values[3*i+1])
+			entry.refunded = rollupValue(values[3*i+2])
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// UnalignedRangeError recusa um período que corta um bucket de rollup: o
+// trecho arquivado só tem totais por bucket, então contá-lo incluiria
+// pagamentos de fora do período.
+type UnalignedRangeError struct {
+	Width time.Duration // largura do maior bucket cortado
+}
+
+func (e *UnalignedRangeError) Error() string {
+	return fmt.Sprintf("período não alinhado aos rollups de %s do trecho arquivado", e.Width)
+}
+
+// checkAligned retorna um *UnalignedRangeError se algum bucket não estiver
+// inteiro dentro do período; to é inclusivo, como no ZRANGEBYSCORE.
+func checkAligned(entries []rollupEntry, from, to time.Time) error {
+	var width int64
+	for _, entry := range entries {
+		cut := (!from.IsZero() && entry.start < from.UnixMilli()) ||
+			(!to.IsZero() && entry.start+entry.level.width-1 > to.UnixMilli())
+		if cut {
+			width = max(width, entry.level.width)
+		}
+	}
+	if width > 0 {
+		return &UnalignedRangeError{Width: time.Duration(width) * time.Millisecond}
+	}
+	return nil
+}
+
+func rollupValue(value any) int64 {
+	s, _ := value.(string)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// getRollupsByDateRange soma, por moeda, os rollups do período, ou retorna um
+// *UnalignedRangeError se o período cortar algum bucket.
+func (r *RedisRepository) getRollupsByDateRange(ctx context.Context, tenant string, api dtos.PaymentAPI, from, to time.Time) (map[string]*rollup, error) {
+	entries, err := r.rollupsInRange(ctx, tenant, api, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAligned(entries, from, to); err != nil {
+		return nil, err
+	}
+
+	rollups := make(map[string]*rollup)
+	for _, entry := range entries {
+		sum, ok := rollups[entry.currency]
+		if !ok {
+			sum = &rollup{}
+			rollups[entry.currency] = sum
+		}
+		sum.requests += entry.requests
+		sum.amount += entry.amount
+		sum.refunded += entry.refunded
+	}
+	return rollups, nil
+}
+
+// compactScript soma buckets por minuto aos buckets por hora e os remove do
+// nível por minuto, atomicamente com o archiveScript.
+//
+// KEYS[1] = hash por minuto, KEYS[2] = índice por minuto, KEYS[3] = hash por
+// hora, KEYS[4] = índice por hora
+// ARGV em grupos de 3: bucket por minuto, bucket por hora e início da hora.
+var compactScript = newLuaScript("compact-rollups", 2, `
+local totals = {':n', ':amount', ':refunded'}
+local compacted = 0
+for i = 1, #ARGV, 3 do
+	for _, total in ipairs(totals) do
+		local value = redis.call('HGET', KEYS[1], ARGV[i] .. total)
+		if value then
+			redis.call('HINCRBY', KEYS[3], ARGV[i+1] .. total, value)
+			redis.call('HDEL', KEYS[1], ARGV[i] .. total)
+		end
+	end
+	redis.call('ZADD', KEYS[4], ARGV[i+2], ARGV[i+1])
+	compacted = compacted + redis.call('ZREM', KEYS[2], ARGV[i])
+end
+return compacted
+`)
+
+// CompactRollups junta em buckets por hora os buckets por minuto das horas
+// inteiras anteriores a before, em blocos de até chunk.
+func (r *RedisRepository) CompactRollups(ctx context.Context, tenant string, api dtos.PaymentAPI, before time.Time, chunk int64) (int64, error) {
+	index := minuteRollups.index(r.keys, tenant, api)
+	keys := []string{
+		minuteRollups.hash(r.keys, tenant, api), index,
+		hourlyRollups.hash(r.keys, tenant, api), hourlyRollups.index(r.keys, tenant, api),
+	}
+	cutoff := before.UnixMilli() / hourlyRollups.width * hourlyRollups.width
+	max := "(" + strconv.FormatInt(cutoff, 10)
+
+	var total int64
+	for {
+		buckets, err := r.client.ZRangeByScoreWithScores(ctx, index, &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   max,
+			Count: chunk,
+		}).Result()
+		if err != nil {
+			return total, fmt.Errorf("Erro ao ler rollups para compactar: %w", err)
+		}
+		if len(buckets) == 0 {
+			return total, nil
+		}
+
+		args := make([]any, 0, len(buckets)*3)
+		for _, bucket := range buckets {
+			member, _ := bucket.Member.(string)
+			_, currency, _ := strings.Cut(member, ":")
+			hour := int64(bucket.Score) / hourlyRollups.width * hourlyRollups.width
+			args = append(args, member, strconv.FormatInt(hour, 10)+":"+currency, hour)
+		}
+		compacted, err := compactScript.Run(ctx, r.client, keys, args...).Int64()
+		if err != nil {
+			return total, fmt.Errorf("Erro ao compactar rollups: %w", err)
+		}
+		total += compacted
+
+		if int64(len(buckets)) < chunk {
+			return total, nil
+		}
+	}
+}
+
+func parseRollupField(field string) (int64, string, string, bool) {
+	parts := strings.Split(field, ":")
+	if len(parts) != 3 {
+		return 0, "", "", false
+	}
+	minute, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", "", false
+	}
+	return minute, parts[1], parts[2], true
+}
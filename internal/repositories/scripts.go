@@ -0,0 +1,186 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lckrugel/rinha-backend-25/internal/chaos"
+	"github.com/redis/go-redis/v9"
+)
+
+// Todos os scripts Lua do repositório passam por este registro. O nome e a
+// versão entram no fonte, então mudar o corpo de um script exige subir a
+// versão, e o SHA novo nunca esbarra no corpo antigo em cache no Redis.
+//
+// Run usa EVALSHA e, se o Redis responder NOSCRIPT (reinício, SCRIPT FLUSH,
+// failover), repete com EVAL, que também deixa o script em cache.
+
+type luaScript struct {
+	name    string
+	version int
+	*redis.Script
+}
+
+var scripts []*luaScript
+
+func newLuaScript(name string, version int, src string) *luaScript {
+	for _, s := range scripts {
+		if s.name == name {
+			panic("script Lua registrado duas vezes: " + name)
+		}
+	}
+	s := &luaScript{
+		name:    name,
+		version: version,
+		Script:  redis.NewScript(fmt.Sprintf("-- %s v%d\n%s", name, version, src)),
+	}
+	scripts = append(scripts, s)
+	return s
+}
+
+// Run é o Run do go-redis com o ponto de chaos "redis:script:<nome>", já que
+// o hook só enxerga um EVALSHA sem nome.
+func (s *luaScript) Run(ctx context.Context, c redis.Scripter, keys []string, args ...any) *redis.Cmd {
+	if err := chaos.Inject(ctx, chaos.POINT_REDIS+"script:"+s.name); err != nil {
+		cmd := redis.NewCmd(ctx)
+		cmd.SetErr(err)
+		return cmd
+	}
+	return s.Script.Run(ctx, c, keys, args...)
+}
+
+// LoadScripts faz SCRIPT LOAD de todos os scripts, para a primeira chamada de
+// cada um já sair com EVALSHA e para os pipelines, que não têm o fallback
+// para EVAL, encontrarem os scripts em cache.
+func (r *RedisRepository) LoadScripts(ctx context.Context) ([]string, error) {
+	loaded := make([]string, 0, len(scripts))
+	for _, s := range scripts {
+		if err := s.Load(ctx, r.client).Err(); err != nil {
+			return loaded, fmt.Errorf("Erro ao carregar script %s: %w", s.name, err)
+		}
+		loaded = append(loaded, fmt.Sprintf("%s@v%d", s.name, s.version))
+	}
+	return loaded, nil
+}
+
+func isNoScript(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT")
+}
+
+// Os scripts de pagamento recebem primeiro as chaves do tenant, que no
+// cluster ficam no mesmo slot, e depois as compartilhadas (feed de eventos,
+// webhooks, intenções), que ficam em outros slots. No cluster as
+// compartilhadas não são passadas e o repositório as escreve fora do script
+// (ver sharedEffects).
+
+// intakeScript enfileira um pagamento se o correlationId ainda não foi
+// recebido, ou se foi para a dead-letter: marca o status como queued,
+// adiciona à stream e publica o evento no feed. Retorna 0 para duplicatas,
+// sem escrever nada.
+//
+// KEYS[1] = hash de status, KEYS[2] = set legado de recebidos,
+// KEYS[3] = stream de pagamentos, KEYS[4] = feed de eventos (opcional)
+// ARGV[1] = correlationId, ARGV[2] = tenant, ARGV[3] = evento,
+// ARGV[4] = tamanho máximo do feed, ARGV[5..] = campos da entrada da stream
+var intakeScript = newLuaScript("intake", 3, `
+local status = redis.call('HGET', KEYS[1], ARGV[1])
+if status and status ~= 'failed' then
+	return 0
+end
+if not status and redis.call('SISMEMBER', KEYS[2], ARGV[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], 'queued')
+redis.call('XADD', KEYS[3], '*', unpack(ARGV, 5))
+if KEYS[4] then
+	redis.call('XADD', KEYS[4], 'MAXLEN', '~', ARGV[4], '*', 'tenant', ARGV[2], 'event', ARGV[3])
+end
+return 1
+`)
+
+// completeScript registra o pagamento processado: membro no sorted set,
+// status, ack da stream, fim da intenção, evento e webhook. Um
+// correlationId que já consta como processado ou arquivado (o reconciliador
+// repetindo um StoreProcessed que chegou a gravar) só recebe o ack e
+// retorna 0.
+//
+// KEYS[1] = sorted set de processados, KEYS[2] = hash de status,
+// KEYS[3] = stream de pagamentos, KEYS[4] = intenções da instância,
+// KEYS[5] = feed de eventos, KEYS[6] = stream de webhooks (as três últimas
+// opcionais)
+// ARGV[1] = membro, ARGV[2] = score, ARGV[3] = correlationId,
+// ARGV[4] = status ("processed:<processador>:<score>"), ARGV[5] = read group, ARGV[6] = id da mensagem (vazio
+// para pagamentos reconciliados sem mensagem), ARGV[7] = tenant,
+// ARGV[8] = evento, ARGV[9] = tamanho máximo do feed, ARGV[10] = entrega de
+// webhook (vazio sem callback), ARGV[11] = campo da intenção
+var completeScript = newLuaScript("complete", 5, `
+local status = redis.call('HGET', KEYS[2], ARGV[3])
+local fresh = not status or (string.sub(status, 1, 9) ~= 'processed' and string.sub(status, 1, 8) ~= 'archived')
+if fresh then
+	redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+	redis.call('HSET', KEYS[2], ARGV[3], ARGV[4])
+end
+if ARGV[6] ~= '' then
+	redis.call('XACK', KEYS[3], ARGV[5], ARGV[6])
+end
+if KEYS[4] then
+	redis.call('HDEL', KEYS[4], ARGV[11])
+	if fresh then
+		redis.call('XADD', KEYS[5], 'MAXLEN', '~', ARGV[9], '*', 'tenant', ARGV[7], 'event', ARGV[8])
+		if ARGV[10] ~= '' then
+			redis.call('XADD', KEYS[6], '*', 'delivery', ARGV[10])
+		end
+	end
+end
+if fresh then
+	return 1
+end
+return 0
+`)
+
+// deadLetterScript move o pagamento para a dead-letter com o motivo, marca o
+// status como failed, dá ack e publica o evento e o webhook. Se outra entrega
+// do mesmo correlationId já o processou (ou ele já foi arquivado), o status
+// fica e nada é publicado; o script retorna 0.
+//
+// KEYS[1] = dead-letter, KEYS[2] = hash de status, KEYS[3] = stream de
+// pagamentos, KEYS[4] = intenções da instância, KEYS[5] = feed de eventos,
+// KEYS[6] = stream de webhooks (as três últimas opcionais)
+// ARGV[1] = correlationId, ARGV[2] = read group, ARGV[3] = id da mensagem,
+// ARGV[4] = tenant, ARGV[5] = evento, ARGV[6] = tamanho máximo do feed,
+// ARGV[7] = entrega de webhook (vazio sem callback), ARGV[8] = campo da
+// intenção, ARGV[9..] = campos da entrada da dead-letter
+var deadLetterScript = newLuaScript("dead-letter", 5, `
+redis.call('XADD', KEYS[1], '*', unpack(ARGV, 9))
+local status = redis.call('HGET', KEYS[2], ARGV[1])
+local fresh = not status or (string.sub(status, 1, 9) ~= 'processed' and string.sub(status, 1, 8) ~= 'archived')
+if fresh then
+	redis.call('HSET', KEYS[2], ARGV[1], 'failed')
+end
+if ARGV[3] ~= '' then
+	redis.call('XACK', KEYS[3], ARGV[2], ARGV[3])
+end
+if KEYS[4] then
+	redis.call('HDEL', KEYS[4], ARGV[8])
+	if fresh then
+		redis.call('XADD', KEYS[5], 'MAXLEN', '~', ARGV[6], '*', 'tenant', ARGV[4], 'event', ARGV[5])
+		if ARGV[7] ~= '' then
+			redis.call('XADD', KEYS[6], '*', 'delivery', ARGV[7])
+		end
+	end
+end
+if fresh then
+	return 1
+end
+return 0
+`)
+
+// fieldArgs achata os campos de uma entrada de stream em pares para o XADD
+// dentro dos scripts.
+func fieldArgs(args []any, values map[string]any) []any {
+	for field, value := range values {
+		args = append(args, field, value)
+	}
+	return args
+}
@@ -0,0 +1,59 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrDuplicatePayment = errors.New("pagamento já recebido")
+
+// GetPaymentStatus retorna a situação do pagamento, ou ErrPaymentNotFound se
+// o correlationId nunca foi recebido. Pagamentos recebidos antes do hash de
+// status só aparecem depois de processados ou de irem para a dead-letter.
+func (r *RedisRepository) GetPaymentStatus(ctx context.Context, tenant, correlationId string) (*dtos.PaymentStatus, error) {
+	value, err := r.client.HGet(ctx, r.keys.status(tenant), correlationId).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao buscar status do pagamento: %w", err)
+	}
+
+	status, rest, _ := strings.Cut(value, ":")
+	processor, _, _ := strings.Cut(rest, ":")
+	return &dtos.PaymentStatus{
+		CorrelationId: correlationId,
+		Status:        status,
+		Processor:     processor,
+	}, nil
+}
+
+// processedStatus guarda, além do processador, o score do pagamento no
+// sorted set, para o reembolso achar o membro sem um índice à parte.
+func processedStatus(api dtos.PaymentAPI, score int64) string {
+	return dtos.PAYMENT_STATUS_PROCESSED + ":" + api.String() + ":" + strconv.FormatInt(score, 10)
+}
+
+// archivedStatus é o que a retenção deixa no hash de status: sem o score, que
+// não aponta mais para nada.
+func archivedStatus(api dtos.PaymentAPI) string {
+	return dtos.PAYMENT_STATUS_ARCHIVED + ":" + api.String()
+}
+
+// parseProcessedStatus retorna o processador e o score de um status
+// "processed"; o score vem vazio nos status gravados antes dele.
+func parseProcessedStatus(value string) (dtos.PaymentAPI, string, bool) {
+	status, rest, _ := strings.Cut(value, ":")
+	if status != dtos.PAYMENT_STATUS_PROCESSED {
+		return 0, "", false
+	}
+	processor, score, _ := strings.Cut(rest, ":")
+	api, ok := dtos.ParsePaymentAPI(processor)
+	return api, score, ok
+}
@@ -0,0 +1,69 @@
+package repositories
+
+import (
+	"math"
+	"slices"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+)
+
+// SetRecordTiming grava dispatchedAt, attempts e latencyMs em cada pagamento
+// processado. Desligado, o registro fica só com o requestedAt e o
+// processedAt, que já bastam para o sumário.
+func (r *RedisRepository) SetRecordTiming(enabled bool) {
+	r.recordTiming = enabled
+}
+
+// recordedPayment é o pagamento como vai para o sorted set.
+func (r *RedisRepository) recordedPayment(payment *dtos.ProcessedPayment) *dtos.ProcessedPayment {
+	if r.recordTiming {
+		return payment
+	}
+	stripped := *payment
+	stripped.DispatchedAt = ""
+	stripped.Attempts = 0
+	stripped.LatencyMs = 0
+	return &stripped
+}
+
+func summarizeTiming(payments []dtos.ProcessedPayment) *dtos.TimingSummary {
+	var queueWait, processing []float64
+	for _, payment := range payments {
+		if payment.RequestedAt == "" || payment.DispatchedAt == "" {
+			continue // gravado antes dos campos de tempo, ou sem despacho conhecido
+		}
+		requestedAt, err1 := time.Parse("2006-01-02T15:04:05.000Z", payment.RequestedAt)
+		dispatchedAt, err2 := time.Parse("2006-01-02T15:04:05.000Z", payment.DispatchedAt)
+		processedAt, err3 := time.Parse("2006-01-02T15:04:05.000Z", payment.ProcessedAt)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		queueWait = append(queueWait, float64(dispatchedAt.Sub(requestedAt).Milliseconds()))
+		processing = append(processing, float64(processedAt.Sub(dispatchedAt).Milliseconds()))
+	}
+
+	if len(queueWait) == 0 {
+		return nil
+	}
+	return &dtos.TimingSummary{
+		Samples:      len(queueWait),
+		QueueWaitMs:  percentiles(queueWait),
+		ProcessingMs: percentiles(processing),
+	}
+}
+
+// percentiles usa o método nearest-rank; ordena values.
+func percentiles(values []float64) dtos.Percentiles {
+	slices.Sort(values)
+	at := func(p float64) float64 {
+		rank := int(math.Ceil(p * float64(len(values))))
+		return values[max(rank-1, 0)]
+	}
+	return dtos.Percentiles{
+		P50: at(0.50),
+		P90: at(0.90),
+		P99: at(0.99),
+		Max: values[len(values)-1],
+	}
+}
@@ -0,0 +1,60 @@
+package repositories
+
+import (
+	"testing"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+)
+
+func TestPercentiles(t *testing.T) {
+	hundred := make([]float64, 100)
+	for i := range hundred {
+		hundred[i] = float64(100 - i)
+	}
+
+	tests := []struct {
+		name   string
+		values []float64
+		want   dtos.Percentiles
+	}{
+		{"um valor", []float64{7}, dtos.Percentiles{P50: 7, P90: 7, P99: 7, Max: 7}},
+		{"dois valores", []float64{1, 2}, dtos.Percentiles{P50: 1, P90: 2, P99: 2, Max: 2}},
+		{"fora de ordem", []float64{3, 1, 2}, dtos.Percentiles{P50: 2, P90: 3, P99: 3, Max: 3}},
+		{"dez valores", []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, dtos.Percentiles{P50: 5, P90: 9, P99: 10, Max: 10}},
+		{"cem valores", hundred, dtos.Percentiles{P50: 50, P90: 90, P99: 99, Max: 100}},
+		{"repetidos", []float64{4, 4, 4, 0}, dtos.Percentiles{P50: 4, P90: 4, P99: 4, Max: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentiles(tt.values); got != tt.want {
+				t.Errorf("percentiles = %+v, esperava %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarizeTiming(t *testing.T) {
+	complete := dtos.ProcessedPayment{
+		RequestedAt:  "2025-07-15T12:00:00.000Z",
+		DispatchedAt: "2025-07-15T12:00:00.040Z",
+		ProcessedAt:  "2025-07-15T12:00:00.100Z",
+	}
+	payments := []dtos.ProcessedPayment{
+		complete,
+		{ProcessedAt: "2025-07-15T12:00:00.100Z"},                                          // legado
+		{RequestedAt: "2025-07-15T12:00:00.000Z", ProcessedAt: "2025-07-15T12:00:00.100Z"}, // sem despacho
+		{RequestedAt: "2025-07-15T12:00:00Z", DispatchedAt: "2025-07-15T12:00:00.040Z", ProcessedAt: "2025-07-15T12:00:00.100Z"},
+	}
+
+	got := summarizeTiming(payments)
+	if got == nil || got.Samples != 1 {
+		t.Fatalf("esperava uma amostra, obteve %+v", got)
+	}
+	if got.QueueWaitMs.Max != 40 || got.ProcessingMs.Max != 60 {
+		t.Errorf("esperava espera de 40ms e processamento de 60ms, obteve %+v", got)
+	}
+
+	if got := summarizeTiming(payments[1:]); got != nil {
+		t.Errorf("sem amostras completas esperava nil, obteve %+v", got)
+	}
+}
@@ -0,0 +1,135 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/redis/go-redis/v9"
+)
+
+// Os webhooks usam o mesmo esquema dos pagamentos: uma stream lida pelo read
+// group. As retries esperam num sorted set pontuado pelo horário da próxima
+// tentativa até voltarem para a stream.
+
+const webhookLogMaxLen = 10000
+
+// webhookDelivery serializa a entrega que os scripts de conclusão e de
+// dead-letter põem no campo "delivery" da stream de webhooks.
+func webhookDelivery(url string, event *dtos.WebhookEvent) ([]byte, error) {
+	event.Id = event.CorrelationId + ":" + event.Type
+
+	data, err := json.Marshal(&dtos.WebhookDelivery{Event: *event, Url: url})
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao serializar webhook: %w", err)
+	}
+	return data, nil
+}
+
+// ReadWebhooks retorna as entregas junto com o id da mensagem na stream.
+func (r *RedisRepository) ReadWebhooks(ctx context.Context, consumerId string) (map[string]*dtos.WebhookDelivery, error) {
+	data, err := r.xReadGroup(ctx, consumerId, []string{r.keys.webhookStream()})
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao ler stream de webhooks: %w", err)
+	}
+
+	deliveries := make(map[string]*dtos.WebhookDelivery)
+	for _, stream := range data {
+		for _, message := range stream.Messages {
+			raw, _ := message.Values["delivery"].(string)
+			var delivery dtos.WebhookDelivery
+			if err := json.Unmarshal([]byte(raw), &delivery); err != nil {
+				slog.Warn("Failed to unmarshall webhook delivery. Skipping")
+				r.client.XAck(ctx, r.keys.webhookStream(), r.readGroup, message.ID)
+				continue
+			}
+			deliveries[message.ID] = &delivery
+		}
+	}
+	return deliveries, nil
+}
+
+func (r *RedisRepository) AckWebhook(ctx context.Context, messageId string) error {
+	err := r.client.XAck(ctx, r.keys.webhookStream(), r.readGroup, messageId).Err()
+	if err != nil {
+		return fmt.Errorf("Erro ao dar ack no webhook: %w", err)
+	}
+	return nil
+}
+
+// ScheduleWebhookRetry agenda a próxima tentativa e dá ack na atual.
+func (r *RedisRepository) ScheduleWebhookRetry(ctx context.Context, messageId string, delivery *dtos.WebhookDelivery, at time.Time) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("Erro ao serializar webhook: %w", err)
+	}
+
+	pipe := r.client.TxPipeline()
+	pipe.ZAdd(ctx, r.keys.webhookRetries(), redis.Z{Score: float64(at.UnixMilli()), Member: data})
+	pipe.XAck(ctx, r.keys.webhookStream(), r.readGroup, messageId)
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("Erro ao agendar retry do webhook: %w", err)
+	}
+	return nil
+}
+
+// Move as retries vencidas de volta para a stream atomicamente, para que duas
+// instâncias não reenfileirem a mesma entrega.
+var moveDueWebhooksScript = newLuaScript("move-due-webhooks", 1, `
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, 100)
+for _, delivery in ipairs(due) do
+	redis.call("ZREM", KEYS[1], delivery)
+	redis.call("XADD", KEYS[2], "*", "delivery", delivery)
+end
+return #due
+`)
+
+func (r *RedisRepository) MoveDueWebhooks(ctx context.Context, now time.Time) (int, error) {
+	moved, err := moveDueWebhooksScript.Run(ctx, r.client,
+		[]string{r.keys.webhookRetries(), r.keys.webhookStream()}, now.UnixMilli()).Int()
+	if err != nil {
+		return 0, fmt.Errorf("Erro ao reenfileirar retries de webhook: %w", err)
+	}
+	return moved, nil
+}
+
+func (r *RedisRepository) LogWebhook(ctx context.Context, entry *dtos.WebhookLogEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("Erro ao serializar log de webhook: %w", err)
+	}
+
+	err = r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: r.keys.webhookLog(),
+		MaxLen: webhookLogMaxLen,
+		Approx: true,
+		Values: map[string]any{"entry": data},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("Erro ao registrar log de webhook: %w", err)
+	}
+	return nil
+}
+
+// GetWebhookLog retorna as entradas mais recentes primeiro.
+func (r *RedisRepository) GetWebhookLog(ctx context.Context, count int64) ([]dtos.WebhookLogEntry, error) {
+	messages, err := r.client.XRevRangeN(ctx, r.keys.webhookLog(), "+", "-", count).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao buscar log de webhooks: %w", err)
+	}
+
+	entries := make([]dtos.WebhookLogEntry, 0, len(messages))
+	for _, message := range messages {
+		raw, _ := message.Values["entry"].(string)
+		var entry dtos.WebhookLogEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,53 @@
+package workers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+)
+
+// BacklogMonitor apara as streams periodicamente e mantém atualizado o
+// backlog que o intake usa para recusar pagamentos acima de MAX_BACKLOG.
+// Toda instância roda o seu; o XTRIM MINID é seguro em paralelo.
+type BacklogMonitor struct {
+	redisRepo  *repositories.RedisRepository
+	maxBacklog int64
+}
+
+func NewBacklogMonitor(redisRepo *repositories.RedisRepository, maxBacklog int64) *BacklogMonitor {
+	return &BacklogMonitor{
+		redisRepo:  redisRepo,
+		maxBacklog: maxBacklog,
+	}
+}
+
+func (m *BacklogMonitor) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	full := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			backlog, err := m.redisRepo.TrimStreams(ctx)
+			if err != nil {
+				slog.Error("Erro ao aparar streams", "err", err)
+				continue
+			}
+
+			// Loga só as transições para não repetir a cada ciclo
+			if m.maxBacklog > 0 && full != (backlog >= m.maxBacklog) {
+				full = !full
+				if full {
+					slog.Warn("Backlog cheio, recusando novos pagamentos", "backlog", backlog, "max", m.maxBacklog)
+				} else {
+					slog.Info("Backlog abaixo do limite, aceitando pagamentos", "backlog", backlog, "max", m.maxBacklog)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrCallbackNotAllowed = errors.New("destino de webhook não permitido")
+
+// O callbackUrl vem do cliente, então sem restrição um webhook alcançaria o
+// Redis, a API administrativa ou a rede interna. Com WEBHOOK_ALLOWED_HOSTS só
+// os hosts da lista recebem webhooks; sem a lista, só endereços públicos. O
+// endereço é conferido no recebimento e de novo na conexão, que é quem vale
+// contra um DNS que muda de resposta entre os dois.
+var callbackHosts struct {
+	sync.RWMutex
+	allowed map[string]bool
+}
+
+// SetAllowedCallbackHosts troca a lista de hosts que recebem webhooks. Uma
+// lista vazia volta a aceitar qualquer endereço público.
+func SetAllowedCallbackHosts(hosts []string) {
+	allowed := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			allowed[host] = true
+		}
+	}
+
+	callbackHosts.Lock()
+	callbackHosts.allowed = allowed
+	callbackHosts.Unlock()
+}
+
+// allowlisted retorna se há uma lista e se o host está nela.
+func allowlisted(host string) (bool, bool) {
+	callbackHosts.RLock()
+	defer callbackHosts.RUnlock()
+	if len(callbackHosts.allowed) == 0 {
+		return false, false
+	}
+	return true, callbackHosts.allowed[strings.ToLower(host)]
+}
+
+// CheckCallbackUrl aceita vazio (sem webhook) ou uma URL http(s) absoluta
+// cujo host está na lista ou resolve só para endereços públicos.
+func CheckCallbackUrl(ctx context.Context, callbackUrl string) error {
+	if callbackUrl == "" {
+		return nil
+	}
+	u, err := url.Parse(callbackUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("callbackUrl inválido: %q", callbackUrl)
+	}
+
+	host := u.Hostname()
+	if enabled, ok := allowlisted(host); enabled {
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrCallbackNotAllowed, host)
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("Erro ao resolver host do webhook: %w", err)
+	}
+	for _, addr := range addrs {
+		if !publicAddr(addr) {
+			return fmt.Errorf("%w: %s resolve para %s", ErrCallbackNotAllowed, host, addr)
+		}
+	}
+	return nil
+}
+
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !addr.IsLoopback() &&
+		!addr.IsLinkLocalUnicast() && !addr.IsUnspecified()
+}
+
+// dialControl recusa a conexão com endereços internos quando não há lista de
+// hosts; com a lista o host já foi conferido pelo nome.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	callbackHosts.RLock()
+	enabled := len(callbackHosts.allowed) > 0
+	callbackHosts.RUnlock()
+	if enabled {
+		return nil
+	}
+
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrCallbackNotAllowed, address)
+	}
+	if !publicAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrCallbackNotAllowed, address)
+	}
+	return nil
+}
+
+// newWebhookClient não usa proxy e confere cada redirecionamento como um
+// callbackUrl novo.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: dialControl}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConnsPerHost: 10,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("Redirecionamentos demais")
+			}
+			return CheckCallbackUrl(req.Context(), req.URL.String())
+		},
+	}
+}
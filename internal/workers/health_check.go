@@ -8,17 +8,36 @@ import (
 	"time"
 
 	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
 )
 
+// Uma checagem nunca passa do TTL do lock: healthCheckTimeout mais o intervalo
+// ficam abaixo de healthLeaderTTL, então o líder renova o lock antes de ele
+// expirar e nenhuma outra instância vira líder com uma checagem em andamento.
+const (
+	healthCheckInterval = 5 * time.Second
+	healthCheckTimeout  = 8 * time.Second
+	healthLeaderTTL     = 15 * time.Second
+)
+
+// HealthCheckWorker consulta a saúde dos processadores. Como os processadores
+// aceitam uma checagem a cada 5s, apenas a instância que detém o lock de
+// liderança no Redis faz as chamadas e publica o resultado. As demais recebem a
+// decisão pelo StateSync e releem o estado publicado a cada ciclo, o que cobre
+// eventos perdidos. Sem Redis, cada instância volta a checar por conta própria.
 type HealthCheckWorker struct {
-	bias     int
-	selector *ServiceSelector
+	bias       int
+	selector   *ServiceSelector
+	redisRepo  *repositories.RedisRepository
+	instanceId string
 }
 
-func NewHealthCheckWorker(selector *ServiceSelector, bias int) *HealthCheckWorker {
+func NewHealthCheckWorker(selector *ServiceSelector, redisRepo *repositories.RedisRepository, instanceId string, bias int) *HealthCheckWorker {
 	return &HealthCheckWorker{
-		bias:     bias,
-		selector: selector,
+		bias:       bias,
+		selector:   selector,
+		redisRepo:  redisRepo,
+		instanceId: instanceId,
 	}
 }
 
@@ -29,19 +48,78 @@ func (hc *HealthCheckWorker) Start(ctx context.Context) {
 
 			return
 		default:
-			time.Sleep(time.Second * 5) // Espera 5s entre checagens
-			healthCheckCtx, cancel := context.WithTimeout(ctx, 90*time.Second)
-			defer cancel()
-
-			err := hc.chooseService(healthCheckCtx)
-			if err != nil {
-				slog.Error("Erro ao escolher o serviço", "err", err)
-			}
+			time.Sleep(healthCheckInterval) // Espera 5s entre checagens
+			healthCheckCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			hc.tick(healthCheckCtx)
+			cancel()
+		}
+	}
+}
+
+func (hc *HealthCheckWorker) tick(ctx context.Context) {
+	leader, err := hc.redisRepo.AcquireLeadership(ctx, repositories.HealthLeaderKey, hc.instanceId, healthLeaderTTL)
+	if err != nil {
+		slog.Warn("Sem acesso ao lock de liderança, checando localmente", "err", err)
+		leader = true
+	}
+
+	if !leader {
+		// Leitura direta cobre mensagens de pub/sub perdidas
+		state, err := hc.redisRepo.GetHealthState(ctx)
+		if err != nil {
+			slog.Error("Erro ao buscar estado de saúde publicado", "err", err)
+			return
+		}
+		if state != nil {
+			hc.applyState(state)
+		}
+		return
+	}
+
+	state, err := hc.chooseService(ctx)
+	if err != nil {
+		slog.Error("Erro ao escolher o serviço", "err", err)
+		return
+	}
+	if previous := hc.selector.getChosen(); state.Active != previous {
+		slog.Info("Trocando API ativa", "url_ativa", state.Active, "leader", state.Leader)
+		// Só o líder publica no feed, então cada troca aparece uma vez
+		err = hc.redisRepo.PublishProcessorSwitch(ctx, previous, state.Active)
+		if err != nil {
+			slog.Warn("Erro ao publicar troca de processador no feed", "err", err)
 		}
 	}
+	hc.selector.Decide(state.Active)
+	hc.applyCurrencies(state)
+
+	err = hc.redisRepo.PublishHealthState(ctx, state)
+	if err != nil {
+		slog.Error("Erro ao publicar estado de saúde", "err", err)
+	}
 }
 
-func (hc *HealthCheckWorker) chooseService(ctx context.Context) error {
+func (hc *HealthCheckWorker) applyState(state *dtos.HealthState) {
+	if state.Active != hc.selector.getChosen() {
+		slog.Info("Trocando API ativa", "url_ativa", state.Active, "leader", state.Leader)
+	}
+	hc.selector.SetActive(state.Active)
+	hc.applyCurrencies(state)
+}
+
+// applyCurrencies usa as moedas declaradas no service-health. Um processador
+// que não declara mantém as da configuração.
+func (hc *HealthCheckWorker) applyCurrencies(state *dtos.HealthState) {
+	for api, health := range map[dtos.PaymentAPI]*dtos.HealthCheckResponse{
+		dtos.DEFAULT_API:  state.Default,
+		dtos.FALLBACK_API: state.Fallback,
+	} {
+		if health != nil && len(health.Currencies) > 0 {
+			hc.selector.SetCurrencies(api, health.Currencies)
+		}
+	}
+}
+
+func (hc *HealthCheckWorker) chooseService(ctx context.Context) (*dtos.HealthState, error) {
 	defaultCh := make(chan *dtos.HealthCheckResponse)
 	fallbackCh := make(chan *dtos.HealthCheckResponse)
 
@@ -63,11 +141,14 @@ func (hc *HealthCheckWorker) chooseService(ctx context.Context) error {
 			choosen = dtos.FALLBACK_API
 		}
 	}
-	if choosen != hc.selector.GetActive() {
-		slog.Info("Trocando API ativa", "url_ativa", choosen)
-	}
-	hc.selector.SetActive(choosen)
-	return nil
+
+	return &dtos.HealthState{
+		Active:    choosen,
+		Default:   defaultRes,
+		Fallback:  fallbackRes,
+		CheckedAt: time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		Leader:    hc.instanceId,
+	}, nil
 }
 
 func check(ctx context.Context, url string, resCh chan<- *dtos.HealthCheckResponse) {
@@ -78,7 +159,7 @@ func check(ctx context.Context, url string, resCh chan<- *dtos.HealthCheckRespon
 			return
 		}
 	}()
-	httpClient := http.Client{Timeout: 90 * time.Second}
+	httpClient := http.Client{Timeout: healthCheckTimeout}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
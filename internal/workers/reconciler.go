@@ -0,0 +1,169 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+)
+
+// Reconciler resolve as intenções de pagamento deixadas por um worker que caiu
+// entre a chamada ao processador e o StoreProcessed.
+type Reconciler struct {
+	redisRepo  *repositories.RedisRepository
+	httpClient *http.Client
+}
+
+func NewReconciler(redisRepo *repositories.RedisRepository) *Reconciler {
+	return &Reconciler{
+		redisRepo:  redisRepo,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+const (
+	IntentsLeaderKey = "intents:leader"
+	// Acima do timeout de 90s do worker: uma intenção sem gravação há mais
+	// tempo que isso foi abandonada por quem a gravou.
+	staleIntentAge = 2 * time.Minute
+)
+
+// Run reconcilia as intenções desta instância, no startup.
+func (r *Reconciler) Run(ctx context.Context) error {
+	intents, err := r.redisRepo.GetIntents(ctx)
+	if err != nil {
+		return err
+	}
+	r.resolveAll(ctx, intents)
+	return nil
+}
+
+// RunStale adota e reconcilia as intenções de qualquer instância sem gravação
+// há mais de olderThan, inclusive as de instâncias que não voltaram.
+func (r *Reconciler) RunStale(ctx context.Context, olderThan time.Duration) error {
+	intents, err := r.redisRepo.AdoptStaleIntents(ctx, time.Now().Add(-olderThan))
+	r.resolveAll(ctx, intents)
+	return err
+}
+
+// Start roda o RunStale a cada interval enquanto esta instância tiver o lock
+// de liderança das intenções.
+func (r *Reconciler) Start(ctx context.Context, interval time.Duration, instanceId string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			leader, err := r.redisRepo.AcquireLeadership(ctx, IntentsLeaderKey, instanceId, 2*interval)
+			if err != nil {
+				slog.Warn("Erro ao disputar liderança das intenções", "err", err)
+				continue
+			}
+			if !leader {
+				continue
+			}
+			if err := r.RunStale(ctx, staleIntentAge); err != nil {
+				slog.Error("Erro ao reconciliar intenções abandonadas", "err", err)
+			}
+		}
+	}
+}
+
+func (r *Reconciler) resolveAll(ctx context.Context, intents []dtos.PaymentIntent) {
+	if len(intents) > 0 {
+		slog.Info("Reconciliando intenções de pagamento pendentes", "total", len(intents))
+	}
+
+	for _, intent := range intents {
+		err := r.resolve(ctx, &intent)
+		if err != nil {
+			slog.Error("Falha ao reconciliar pagamento", "correlationId", intent.CorrelationId, "err", err)
+		}
+	}
+}
+
+// resolve consulta primeiro o processador registrado na intenção e depois o
+// outro, já que uma retry pode ter trocado de API. Se nenhum conhece o
+// pagamento ele volta para a stream.
+func (r *Reconciler) resolve(ctx context.Context, intent *dtos.PaymentIntent) error {
+	apis := []dtos.PaymentAPI{intent.Api, dtos.FALLBACK_API}
+	if intent.Api == dtos.FALLBACK_API {
+		apis[1] = dtos.DEFAULT_API
+	}
+
+	for _, api := range apis {
+		payment, err := fetchProcessorPayment(ctx, r.httpClient, api, intent.CorrelationId)
+		if err != nil {
+			return err // Processador indisponível, tenta de novo na próxima execução
+		}
+		if payment == nil {
+			continue
+		}
+
+		// O horário real do aceite se perdeu na queda; o início do despacho é
+		// o melhor limite inferior que temos
+		processedAt := intent.DispatchedAt
+		if processedAt == "" {
+			processedAt = payment.RequestedAt
+		}
+
+		processedPayment := dtos.ProcessedPayment{
+			CorrelationId: payment.CorrelationId,
+			Amount:        payment.Amount,
+			Currency:      intent.Currency,
+			Api:           api,
+			RequestedAt:   payment.RequestedAt,
+			DispatchedAt:  intent.DispatchedAt,
+			ProcessedAt:   processedAt,
+			Attempts:      intent.Attempts,
+			Tenant:        intent.Tenant,
+			ClientId:      intent.ClientId,
+			CallbackUrl:   intent.CallbackUrl,
+		}
+		slog.Info("Pagamento confirmado pelo processador", "correlationId", intent.CorrelationId, "api", api)
+		return r.redisRepo.StoreProcessed(ctx, &processedPayment, intent.RedisStreamId)
+	}
+
+	slog.Info("Pagamento não encontrado nos processadores, reenfileirando", "correlationId", intent.CorrelationId)
+	return r.redisRepo.RequeueIntent(ctx, intent)
+}
+
+// fetchProcessorPayment retorna nil, nil quando o processador responde 404.
+func fetchProcessorPayment(ctx context.Context, client *http.Client, api dtos.PaymentAPI, correlationId string) (*dtos.ProcessorPaymentResponse, error) {
+	url := dtos.ApiUrl[api] + "/payments/" + correlationId
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao criar requisição HTTP: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao consultar pagamento no processador: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	var payment dtos.ProcessorPaymentResponse
+	err = json.NewDecoder(resp.Body).Decode(&payment)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao decodificar pagamento do processador: %w", err)
+	}
+	return &payment, nil
+}
@@ -0,0 +1,146 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+)
+
+// RefundWorkers envia os reembolsos ao processador que recebeu o pagamento
+// original. Não há fallback: o dinheiro está naquele processador.
+type RefundWorkers struct {
+	redisRepo   *repositories.RedisRepository
+	httpClient  *http.Client
+	maxRetries  int
+	baseBackoff time.Duration
+}
+
+func NewRefundWorkers(redisRepo *repositories.RedisRepository) *RefundWorkers {
+	return &RefundWorkers{
+		redisRepo:   redisRepo,
+		httpClient:  &http.Client{Timeout: 5 * time.Second},
+		maxRetries:  12,
+		baseBackoff: time.Millisecond * 10,
+	}
+}
+
+func (w *RefundWorkers) Start(ctx context.Context, numWorkers int) {
+	slog.Info("Iniciando workers de reembolso...", "nworkers", numWorkers)
+
+	var wg sync.WaitGroup
+	for i := range numWorkers {
+		wg.Add(1)
+		go func(workerId int) {
+			defer wg.Done()
+			w.start(ctx, workerId)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (w *RefundWorkers) start(ctx context.Context, workerId int) {
+	consumerId := fmt.Sprintf("%s-refund-%d", w.redisRepo.ConsumerId, workerId)
+
+	// Primeiro termina o que ficou pendente com este consumidor antes de uma queda
+	pending := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			refunds, err := w.redisRepo.ReadRefunds(ctx, consumerId, pending)
+			if err != nil {
+				slog.Warn("Erro ao ler reembolsos", "err", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			if pending && len(refunds) == 0 {
+				pending = false
+			}
+			for _, refund := range refunds {
+				w.process(ctx, refund)
+			}
+		}
+	}
+}
+
+func (w *RefundWorkers) process(ctx context.Context, refund *dtos.Refund) {
+	err := w.callRefundAPIWithRetry(ctx, refund)
+
+	var httpErr *HTTPError
+	switch {
+	case err == nil:
+		err = w.redisRepo.StoreRefund(ctx, refund)
+	case errors.As(err, &httpErr) && !isRetryableError(httpErr):
+		slog.Error("Reembolso recusado pelo processador", "refundId", refund.RefundId, "err", err)
+		err = w.redisRepo.FailRefund(ctx, refund, err.Error())
+	case ctx.Err() != nil:
+		return // Fica pendente e é retomado no próximo start
+	default:
+		slog.Warn("Reembolso sem resposta do processador, reenfileirando", "refundId", refund.RefundId, "err", err)
+		err = w.redisRepo.RequeueRefund(ctx, refund)
+	}
+	if err != nil {
+		slog.Error("Erro ao finalizar reembolso", "refundId", refund.RefundId, "err", err)
+	}
+}
+
+func (w *RefundWorkers) callRefundAPIWithRetry(ctx context.Context, refund *dtos.Refund) error {
+	url := fmt.Sprintf("%s/payments/%s/refund", dtos.ApiUrl[refund.Api], refund.CorrelationId)
+	request := dtos.ProcessorRefundRequest{
+		RefundId:    refund.RefundId,
+		Amount:      refund.Amount,
+		Currency:    refund.Currency,
+		RequestedAt: refund.RequestedAt,
+	}
+
+	var err error
+	for attempt := 0; attempt <= w.maxRetries; attempt++ {
+		err = w.callRefundAPI(ctx, url, &request)
+		if err == nil || !isRetryableError(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt*attempt) * w.baseBackoff):
+		}
+	}
+	return fmt.Errorf("Todas as tentativas falharam: %w", err)
+}
+
+func (w *RefundWorkers) callRefundAPI(ctx context.Context, url string, refund *dtos.ProcessorRefundRequest) error {
+	payload, err := json.Marshal(refund)
+	if err != nil {
+		return fmt.Errorf("Erro ao serializar reembolso: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(payload))
+	if err != nil {
+		return fmt.Errorf("Erro ao criar requisição HTTP: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Erro ao enviar requisição HTTP: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// 409 indica que o processador já recebeu este refundId
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusConflict {
+		return nil
+	}
+	return &HTTPError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+}
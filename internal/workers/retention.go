@@ -0,0 +1,98 @@
+package workers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+)
+
+const (
+	retentionChunk = 500 // pagamentos arquivados por vez
+	// Rollups por minuto mais velhos que a retenção mais isso viram rollups
+	// por hora
+	rollupCompactAfter = 24 * time.Hour
+)
+
+// RetentionWorker arquiva os pagamentos processados mais velhos que maxAge e
+// os remove do Redis junto com os reembolsos deles, mantendo rollups por
+// minuto para os sumários, que um dia
+// depois são compactados em rollups por hora. Só a
+// instância com o lock de retenção roda, para o mesmo pagamento não ir duas
+// vezes para o arquivo.
+type RetentionWorker struct {
+	redisRepo  *repositories.RedisRepository
+	archiver   repositories.Archiver
+	maxAge     time.Duration
+	instanceId string
+}
+
+func NewRetentionWorker(redisRepo *repositories.RedisRepository, archiver repositories.Archiver, maxAge time.Duration, instanceId string) *RetentionWorker {
+	return &RetentionWorker{
+		redisRepo:  redisRepo,
+		archiver:   archiver,
+		maxAge:     maxAge,
+		instanceId: instanceId,
+	}
+}
+
+func (w *RetentionWorker) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			leader, err := w.redisRepo.AcquireLeadership(ctx, repositories.RetentionLeaderKey, w.instanceId, 2*interval)
+			if err != nil {
+				slog.Error("Erro ao obter lock de retenção", "err", err)
+				continue
+			}
+			if !leader {
+				continue
+			}
+
+			archived, err := w.Run(ctx)
+			if err != nil {
+				slog.Error("Erro ao arquivar pagamentos", "err", err, "archived", archived)
+				continue
+			}
+			if archived > 0 {
+				slog.Info("Pagamentos arquivados", "archived", archived)
+			}
+		}
+	}
+}
+
+// Run arquiva de uma vez tudo que passou de maxAge em todos os tenants e
+// compacta os rollups antigos.
+func (w *RetentionWorker) Run(ctx context.Context) (int64, error) {
+	before := time.Now().Add(-w.maxAge)
+	compactBefore := before.Add(-rollupCompactAfter)
+	tenants, err := w.redisRepo.Tenants(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, tenant := range tenants {
+		for _, api := range []dtos.PaymentAPI{dtos.DEFAULT_API, dtos.FALLBACK_API} {
+			archived, err := w.redisRepo.ArchiveProcessed(ctx, tenant, api, before, retentionChunk, w.archiver)
+			total += archived
+			if err != nil {
+				return total, err
+			}
+			if _, err := w.redisRepo.ArchiveRefunds(ctx, tenant, api, before, retentionChunk); err != nil {
+				return total, err
+			}
+			if _, err := w.redisRepo.CompactRollups(ctx, tenant, api, compactBefore, retentionChunk); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
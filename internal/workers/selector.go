@@ -1,13 +1,56 @@
 package workers
 
 import (
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/lckrugel/rinha-backend-25/internal/dtos"
 )
 
+const (
+	breakerThreshold = 5                     // falhas seguidas até abrir o circuito
+	breakerCooldown  = 2 * time.Second       // tempo que o circuito fica aberto
+	latencyAlpha     = 0.2                   // peso de cada observação na média móvel
+	latencyMaxAge    = 3 * time.Second       // idade máxima de uma amostra vinda de outra instância
+	apiCount         = dtos.FALLBACK_API + 1 // número de processadores
+)
+
+type circuitBreaker struct {
+	failures  atomic.Int32
+	openUntil atomic.Int64 // unix ms
+}
+
+func (b *circuitBreaker) isOpen(now time.Time) bool {
+	return now.UnixMilli() < b.openUntil.Load()
+}
+
+// latencySamples acumula as latências observadas por esta instância desde a
+// última publicação.
+type latencySamples struct {
+	mu    sync.Mutex
+	sum   float64
+	count int
+}
+
+type pin struct {
+	api   dtos.PaymentAPI
+	until int64 // unix ms
+}
+
 type ServiceSelector struct {
-	active atomic.Value // stores dtos.PaymentAPI
+	active   atomic.Value // stores dtos.PaymentAPI
+	pinned   atomic.Pointer[pin]
+	breakers [apiCount]circuitBreaker
+	latency  [apiCount]atomic.Uint64 // stores float64 bits (ms)
+	samples  [apiCount]latencySamples
+	publish  atomic.Value // stores func(dtos.ProcessorEvent)
+
+	// Moedas aceitas por processador; nil aceita qualquer uma
+	currencies [apiCount]atomic.Pointer[[]string]
 }
 
 func NewServiceSelector() *ServiceSelector {
@@ -16,7 +59,79 @@ func NewServiceSelector() *ServiceSelector {
 	return s
 }
 
+// SetPublisher define para onde vão as decisões locais do seletor. Sem
+// publisher as decisões valem apenas para esta instância.
+func (s *ServiceSelector) SetPublisher(publish func(dtos.ProcessorEvent)) {
+	s.publish.Store(publish)
+}
+
+func (s *ServiceSelector) emit(event dtos.ProcessorEvent) {
+	if publish, ok := s.publish.Load().(func(dtos.ProcessorEvent)); ok {
+		publish(event)
+	}
+}
+
+// GetActive retorna a API fixada por um administrador, se houver. Caso
+// contrário retorna a API escolhida, a menos que o circuito dela esteja aberto
+// e o da outra não.
 func (s *ServiceSelector) GetActive() dtos.PaymentAPI {
+	now := time.Now()
+	if p := s.pinned.Load(); p != nil && now.UnixMilli() < p.until {
+		return p.api
+	}
+
+	active := s.getChosen()
+	other := otherAPI(active)
+	if s.breakers[active].isOpen(now) && !s.breakers[other].isOpen(now) {
+		return other
+	}
+	return active
+}
+
+// GetActiveFor é o GetActive restrito aos processadores que aceitam a moeda.
+// Retorna false se nenhum dos dois aceitar.
+func (s *ServiceSelector) GetActiveFor(currency string) (dtos.PaymentAPI, bool) {
+	active := s.GetActive()
+	if s.Accepts(active, currency) {
+		return active, true
+	}
+	other := otherAPI(active)
+	if s.Accepts(other, currency) {
+		return other, true
+	}
+	return active, false
+}
+
+// SetCurrencies define as moedas que api aceita. Lista vazia aceita todas;
+// uma lista só com moedas desconhecidas é ignorada, em vez de fazer o
+// processador recusar todas.
+func (s *ServiceSelector) SetCurrencies(api dtos.PaymentAPI, currencies []string) {
+	if len(currencies) == 0 {
+		s.currencies[api].Store(nil)
+		return
+	}
+	normalized := make([]string, 0, len(currencies))
+	for _, currency := range currencies {
+		if code, ok := dtos.NormalizeCurrency(currency); ok {
+			normalized = append(normalized, code)
+		} else {
+			slog.Warn("Moeda desconhecida ignorada", "processor", api, "currency", currency)
+		}
+	}
+	if len(normalized) == 0 {
+		slog.Warn("Nenhuma moeda válida, mantendo a configuração anterior", "processor", api)
+		return
+	}
+	slices.Sort(normalized)
+	s.currencies[api].Store(&normalized)
+}
+
+func (s *ServiceSelector) Accepts(api dtos.PaymentAPI, currency string) bool {
+	accepted := s.currencies[api].Load()
+	return accepted == nil || slices.Contains(*accepted, currency)
+}
+
+func (s *ServiceSelector) getChosen() dtos.PaymentAPI {
 	v := s.active.Load()
 	if v == nil {
 		return dtos.DEFAULT_API
@@ -27,3 +142,146 @@ func (s *ServiceSelector) GetActive() dtos.PaymentAPI {
 func (s *ServiceSelector) SetActive(api dtos.PaymentAPI) {
 	s.active.Store(api)
 }
+
+// Decide troca a API ativa e publica a decisão para as outras instâncias.
+func (s *ServiceSelector) Decide(api dtos.PaymentAPI) {
+	if s.getChosen() == api {
+		return
+	}
+	s.SetActive(api)
+	s.emit(dtos.ProcessorEvent{Type: dtos.EVENT_SELECTOR, Api: api})
+}
+
+// Pin força o roteamento para api por ttl em todas as instâncias.
+func (s *ServiceSelector) Pin(api dtos.PaymentAPI, ttl time.Duration) time.Time {
+	until := time.Now().Add(ttl)
+	s.pinned.Store(&pin{api: api, until: until.UnixMilli()})
+	s.emit(dtos.ProcessorEvent{Type: dtos.EVENT_PIN, Api: api, PinUntil: until.UnixMilli()})
+	return until
+}
+
+func (s *ServiceSelector) Unpin() {
+	s.pinned.Store(nil)
+	s.emit(dtos.ProcessorEvent{Type: dtos.EVENT_UNPIN})
+}
+
+func (s *ServiceSelector) ReportSuccess(api dtos.PaymentAPI, latency time.Duration) {
+	s.breakers[api].failures.Store(0)
+	ms := float64(latency.Microseconds()) / 1000
+	s.observeLatency(api, ms)
+
+	samples := &s.samples[api]
+	samples.mu.Lock()
+	samples.sum += ms
+	samples.count++
+	samples.mu.Unlock()
+}
+
+// TakeLocalLatency retorna a média das latências que esta instância observou
+// desde a chamada anterior, ou false se não houve nenhuma. Só essas vão para
+// as outras instâncias: a média móvel mistura o que veio delas e, publicada,
+// ficaria circulando entre as instâncias sem observação nova.
+func (s *ServiceSelector) TakeLocalLatency(api dtos.PaymentAPI) (float64, bool) {
+	samples := &s.samples[api]
+	samples.mu.Lock()
+	defer samples.mu.Unlock()
+	if samples.count == 0 {
+		return 0, false
+	}
+	mean := samples.sum / float64(samples.count)
+	samples.sum, samples.count = 0, 0
+	return mean, true
+}
+
+func (s *ServiceSelector) ReportFailure(api dtos.PaymentAPI) {
+	b := &s.breakers[api]
+	if b.failures.Add(1) < breakerThreshold {
+		return
+	}
+	b.failures.Store(0)
+
+	openUntil := time.Now().Add(breakerCooldown).UnixMilli()
+	b.openUntil.Store(openUntil)
+	s.emit(dtos.ProcessorEvent{Type: dtos.EVENT_BREAKER, Api: api, OpenUntil: openUntil})
+}
+
+func (s *ServiceSelector) Latency(api dtos.PaymentAPI) float64 {
+	return math.Float64frombits(s.latency[api].Load())
+}
+
+func (s *ServiceSelector) observeLatency(api dtos.PaymentAPI, ms float64) {
+	for {
+		old := s.latency[api].Load()
+		current := math.Float64frombits(old)
+		next := ms
+		if current != 0 {
+			next = current*(1-latencyAlpha) + ms*latencyAlpha
+		}
+		if s.latency[api].CompareAndSwap(old, math.Float64bits(next)) {
+			return
+		}
+	}
+}
+
+// Apply incorpora um evento publicado por outra instância sem republicá-lo.
+func (s *ServiceSelector) Apply(event dtos.ProcessorEvent) {
+	if event.Api >= apiCount {
+		return
+	}
+
+	switch event.Type {
+	case dtos.EVENT_SELECTOR:
+		s.SetActive(event.Api)
+	case dtos.EVENT_BREAKER:
+		b := &s.breakers[event.Api]
+		if event.OpenUntil > b.openUntil.Load() {
+			b.openUntil.Store(event.OpenUntil)
+		}
+	case dtos.EVENT_LATENCY:
+		// Amostras atrasadas (ou sem horário, de versões anteriores) são descartadas
+		age := time.Now().UnixMilli() - event.ObservedAt
+		if event.LatencyMs > 0 && age < latencyMaxAge.Milliseconds() {
+			s.observeLatency(event.Api, event.LatencyMs)
+		}
+	case dtos.EVENT_PIN:
+		s.pinned.Store(&pin{api: event.Api, until: event.PinUntil})
+	case dtos.EVENT_UNPIN:
+		s.pinned.Store(nil)
+	}
+}
+
+func (s *ServiceSelector) Snapshot() dtos.SelectorState {
+	now := time.Now()
+	state := dtos.SelectorState{
+		Active: s.GetActive().String(),
+		Chosen: s.getChosen().String(),
+	}
+
+	if p := s.pinned.Load(); p != nil && now.UnixMilli() < p.until {
+		state.Pinned = p.api.String()
+		state.PinUntil = time.UnixMilli(p.until).UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+
+	for api := dtos.DEFAULT_API; api < apiCount; api++ {
+		processor := dtos.ProcessorState{
+			Processor:   api.String(),
+			BreakerOpen: s.breakers[api].isOpen(now),
+			LatencyMs:   s.Latency(api),
+		}
+		if accepted := s.currencies[api].Load(); accepted != nil {
+			processor.Currencies = *accepted
+		}
+		if processor.BreakerOpen {
+			processor.BreakerOpenUntil = time.UnixMilli(s.breakers[api].openUntil.Load()).UTC().Format("2006-01-02T15:04:05.000Z")
+		}
+		state.Processors = append(state.Processors, processor)
+	}
+	return state
+}
+
+func otherAPI(api dtos.PaymentAPI) dtos.PaymentAPI {
+	if api == dtos.DEFAULT_API {
+		return dtos.FALLBACK_API
+	}
+	return dtos.DEFAULT_API
+}
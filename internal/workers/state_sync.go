@@ -0,0 +1,79 @@
+package workers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+)
+
+// StateSync replica as decisões do ServiceSelector entre as instâncias via
+// pub/sub no Redis. A publicação é assíncrona e descarta eventos quando o
+// Redis não dá conta, de modo que o seletor continua decidindo localmente se
+// o Redis estiver fora do ar.
+type StateSync struct {
+	redisRepo  *repositories.RedisRepository
+	selector   *ServiceSelector
+	instanceId string
+	events     chan dtos.ProcessorEvent
+}
+
+func NewStateSync(redisRepo *repositories.RedisRepository, selector *ServiceSelector, instanceId string) *StateSync {
+	s := &StateSync{
+		redisRepo:  redisRepo,
+		selector:   selector,
+		instanceId: instanceId,
+		events:     make(chan dtos.ProcessorEvent, 256),
+	}
+	selector.SetPublisher(s.publish)
+	return s
+}
+
+func (s *StateSync) publish(event dtos.ProcessorEvent) {
+	event.Source = s.instanceId
+	select {
+	case s.events <- event:
+	default:
+		slog.Debug("Fila de eventos cheia, descartando", "type", event.Type)
+	}
+}
+
+func (s *StateSync) Start(ctx context.Context) {
+	go s.redisRepo.ListenProcessorEvents(ctx, func(event *dtos.ProcessorEvent) {
+		if event.Source == s.instanceId {
+			return
+		}
+		s.selector.Apply(*event)
+	})
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-s.events:
+			s.send(ctx, &event)
+		case now := <-ticker.C:
+			for api := dtos.DEFAULT_API; api < apiCount; api++ {
+				if latency, ok := s.selector.TakeLocalLatency(api); ok {
+					s.send(ctx, &dtos.ProcessorEvent{Type: dtos.EVENT_LATENCY, Api: api, Source: s.instanceId,
+						LatencyMs: latency, ObservedAt: now.UnixMilli()})
+				}
+			}
+		}
+	}
+}
+
+func (s *StateSync) send(ctx context.Context, event *dtos.ProcessorEvent) {
+	sendCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	err := s.redisRepo.PublishProcessorEvent(sendCtx, event)
+	if err != nil {
+		slog.Debug("Falha ao publicar evento, mantendo decisão local", "type", event.Type, "err", err)
+	}
+}
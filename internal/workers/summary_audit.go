@@ -0,0 +1,187 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+)
+
+// SummaryAuditor compara o nosso sumário com o GET /admin/payments-summary de
+// cada processador na mesma janela.
+//
+// Os processadores não expõem uma listagem de pagamentos, então só é possível
+// apontar correlationIds que existem apenas do nosso lado (consultando
+// GET /payments/{id} para cada um). Pagamentos que só o processador conhece
+// aparecem apenas como drift na contagem.
+type SummaryAuditor struct {
+	redisRepo   *repositories.RedisRepository
+	httpClient  *http.Client
+	adminToken  string
+	listMissing bool
+}
+
+func NewSummaryAuditor(redisRepo *repositories.RedisRepository, adminToken string, listMissing bool) *SummaryAuditor {
+	return &SummaryAuditor{
+		redisRepo:   redisRepo,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		adminToken:  adminToken,
+		listMissing: listMissing,
+	}
+}
+
+// Start audita periodicamente a janela [agora-window-grace, agora-grace]. O
+// grace evita reportar pagamentos que ainda estão entre o processador e o
+// StoreProcessed.
+func (a *SummaryAuditor) Start(ctx context.Context, interval, window, grace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			to := time.Now().UTC().Add(-grace)
+			from := to.Add(-window)
+
+			auditCtx, cancel := context.WithTimeout(ctx, interval)
+			report, err := a.Audit(auditCtx, from, to)
+			cancel()
+			if err != nil {
+				slog.Error("Erro ao auditar sumário", "err", err)
+				continue
+			}
+
+			for _, p := range report.Processors {
+				if p.RequestsDrift != 0 || p.AmountDrift != 0 {
+					slog.Warn("Divergência no sumário", "processor", p.Processor, "from", report.From, "to", report.To,
+						"requestsDrift", p.RequestsDrift, "amountDrift", p.AmountDrift, "onlyLocal", p.OnlyLocal)
+				}
+				if len(p.UnauditedCurrencies) > 0 {
+					slog.Info("Valores não auditados: janela com outras moedas", "processor", p.Processor,
+						"currencies", p.UnauditedCurrencies)
+				}
+			}
+		}
+	}
+}
+
+func (a *SummaryAuditor) Audit(ctx context.Context, from, to time.Time) (*dtos.AuditReport, error) {
+	report := &dtos.AuditReport{
+		From: from.UTC().Format("2006-01-02T15:04:05.000Z"),
+		To:   to.UTC().Format("2006-01-02T15:04:05.000Z"),
+	}
+
+	for _, api := range []dtos.PaymentAPI{dtos.DEFAULT_API, dtos.FALLBACK_API} {
+		audit, err := a.auditProcessor(ctx, api, from, to, report)
+		if err != nil {
+			return nil, fmt.Errorf("Erro ao auditar processador %s: %w", api, err)
+		}
+		report.Processors = append(report.Processors, *audit)
+	}
+	return report, nil
+}
+
+func (a *SummaryAuditor) auditProcessor(ctx context.Context, api dtos.PaymentAPI, from, to time.Time, report *dtos.AuditReport) (*dtos.ProcessorAudit, error) {
+	// O processador não distingue tenants, então a comparação é com a soma de todos
+	tenants, err := a.redisRepo.Tenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var payments []dtos.ProcessedPayment
+	for _, tenant := range tenants {
+		tenantPayments, err := a.redisRepo.GetProcessedByDateRange(ctx, tenant, api, from, to)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, tenantPayments...)
+	}
+
+	// A contagem vale para todas as moedas; o valor só na moeda padrão
+	local := dtos.APISummary{TotalRequests: len(payments)}
+	var localMinor int64
+	others := make(map[string]bool)
+	for _, payment := range payments {
+		currency, _ := dtos.NormalizeCurrency(payment.Currency)
+		if currency != dtos.DEFAULT_CURRENCY {
+			others[currency] = true
+			continue
+		}
+		localMinor += dtos.ToMinor(currency, payment.Amount)
+	}
+	local.TotalAmount = dtos.FromMinor(dtos.DEFAULT_CURRENCY, localMinor)
+
+	remote, err := a.fetchProcessorSummary(ctx, api, report.From, report.To)
+	if err != nil {
+		return nil, err
+	}
+
+	audit := &dtos.ProcessorAudit{
+		Processor:     api.String(),
+		Local:         local,
+		Remote:        dtos.APISummary{TotalRequests: remote.TotalRequests, TotalAmount: remote.TotalAmount},
+		RequestsDrift: local.TotalRequests - remote.TotalRequests,
+	}
+	if len(others) == 0 {
+		audit.AmountDrift = math.Round((local.TotalAmount-remote.TotalAmount)*100) / 100
+	} else {
+		audit.UnauditedCurrencies = slices.Sorted(maps.Keys(others))
+	}
+
+	if a.listMissing && (audit.RequestsDrift != 0 || audit.AmountDrift != 0) {
+		for _, payment := range payments {
+			found, err := fetchProcessorPayment(ctx, a.httpClient, api, payment.CorrelationId)
+			if err != nil {
+				return nil, err
+			}
+			if found == nil {
+				audit.OnlyLocal = append(audit.OnlyLocal, payment.CorrelationId)
+			}
+		}
+	}
+
+	return audit, nil
+}
+
+func (a *SummaryAuditor) fetchProcessorSummary(ctx context.Context, api dtos.PaymentAPI, from, to string) (*dtos.ProcessorSummaryResponse, error) {
+	query := url.Values{}
+	query.Set("from", from)
+	query.Set("to", to)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dtos.ApiUrl[api]+"/admin/payments-summary?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao criar requisição HTTP: %w", err)
+	}
+	req.Header.Set("X-Rinha-Token", a.adminToken)
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao buscar sumário do processador: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	var summary dtos.ProcessorSummaryResponse
+	err = json.NewDecoder(resp.Body).Decode(&summary)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao decodificar sumário do processador: %w", err)
+	}
+	return &summary, nil
+}
@@ -0,0 +1,192 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lckrugel/rinha-backend-25/internal/dtos"
+	"github.com/lckrugel/rinha-backend-25/internal/repositories"
+)
+
+// Intervalo antes de cada nova tentativa. Depois da última o webhook é
+// abandonado e fica só no log de entregas.
+var webhookRetrySchedule = []time.Duration{
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	2 * time.Minute,
+	10 * time.Minute,
+}
+
+// WebhookWorkers entrega os eventos de pagamento para o callbackUrl dos
+// clientes, assinando o corpo com HMAC-SHA256:
+//
+//	X-Webhook-Signature: sha256=hex(hmac(secret, timestamp + "." + corpo))
+type WebhookWorkers struct {
+	redisRepo  *repositories.RedisRepository
+	httpClient *http.Client
+	secret     []byte
+}
+
+func NewWebhookWorkers(redisRepo *repositories.RedisRepository, secret string) *WebhookWorkers {
+	return &WebhookWorkers{
+		redisRepo:  redisRepo,
+		httpClient: newWebhookClient(5 * time.Second),
+		secret:     []byte(secret),
+	}
+}
+
+func (w *WebhookWorkers) Start(ctx context.Context, numWorkers int) {
+	slog.Info("Iniciando workers de webhooks...", "nworkers", numWorkers)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.scheduleRetries(ctx)
+	}()
+
+	for i := range numWorkers {
+		wg.Add(1)
+		go func(workerId int) {
+			defer wg.Done()
+			w.start(ctx, workerId)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (w *WebhookWorkers) scheduleRetries(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := w.redisRepo.MoveDueWebhooks(ctx, time.Now())
+			if err != nil {
+				slog.Warn("Erro ao reenfileirar webhooks", "err", err)
+			}
+		}
+	}
+}
+
+func (w *WebhookWorkers) start(ctx context.Context, workerId int) {
+	consumerId := fmt.Sprintf("%s-webhook-%d", w.redisRepo.ConsumerId, workerId)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			deliveries, err := w.redisRepo.ReadWebhooks(ctx, consumerId)
+			if err != nil {
+				slog.Warn("Erro ao ler webhooks", "err", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			for messageId, delivery := range deliveries {
+				w.deliver(ctx, messageId, delivery)
+			}
+		}
+	}
+}
+
+func (w *WebhookWorkers) deliver(ctx context.Context, messageId string, delivery *dtos.WebhookDelivery) {
+	delivery.Attempt++
+	status, err := w.send(ctx, delivery)
+
+	entry := dtos.WebhookLogEntry{
+		EventId:       delivery.Event.Id,
+		CorrelationId: delivery.Event.CorrelationId,
+		Url:           delivery.Url,
+		Attempt:       delivery.Attempt,
+		Status:        status,
+		At:            time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	switch {
+	case err == nil:
+		entry.Outcome = "delivered"
+		err = w.redisRepo.AckWebhook(ctx, messageId)
+	case errors.Is(err, ErrCallbackNotAllowed):
+		entry.Outcome = "abandoned"
+		slog.Warn("Webhook para destino não permitido", "eventId", delivery.Event.Id, "url", delivery.Url)
+		err = w.redisRepo.AckWebhook(ctx, messageId)
+	case retryableWebhookStatus(status) && delivery.Attempt <= len(webhookRetrySchedule):
+		entry.Outcome = "retrying"
+		next := time.Now().Add(webhookRetrySchedule[delivery.Attempt-1])
+		err = w.redisRepo.ScheduleWebhookRetry(ctx, messageId, delivery, next)
+	default:
+		entry.Outcome = "abandoned"
+		slog.Warn("Webhook abandonado", "eventId", delivery.Event.Id, "url", delivery.Url, "attempt", delivery.Attempt)
+		err = w.redisRepo.AckWebhook(ctx, messageId)
+	}
+	if err != nil {
+		slog.Error("Erro ao finalizar entrega de webhook", "eventId", delivery.Event.Id, "err", err)
+	}
+
+	if err := w.redisRepo.LogWebhook(ctx, &entry); err != nil {
+		slog.Warn("Erro ao registrar entrega de webhook", "err", err)
+	}
+}
+
+// send retorna o status HTTP (0 se não houve resposta) e um erro para
+// qualquer resposta fora de 2xx.
+func (w *WebhookWorkers) send(ctx context.Context, delivery *dtos.WebhookDelivery) (int, error) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, fmt.Errorf("Erro ao serializar evento: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("Erro ao criar requisição HTTP: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", delivery.Event.Id)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+w.sign(timestamp, body))
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("Erro ao enviar webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("HTTP error: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (w *WebhookWorkers) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Erros de rede, 5xx, 408 e 429 valem nova tentativa; os demais 4xx indicam
+// que o cliente recusou o evento.
+func retryableWebhookStatus(status int) bool {
+	return status == 0 || status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
@@ -4,27 +4,43 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/lckrugel/rinha-backend-25/internal/chaos"
 	"github.com/lckrugel/rinha-backend-25/internal/dtos"
 	"github.com/lckrugel/rinha-backend-25/internal/repositories"
 )
 
+// Uma entrada pendente há mais que reclaimMinIdle foi abandonada: o
+// processamento tem timeout de 90s. Depois de maxDeliveries entregas ela vai
+// para a dead-letter em vez de ser processada de novo.
+const (
+	reclaimMinIdle = 5 * time.Minute
+	reclaimChunk   = 100
+	maxDeliveries  = 5
+)
+
 type Workers struct {
 	redisRepo   *repositories.RedisRepository
+	reconciler  *Reconciler
 	httpClient  *http.Client
 	maxRetries  int
 	baseBackoff time.Duration
 	selector    *ServiceSelector
+	paused      atomic.Bool
+	poolSize    atomic.Int32
 }
 
 func NewWorkers(redisRepo *repositories.RedisRepository, selector *ServiceSelector) *Workers {
 	return &Workers{
 		redisRepo:   redisRepo,
+		reconciler:  NewReconciler(redisRepo),
 		httpClient:  &http.Client{Timeout: 5 * time.Second},
 		maxRetries:  12,
 		baseBackoff: time.Millisecond * 10,
@@ -34,6 +50,8 @@ func NewWorkers(redisRepo *repositories.RedisRepository, selector *ServiceSelect
 
 func (w *Workers) StartWorkers(ctx context.Context, numWorkers int) {
 	slog.Info("Iniciando workers de processamento de pagamentos...", "nworkers", numWorkers)
+	w.poolSize.Add(int32(numWorkers))
+	defer w.poolSize.Add(-int32(numWorkers))
 
 	var wg sync.WaitGroup
 	for i := range numWorkers {
@@ -46,6 +64,24 @@ func (w *Workers) StartWorkers(ctx context.Context, numWorkers int) {
 	wg.Wait()
 }
 
+// Pause faz os workers desta instância pararem de ler da stream depois de
+// terminar o pagamento atual.
+func (w *Workers) Pause() {
+	w.paused.Store(true)
+}
+
+func (w *Workers) Resume() {
+	w.paused.Store(false)
+}
+
+func (w *Workers) Paused() bool {
+	return w.paused.Load()
+}
+
+func (w *Workers) PoolSize() int {
+	return int(w.poolSize.Load())
+}
+
 func (w *Workers) start(ctx context.Context, workerId int) {
 	slog.Info("Worker iniciado", "workerId", workerId)
 
@@ -55,6 +91,11 @@ func (w *Workers) start(ctx context.Context, workerId int) {
 			slog.Info("Worker recebeu sinal de parada", "workerId", workerId)
 			return
 		default:
+			if w.paused.Load() {
+				time.Sleep(200 * time.Millisecond)
+				continue
+			}
+
 			processCtx, cancel := context.WithTimeout(ctx, 90*time.Second)
 
 			err := w.processPayment(processCtx, workerId)
@@ -69,27 +110,108 @@ func (w *Workers) start(ctx context.Context, workerId int) {
 
 func (w *Workers) processPayment(ctx context.Context, workerId int) error {
 	consumerId := fmt.Sprintf("%s-%d", w.redisRepo.ConsumerId, workerId)
-	paymentRequest, err := w.redisRepo.ReadFromStream(ctx, consumerId)
-	if err != nil {
+	paymentRequests, err := w.redisRepo.ReadFromStream(ctx, consumerId)
+	if err != nil && len(paymentRequests) == 0 {
 		return fmt.Errorf("Erro ao remover pagamento da fila: %w", err)
 	}
 
-	if paymentRequest == nil {
-		return nil // Fila vazia, nada a processar
+	errs := []error{err}
+	for _, paymentRequest := range paymentRequests {
+		errs = append(errs, w.processOne(ctx, paymentRequest))
 	}
+	return errors.Join(errs...)
+}
+
+// StartReclaimer reclama a cada interval as entradas pendentes abandonadas e
+// as resolve com Reclaim. Toda instância roda o seu: o XAUTOCLAIM entrega cada
+// entrada a um só consumidor.
+func (w *Workers) StartReclaimer(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reclaimed, err := w.Reclaim(ctx, reclaimMinIdle)
+			if err != nil {
+				slog.Error("Erro ao reclamar pagamentos pendentes", "err", err, "reclaimed", reclaimed)
+			} else if reclaimed > 0 {
+				slog.Info("Pagamentos pendentes reclamados", "reclaimed", reclaimed)
+			}
+		}
+	}
+}
+
+// Reclaim processa de novo as entradas pendentes há mais de minIdle. As que
+// têm intenção gravada ficam com o reconciliador, que confere o processador
+// antes de reenfileirar; as ilegíveis recebem ack e as entregues demais vão
+// para a dead-letter.
+func (w *Workers) Reclaim(ctx context.Context, minIdle time.Duration) (int, error) {
+	entries, err := w.redisRepo.ReclaimStale(ctx, w.redisRepo.ConsumerId+"-reclaim", minIdle, reclaimChunk)
+	errs := []error{err}
+	for i := range entries {
+		errs = append(errs, w.reclaimOne(ctx, &entries[i]))
+	}
+	return len(entries), errors.Join(errs...)
+}
+
+func (w *Workers) reclaimOne(ctx context.Context, entry *repositories.StaleEntry) error {
+	payment := entry.Payment
+	if payment == nil {
+		slog.Warn("Entrada inválida na stream, descartando", "tenant", entry.Tenant, "id", entry.Id)
+		return w.redisRepo.AckMessage(ctx, entry.Tenant, entry.Id, nil)
+	}
+
+	hasIntent, err := w.redisRepo.HasIntent(ctx, payment.Tenant, payment.CorrelationId)
+	if err != nil || hasIntent {
+		return err
+	}
+	if entry.Deliveries > maxDeliveries {
+		reason := fmt.Sprintf("Pagamento entregue %d vezes sem ser concluído", entry.Deliveries)
+		return w.redisRepo.DeadLetter(ctx, payment, reason)
+	}
+
+	processCtx, cancel := context.WithTimeout(ctx, 90*time.Second)
+	defer cancel()
+	return w.processOne(processCtx, payment)
+}
 
+func (w *Workers) processOne(ctx context.Context, paymentRequest *dtos.PaymentRequest) error {
 	slog.Debug("Processando pagamento", "code", "PROCESSING_START", "payment-request", paymentRequest)
 
-	paymentResponse, apiUsed, err := w.callPaymentAPIWithRetry(ctx, paymentRequest)
+	// Uma entrega repetida de pagamento já concluído (o read group recriado
+	// do início da stream após um failover) só recebe o ack
+	done, err := w.alreadyDone(ctx, paymentRequest)
+	if err != nil || done {
+		return err
+	}
+
+	result, err := w.callPaymentAPIWithRetry(ctx, paymentRequest)
 	if err != nil {
 		return fmt.Errorf("Erro ao chamar API de pagamento: %w", err)
 	}
 
+	// Simula uma queda entre a cobrança e o registro do pagamento
+	err = chaos.Inject(ctx, chaos.POINT_BEFORE_STORE)
+	if err != nil {
+		return fmt.Errorf("Erro antes de armazenar pagamento: %w", err)
+	}
+
 	processedPayment := dtos.ProcessedPayment{
-		CorrelationId: paymentResponse.CorrelationId,
-		Amount:        paymentResponse.Amount,
-		Api:           *apiUsed,
-		ProcessedAt:   paymentResponse.RequestedAt,
+		CorrelationId: paymentRequest.CorrelationId,
+		Amount:        paymentRequest.Amount,
+		Currency:      paymentRequest.Currency,
+		Api:           result.api,
+		RequestedAt:   paymentRequest.RequestedAt.Format("2006-01-02T15:04:05.000Z"),
+		DispatchedAt:  result.dispatchedAt.UTC().Format("2006-01-02T15:04:05.000Z"),
+		ProcessedAt:   result.processedAt.UTC().Format("2006-01-02T15:04:05.000Z"),
+		Attempts:      result.attempts,
+		LatencyMs:     float64(result.latency.Microseconds()) / 1000,
+		Tenant:        paymentRequest.Tenant,
+		ClientId:      paymentRequest.ClientId,
+		CallbackUrl:   paymentRequest.CallbackUrl,
 	}
 
 	err = w.redisRepo.StoreProcessed(ctx, &processedPayment, paymentRequest.RedisStreamId)
@@ -102,21 +224,77 @@ func (w *Workers) processPayment(ctx context.Context, workerId int) error {
 	return nil
 }
 
-func (w *Workers) callPaymentAPIWithRetry(ctx context.Context, payment *dtos.PaymentRequest) (*dtos.PaymentAPIRequest, *dtos.PaymentAPI, error) {
+// alreadyDone diz se o pagamento já foi processado (ou arquivado) ou foi
+// para a dead-letter, e nesse caso dá ack na entrega.
+func (w *Workers) alreadyDone(ctx context.Context, payment *dtos.PaymentRequest) (bool, error) {
+	status, err := w.redisRepo.GetPaymentStatus(ctx, payment.Tenant, payment.CorrelationId)
+	if errors.Is(err, repositories.ErrPaymentNotFound) {
+		return false, nil // recebido antes do hash de status
+	}
+	if err != nil {
+		return false, err
+	}
+	if status.Status != dtos.PAYMENT_STATUS_PROCESSED && status.Status != dtos.PAYMENT_STATUS_FAILED &&
+		status.Status != dtos.PAYMENT_STATUS_ARCHIVED {
+		return false, nil
+	}
+
+	slog.Info("Pagamento já concluído, descartando entrega repetida", "correlationId", payment.CorrelationId, "status", status.Status)
+	if payment.RedisStreamId == "" {
+		return true, nil
+	}
+	return true, w.redisRepo.AckMessage(ctx, payment.Tenant, payment.RedisStreamId, nil)
+}
+
+// dispatchResult descreve a chamada que o processador aceitou.
+type dispatchResult struct {
+	api          dtos.PaymentAPI
+	dispatchedAt time.Time // início da primeira tentativa
+	processedAt  time.Time // resposta da tentativa aceita
+	attempts     int       // chamadas feitas ao processador
+	latency      time.Duration
+}
+
+func (w *Workers) callPaymentAPIWithRetry(ctx context.Context, payment *dtos.PaymentRequest) (*dispatchResult, error) {
 	var lastErr error
 
 	paymentAPIRequest := dtos.PaymentAPIRequest{
 		CorrelationId: payment.CorrelationId,
 		Amount:        payment.Amount,
+		Currency:      payment.Currency,
 		RequestedAt:   payment.RequestedAt.Format("2006-01-02T15:04:05.000Z"),
 	}
 
+	result := dispatchResult{dispatchedAt: time.Now()}
+	// Alguma tentativa terminou sem resposta conclusiva (timeout, erro de
+	// rede ou 5xx) e pode ter sido aceita pelo processador
+	ambiguous := false
 	for attempt := 0; attempt <= w.maxRetries; attempt++ {
-		api := w.selector.GetActive()
+		api, ok := w.selector.GetActiveFor(payment.Currency)
+		if !ok {
+			reason := "Nenhum processador aceita a moeda " + payment.Currency
+			if err := w.redisRepo.DeadLetter(ctx, payment, reason); err != nil {
+				slog.Error("Erro ao mover pagamento para dead-letter", "correlationId", payment.CorrelationId, "err", err)
+			}
+			return nil, errors.New(reason)
+		}
 		url := dtos.ApiUrl[api]
-		err := w.callPaymentAPI(ctx, url+"/payments", &paymentAPIRequest)
+		err := w.redisRepo.RecordIntent(ctx, paymentIntent(payment, &paymentAPIRequest, &result, api, result.attempts+1))
 		if err == nil {
-			return &paymentAPIRequest, &api, nil
+			result.attempts++
+			start := time.Now()
+			err = w.callPaymentAPI(ctx, url+"/payments", &paymentAPIRequest)
+			if err == nil {
+				result.processedAt = time.Now()
+				result.latency = result.processedAt.Sub(start)
+				result.api = api
+				w.selector.ReportSuccess(api, result.latency)
+				return &result, nil
+			}
+			if isRetryableError(err) {
+				w.selector.ReportFailure(api)
+				ambiguous = ambiguous || isAmbiguousError(err)
+			}
 		}
 
 		if attempt == w.maxRetries {
@@ -124,25 +302,71 @@ func (w *Workers) callPaymentAPIWithRetry(ctx context.Context, payment *dtos.Pay
 		}
 
 		lastErr = err
-		if !w.isRetryableError(err) {
-			w.redisRepo.AckMessage(ctx, payment.RedisStreamId, nil)
-			return nil, nil, fmt.Errorf("Erro não recuperável: %w", err)
+		if !isRetryableError(err) && ambiguous {
+			// Um 422 de correlationId repetido depois de um timeout quer dizer
+			// que a tentativa anterior foi aceita: quem decide é o processador
+			w.settle(ctx, payment, &paymentAPIRequest, &result)
+			return nil, fmt.Errorf("Erro não recuperável após tentativa sem resposta: %w", err)
+		}
+		if !isRetryableError(err) {
+			if dlErr := w.redisRepo.DeadLetter(ctx, payment, err.Error()); dlErr != nil {
+				slog.Error("Erro ao mover pagamento para dead-letter", "correlationId", payment.CorrelationId, "err", dlErr)
+			}
+			return nil, fmt.Errorf("Erro não recuperável: %w", err)
 		}
 
 		slog.Debug("Tentativa falhou", "tentativa", attempt, "maxTentativas", w.maxRetries+1, "correlationId", payment.CorrelationId)
 		delay := w.calculateBackoff(attempt)
 		select {
 		case <-ctx.Done():
-			return nil, nil, ctx.Err()
+			return nil, ctx.Err()
 		case <-time.After(delay):
 			continue
 		}
 	}
 
-	return nil, nil, fmt.Errorf("Todas as tentativas falharam: %w", lastErr)
+	w.settle(ctx, payment, &paymentAPIRequest, &result)
+	return nil, fmt.Errorf("Todas as tentativas falharam: %w", lastErr)
+}
+
+// settle resolve um pagamento cujo destino no processador é incerto: o
+// reconciliador confere se alguma tentativa foi aceita e grava o pagamento ou
+// o devolve à fila, com o ack. Se os processadores não responderem, a
+// intenção fica para a próxima rodada dele.
+func (w *Workers) settle(ctx context.Context, payment *dtos.PaymentRequest, request *dtos.PaymentAPIRequest, result *dispatchResult) {
+	intent := paymentIntent(payment, request, result, w.selector.GetActive(), result.attempts)
+	var err error
+	if result.attempts == 0 {
+		err = w.redisRepo.RequeueIntent(ctx, intent)
+	} else {
+		err = w.reconciler.resolve(ctx, intent)
+	}
+	if err != nil {
+		slog.Warn("Pagamento fica com o reconciliador", "correlationId", payment.CorrelationId, "err", err)
+	}
+}
+
+func paymentIntent(payment *dtos.PaymentRequest, request *dtos.PaymentAPIRequest, result *dispatchResult, api dtos.PaymentAPI, attempts int) *dtos.PaymentIntent {
+	return &dtos.PaymentIntent{
+		CorrelationId: request.CorrelationId,
+		Amount:        request.Amount,
+		Currency:      payment.Currency,
+		RequestedAt:   request.RequestedAt,
+		DispatchedAt:  result.dispatchedAt.UTC().Format("2006-01-02T15:04:05.000Z"),
+		Attempts:      attempts,
+		Api:           api,
+		RedisStreamId: payment.RedisStreamId,
+		Tenant:        payment.Tenant,
+		ClientId:      payment.ClientId,
+		CallbackUrl:   payment.CallbackUrl,
+	}
 }
 
 func (w *Workers) callPaymentAPI(ctx context.Context, url string, payment *dtos.PaymentAPIRequest) error {
+	if err := chaos.Inject(ctx, chaos.POINT_PAYMENT_API); err != nil {
+		return err
+	}
+
 	payload, err := json.Marshal(payment)
 	if err != nil {
 		return fmt.Errorf("Erro ao serializar pagamento: %w", err)
@@ -184,7 +408,17 @@ func (e *HTTPError) Error() string {
 	return fmt.Sprintf("HTTP error: %s", e.Status)
 }
 
-func (w *Workers) isRetryableError(err error) bool {
+// isAmbiguousError diz se a tentativa pode ter sido aceita apesar do erro:
+// sem resposta ou com erro do servidor. Um 429 é recusa explícita.
+func isAmbiguousError(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+func isRetryableError(err error) bool {
 	if httpErr, ok := err.(*HTTPError); ok {
 		switch httpErr.StatusCode {
 		case http.StatusInternalServerError, // 500